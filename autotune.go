@@ -0,0 +1,118 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"time"
+)
+
+// EncoderConfig is a set of Encoder options, in a form that can be inspected,
+// stored and compared. The zero value is the default configuration, whose
+// output is that of Encode.
+type EncoderConfig struct {
+	// DenseMatching and RunMatching are whether to use the options of the
+	// same name.
+	DenseMatching bool
+	RunMatching   bool
+
+	// SkipInit and SkipShift, if SkipInit is non-zero, are the parameters of
+	// the SkipHeuristic option.
+	SkipInit  int
+	SkipShift uint
+
+	// ProbeIncompressible is whether to use the option of the same name.
+	ProbeIncompressible bool
+}
+
+// Options returns the EncoderOption values that c describes, for passing to
+// NewEncoder.
+func (c EncoderConfig) Options() []EncoderOption {
+	var opts []EncoderOption
+	if c.DenseMatching {
+		opts = append(opts, DenseMatching())
+	}
+	if c.RunMatching {
+		opts = append(opts, RunMatching())
+	}
+	if c.SkipInit != 0 {
+		opts = append(opts, SkipHeuristic(c.SkipInit, c.SkipShift))
+	}
+	if c.ProbeIncompressible {
+		opts = append(opts, ProbeIncompressible())
+	}
+	return opts
+}
+
+// autoTuneConfigs are the configurations that AutoTune tries, from the
+// fastest to the most thorough, roughly.
+var autoTuneConfigs = []EncoderConfig{
+	{SkipInit: 128, SkipShift: 5},
+	{SkipInit: 64, SkipShift: 5},
+	{},
+	{SkipInit: 64, SkipShift: 6},
+	{RunMatching: true},
+	{SkipInit: 64, SkipShift: 6, RunMatching: true},
+	{DenseMatching: true},
+	{DenseMatching: true, RunMatching: true},
+}
+
+// AutoTune encodes sample with a range of Encoder configurations, and returns
+// the one that best trades encoding speed for output size on it. The sample
+// should be representative of the data to be encoded with the result.
+//
+// The configurations are timed for about budget in total, and each encodes
+// sample at least once however small budget is. Of those for which no other
+// configuration is both faster and gives smaller output, AutoTune returns the
+// one that gives the smallest output while still encoding at least half as
+// fast as the fastest. As with any benchmark, the timings, and therefore the
+// result, vary from run to run, and with the load on the machine.
+func AutoTune(sample []byte, budget time.Duration) EncoderConfig {
+	type result struct {
+		config EncoderConfig
+		size   int
+		speed  float64 // In bytes per second.
+	}
+	results := make([]result, len(autoTuneConfigs))
+	share := budget / time.Duration(len(autoTuneConfigs))
+	dst := make([]byte, MaxEncodedLen(len(sample)))
+	fastest := 0.0
+	for i, c := range autoTuneConfigs {
+		e := NewEncoder(c.Options()...)
+		start := time.Now()
+		var elapsed time.Duration
+		n := 0
+		for n == 0 || elapsed < share {
+			results[i].size = len(e.Encode(dst, sample))
+			n++
+			elapsed = time.Since(start)
+		}
+		if elapsed <= 0 {
+			elapsed = 1
+		}
+		results[i].config = c
+		results[i].speed = float64(n) * float64(len(sample)) / elapsed.Seconds()
+		if results[i].speed > fastest {
+			fastest = results[i].speed
+		}
+	}
+
+	best := -1
+	for i, r := range results {
+		dominated := false
+		for _, s := range results {
+			if s.speed > r.speed && s.size < r.size {
+				dominated = true
+				break
+			}
+		}
+		if dominated || 2*r.speed < fastest {
+			continue
+		}
+		if best < 0 || r.size < results[best].size || (r.size == results[best].size && r.speed > results[best].speed) {
+			best = i
+		}
+	}
+	return results[best].config
+}
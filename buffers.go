@@ -0,0 +1,85 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// EncodeBuffers is like Encode, but its input is the concatenation of the
+// fragments of src, which it encodes without concatenating them. Its output
+// is exactly what Encode would return for the concatenation, so matches are
+// found across fragment boundaries.
+//
+// The input is encoded in 64 KiB pieces, as by Encode. A piece that lies
+// within one fragment is encoded in place, and only pieces that straddle a
+// boundary are first copied into a 64 KiB buffer. So however long the input,
+// EncodeBuffers allocates at most that buffer, and dst if it is too short.
+//
+// src itself is not modified, unlike by net.Buffers' Read and WriteTo
+// methods.
+func EncodeBuffers(dst []byte, src net.Buffers) []byte {
+	n := 0
+	for _, b := range src {
+		n += len(b)
+	}
+	if m := MaxEncodedLen(n); m < 0 {
+		panic(ErrTooLarge)
+	} else if len(dst) < m {
+		dst = make([]byte, m)
+	}
+	d := binary.PutUvarint(dst, uint64(n))
+
+	// head is what remains of the current fragment, and bufs the fragments
+	// after it.
+	bufs := [][]byte(src)
+	var head, scratch []byte
+	for n > 0 {
+		k := n
+		if k > maxBlockSize {
+			k = maxBlockSize
+		}
+		n -= k
+		for len(head) == 0 {
+			head, bufs = bufs[0], bufs[1:]
+		}
+		var p []byte
+		if len(head) >= k {
+			p, head = head[:k], head[k:]
+		} else {
+			if scratch == nil {
+				scratch = make([]byte, maxBlockSize)
+			}
+			for len(p) < k {
+				for len(head) == 0 {
+					head, bufs = bufs[0], bufs[1:]
+				}
+				c := copy(scratch[len(p):k], head)
+				p, head = scratch[:len(p)+c], head[c:]
+			}
+		}
+		d += encodeTags(dst[d:], p, encodeBlock)
+	}
+	return dst[:d]
+}
+
+// WriteBuffers writes the fragments of bufs in turn, as successive calls to
+// Write would, and returns the number of bytes written. For a buffered Writer,
+// the fragments are gathered into the Writer's buffer, so its blocks span
+// fragment boundaries, without the fragments having to be concatenated first.
+//
+// bufs itself is not modified, unlike by net.Buffers' Read and WriteTo
+// methods.
+func (w *Writer) WriteBuffers(bufs net.Buffers) (n int64, err error) {
+	for _, b := range bufs {
+		m, err := w.Write(b)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
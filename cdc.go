@@ -0,0 +1,90 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+var errInvalidAvgBlockSize = errors.New("snappy: invalid average block size")
+
+// gearTable holds the random values that the content-defined chunking of a
+// Writer from NewCDCWriter hashes bytes to. They are generated by SplitMix64
+// from a fixed seed, so that the chunking is the same everywhere.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x736e61707079) // "snappy".
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// NewCDCWriter is like NewBufferedWriter, but the Writer returned chooses where
+// each block ends from the data itself, using content-defined chunking, rather
+// than always filling 64 KiB blocks. So the output depends only on the bytes
+// written, not on how they were split across calls to Write, and a change to
+// the data only changes the chunks around it. This suits content-addressed
+// storage that deduplicates chunks.
+//
+// A block ends where a rolling hash of its last 64 bytes has a particular
+// form, after at least avgBlockSize/2 bytes, or at 64 KiB. The block sizes
+// average roughly avgBlockSize, which must be in the range [64, 32768].
+// Otherwise, the Writer fails, with every call to Write, Flush or Close
+// returning an error.
+//
+// Calling Flush ends a block where the data alone would not, so the output
+// only depends on the data if Flush is not called before Close.
+func NewCDCWriter(w io.Writer, avgBlockSize int) *Writer {
+	x := NewBufferedWriter(w)
+	if avgBlockSize < 64 || avgBlockSize > maxBlockSize/2 {
+		x.err = errInvalidAvgBlockSize
+		x.optErr = x.err
+		return x
+	}
+	x.cdcMin = avgBlockSize / 2
+	// Beyond the minimum, each byte ends the block with probability 2^-b,
+	// making the mean block size the minimum plus 2^b.
+	b := bits.Len(uint(x.cdcMin)) - 1
+	x.cdcMask = ^uint64(0) << (64 - b)
+	return x
+}
+
+// writeCDC implements Write for a Writer from NewCDCWriter.
+func (w *Writer) writeCDC(p []byte) (nRet int, errRet error) {
+	for len(p) > 0 {
+		if w.err != nil {
+			return nRet, w.err
+		}
+		// Find the end of the current block, if it is within p. The hash's
+		// top bits depend on the last 64 bytes, which is what makes the block
+		// boundaries resynchronize after an insertion or deletion.
+		n, cut := len(w.ibuf), -1
+		h := w.cdcHash
+		for i, c := range p {
+			h = h<<1 + gearTable[c]
+			if n+i+1 >= w.cdcMin && h&w.cdcMask == 0 || n+i+1 == cap(w.ibuf) {
+				cut = i + 1
+				break
+			}
+		}
+		if cut < 0 {
+			w.ibuf = append(w.ibuf, p...)
+			w.cdcHash = h
+			return nRet + len(p), nil
+		}
+		w.ibuf = append(w.ibuf, p[:cut]...)
+		nRet += cut
+		p = p[cut:]
+		w.cdcHash = 0
+		w.Flush()
+	}
+	return nRet, w.err
+}
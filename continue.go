@@ -0,0 +1,315 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"encoding/binary"
+)
+
+// continueWindow is how far back into the blocks before it a block encoded by
+// EncodeBlockContinue may refer: the largest offset of a 2-byte-offset copy.
+const continueWindow = 1<<16 - 1
+
+// continueState is the state that EncodeBlockContinue keeps between blocks.
+type continueState struct {
+	// buf holds the window of previously encoded bytes, followed, during a
+	// call, by the block being encoded. pos is the position of buf[0] in the
+	// sequence of blocks since the last ResetContinue.
+	buf []byte
+	pos uint32
+
+	// table maps hashes to positions in the sequence of blocks, plus one, so
+	// that zero means no entry.
+	table [maxTableSize]uint32
+}
+
+// EncodeBlockContinue is like Encode, but the block returned may also copy
+// bytes from the blocks encoded by the previous calls since the Encoder was
+// created or last ResetContinue'd, up to 65535 bytes back. For continuous data
+// split into blocks, such as a stream of small messages, this compresses
+// better than independent blocks, as each block can refer to the data just
+// before it.
+//
+// The blocks returned can NOT be decoded by Decode, or on their own at all.
+// They must be decoded, in the same order and with none missing, by a
+// ContinueDecoder. If a block is lost, no later one can be decoded.
+//
+// EncodeBlockContinue uses the same matching as Encode, regardless of the
+// Encoder's options, and does not affect the Encoder's other methods.
+func (e *Encoder) EncodeBlockContinue(dst, src []byte) []byte {
+	if n := MaxEncodedLen(len(src)); n < 0 {
+		panic(ErrTooLarge)
+	} else if len(dst) < n {
+		dst = make([]byte, n)
+	}
+	if e.cont == nil {
+		e.cont = &continueState{}
+	}
+	c := e.cont
+	if uint64(c.pos)+uint64(len(c.buf))+uint64(len(src)) >= 1<<31 {
+		// Start positions again from zero, rather than let them overflow. The
+		// table's entries are lost, but the window is kept.
+		c.table = [maxTableSize]uint32{}
+		c.pos = 0
+	}
+	dst = c.encode(dst, src)
+
+	// Keep the last continueWindow bytes as the window for the next block.
+	if n := len(c.buf) - continueWindow; n > 0 {
+		c.pos += uint32(n)
+		c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+	}
+	return dst
+}
+
+// encode appends src to the window, and encodes it into dst, which must be
+// at least MaxEncodedLen(len(src)) bytes long, as a block that may refer to
+// the window.
+func (c *continueState) encode(dst, src []byte) []byte {
+	start := len(c.buf)
+	c.buf = append(c.buf, src...)
+	d := binary.PutUvarint(dst, uint64(len(src)))
+	if len(src) > 0 {
+		d += c.encodeBlock(dst[d:], start)
+	}
+	return dst[:d]
+}
+
+// ResetContinue makes the next call to EncodeBlockContinue start a new
+// sequence of blocks, which does not refer to the blocks before it.
+func (e *Encoder) ResetContinue() {
+	if e.cont != nil {
+		e.cont.buf = e.cont.buf[:0]
+		e.cont.table = [maxTableSize]uint32{}
+		e.cont.pos = 0
+	}
+}
+
+// encodeBlock encodes c.buf[start:], which must be non-empty, into dst,
+// looking for matches in all of c.buf, and returns the number of bytes
+// written. It follows the encodeBlock function in encode_other.go, with the
+// hash table holding positions in the whole sequence of blocks.
+func (c *continueState) encodeBlock(dst []byte, start int) (d int) {
+	const shift = 32 - 14
+	src := c.buf
+	nextEmit := start
+	if len(src)-start < minNonLiteralBlockSize {
+		return emitLongLiteral(dst, src[nextEmit:])
+	}
+	// lookup returns the position in src that the table holds for hash h, or
+	// -1 if there is none within reach of position s, and records s instead.
+	lookup := func(h uint32, s int) int {
+		v := c.table[h&tableMask]
+		c.table[h&tableMask] = c.pos + uint32(s) + 1
+		candidate := int(v) - 1 - int(c.pos)
+		if v == 0 || candidate < 0 || s-candidate > continueWindow {
+			return -1
+		}
+		return candidate
+	}
+
+	sLimit := len(src) - inputMargin
+	s := start
+	nextHash := hash(load32(src, s), shift)
+	for {
+		skip := 32
+		nextS := s
+		candidate := 0
+		for {
+			s = nextS
+			bytesBetweenHashLookups := skip >> 5
+			nextS = s + bytesBetweenHashLookups
+			skip += bytesBetweenHashLookups
+			if nextS > sLimit {
+				goto emitRemainder
+			}
+			candidate = lookup(nextHash, s)
+			nextHash = hash(load32(src, nextS), shift)
+			if candidate >= 0 && load32(src, s) == load32(src, candidate) {
+				break
+			}
+		}
+
+		if nextEmit < s {
+			d += emitLongLiteral(dst[d:], src[nextEmit:s])
+		}
+
+		for {
+			base := s
+			s += 4
+			for i := candidate + 4; s < len(src) && src[i] == src[s]; i, s = i+1, s+1 {
+			}
+
+			d += emitCopy(dst[d:], base-candidate, s-base)
+			nextEmit = s
+			if s >= sLimit {
+				goto emitRemainder
+			}
+
+			x := load64(src, s-1)
+			lookup(hash(uint32(x>>0), shift), s-1)
+			candidate = lookup(hash(uint32(x>>8), shift), s)
+			if candidate < 0 || uint32(x>>8) != load32(src, candidate) {
+				nextHash = hash(uint32(x>>16), shift)
+				s++
+				break
+			}
+		}
+	}
+
+emitRemainder:
+	if nextEmit < len(src) {
+		d += emitLongLiteral(dst[d:], src[nextEmit:])
+	}
+	return d
+}
+
+// emitLongLiteral is like emitLiteral, but lit may be longer than 65536 bytes,
+// as the blocks passed to EncodeBlockContinue and EncodeLiteralsOnly may be,
+// in which case it is emitted as several literals.
+func emitLongLiteral(dst, lit []byte) (d int) {
+	for len(lit) > maxBlockSize {
+		d += emitLiteral(dst[d:], lit[:maxBlockSize])
+		lit = lit[maxBlockSize:]
+	}
+	return d + emitLiteral(dst[d:], lit)
+}
+
+// A ContinueDecoder decodes a sequence of blocks encoded by an Encoder's
+// EncodeBlockContinue method, which may refer to the blocks before them. It
+// keeps the last 65535 bytes decoded, for the next block to refer to.
+type ContinueDecoder struct {
+	// buf holds the window of previously decoded bytes, followed, during a
+	// call, by the block being decoded.
+	buf []byte
+	err error
+}
+
+// NewContinueDecoder returns a new ContinueDecoder, for the first block of a
+// sequence.
+func NewContinueDecoder() *ContinueDecoder {
+	return &ContinueDecoder{}
+}
+
+// Reset makes the ContinueDecoder ready for the first block of a new sequence.
+func (c *ContinueDecoder) Reset() {
+	c.buf = c.buf[:0]
+	c.err = nil
+}
+
+// Decode returns the decoded form of src, the next block of the sequence. The
+// returned slice may be a sub-slice of dst if dst was large enough to hold the
+// entire decoded block. Otherwise, a newly allocated slice will be returned.
+//
+// If src is not valid, Decode returns ErrCorrupt, or the error that the
+// package-level Decode would. The ContinueDecoder then returns that error for
+// every later block, until it is Reset, as they may refer to the bytes that
+// could not be decoded.
+func (c *ContinueDecoder) Decode(dst, src []byte) ([]byte, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	start := len(c.buf)
+	dLen, s, err := decodedLen(src)
+	if err == nil {
+		// As with ValidateBlockHeader, reject an implausible length before
+		// allocating for it.
+		if !plausibleLen(dLen, len(src)-s) {
+			err = ErrCorrupt
+		} else {
+			err = c.decodeBlock(src[s:], dLen)
+		}
+	}
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+	if dLen > len(dst) {
+		dst = make([]byte, dLen)
+	}
+	dst = dst[:copy(dst, c.buf[start:])]
+	if n := len(c.buf) - continueWindow; n > 0 {
+		c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+	}
+	return dst, nil
+}
+
+// decodeBlock appends the dLen bytes that the tags src decode to to c.buf.
+func (c *ContinueDecoder) decodeBlock(src []byte, dLen int) error {
+	end := len(c.buf) + dLen
+	if cap(c.buf) < end {
+		buf := make([]byte, len(c.buf), end)
+		copy(buf, c.buf)
+		c.buf = buf
+	}
+	d, s := len(c.buf), 0
+	buf := c.buf[:end]
+	for s < len(src) {
+		tag := src[s]
+		var length, offset int
+		switch tag & 0x03 {
+		case tagLiteral:
+			x := uint32(tag >> 2)
+			n := 0
+			if x >= 60 {
+				// The length is in the next 1-4 bytes, little-endian.
+				n = int(x) - 59
+				if len(src)-s-1 < n {
+					return ErrCorrupt
+				}
+				x = 0
+				for i := n; i > 0; i-- {
+					x = x<<8 | uint32(src[s+i])
+				}
+			}
+			length = int(x) + 1
+			if length <= 0 {
+				return errUnsupportedLiteralLength
+			}
+			s += 1 + n
+			if length > len(src)-s || length > end-d {
+				return ErrCorrupt
+			}
+			copy(buf[d:], src[s:s+length])
+			d += length
+			s += length
+			continue
+
+		case tagCopy1:
+			if len(src)-s < 2 {
+				return ErrCorrupt
+			}
+			length = 4 + int(tag)>>2&0x7
+			offset = int(uint32(tag)&0xe0<<3 | uint32(src[s+1]))
+			s += 2
+		case tagCopy2:
+			if len(src)-s < 3 {
+				return ErrCorrupt
+			}
+			length = 1 + int(tag)>>2
+			offset = int(uint32(src[s+1]) | uint32(src[s+2])<<8)
+			s += 3
+		case tagCopy4:
+			if len(src)-s < 5 {
+				return ErrCorrupt
+			}
+			length = 1 + int(tag)>>2
+			offset = int(uint32(src[s+1]) | uint32(src[s+2])<<8 | uint32(src[s+3])<<16 | uint32(src[s+4])<<24)
+			s += 5
+		}
+		if offset <= 0 || offset > d || length > end-d {
+			return ErrCorrupt
+		}
+		// The copy may overlap its own output, so copy byte by byte.
+		for i := d - offset; length > 0; i, d, length = i+1, d+1, length-1 {
+			buf[d] = buf[i]
+		}
+	}
+	if d != end {
+		return ErrCorrupt
+	}
+	c.buf = buf
+	return nil
+}
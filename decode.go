@@ -5,9 +5,14 @@
 package snappy
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"net"
 )
 
 var (
@@ -17,8 +22,20 @@ var (
 	ErrTooLarge = errors.New("snappy: decoded block is too large")
 	// ErrUnsupported reports that the input isn't supported.
 	ErrUnsupported = errors.New("snappy: unsupported input")
+	// ErrInvalidUnreadBlock reports that UnreadBlock was called when there
+	// was no block to unread.
+	ErrInvalidUnreadBlock = errors.New("snappy: invalid use of UnreadBlock")
+	// ErrStreamChecksum reports that the checksum of a whole stream, recorded
+	// by its end-of-stream marker, does not match the data read. The data
+	// chunks were each intact, so the stream's chunks were reordered, lost or
+	// duplicated.
+	ErrStreamChecksum = errors.New("snappy: stream checksum mismatch")
+	// ErrDecodedLimit reports that a stream decodes to more than the limit
+	// set by Reader.SetTotalDecodedLimit.
+	ErrDecodedLimit = errors.New("snappy: decoded data exceeds the limit")
 
 	errUnsupportedLiteralLength = errors.New("snappy: unsupported literal length")
+	errShortPoolBuffer          = errors.New("snappy: buffer pool returned a short buffer")
 )
 
 // DecodedLen returns the length of the decoded block.
@@ -27,11 +44,43 @@ func DecodedLen(src []byte) (int, error) {
 	return v, err
 }
 
+// ValidateBlockHeader cheaply checks that the header of the block src, its
+// decoded length, is plausible for the block's size, without decoding the
+// block. It is meant as a pre-filter for untrusted input, to be applied
+// before allocating a buffer of the decoded length. It returns the error that
+// DecodedLen would, or ErrCorrupt if:
+//
+//   - the decoded length is more than 64/3 times the length of the rest of
+//     the block, as no tag decodes to more than 64 bytes from 3;
+//   - the decoded length is zero but the block has tags, or non-zero but it
+//     has none; or
+//   - the first tag is not a literal, as a copy needs earlier bytes to copy.
+//
+// A nil error does not mean that the block is valid, only that its header is
+// not obviously wrong. Decode still checks the whole block.
+func ValidateBlockHeader(src []byte) error {
+	dLen, s, err := decodedLen(src)
+	if err != nil {
+		return err
+	}
+	rest := len(src) - s
+	if !plausibleLen(dLen, rest) || (dLen == 0) != (rest == 0) {
+		return ErrCorrupt
+	}
+	if rest > 0 && src[s]&0x03 != tagLiteral {
+		return ErrCorrupt
+	}
+	return nil
+}
+
 // decodedLen returns the length of the decoded block and the number of bytes
-// that the length header occupied.
+// that the length header occupied. The header must be a uvarint of at most
+// 0xffffffff, in its shortest form: an overlong encoding, with trailing zero
+// bytes, is rejected as corrupt, as no encoder writes one and it would let a
+// block have more than one valid encoding of its header.
 func decodedLen(src []byte) (blockLen, headerLen int, err error) {
 	v, n := binary.Uvarint(src)
-	if n <= 0 || v > 0xffffffff {
+	if n <= 0 || v > 0xffffffff || n > 1 && src[n-1] == 0 {
 		return 0, 0, ErrCorrupt
 	}
 
@@ -42,6 +91,13 @@ func decodedLen(src []byte) (blockLen, headerLen int, err error) {
 	return int(v), n, nil
 }
 
+// plausibleLen returns whether tags of tagsLen bytes could decode to dLen
+// bytes. No tag decodes to more than 64 bytes from 3, so a longer decoded
+// length is corrupt, and need not be allocated to find that out.
+func plausibleLen(dLen, tagsLen int) bool {
+	return uint64(dLen)*3 <= uint64(tagsLen)*64
+}
+
 const (
 	decodeErrCodeCorrupt                  = 1
 	decodeErrCodeUnsupportedLiteralLength = 2
@@ -52,13 +108,42 @@ const (
 // Otherwise, a newly allocated slice will be returned.
 //
 // The dst and src must not overlap. It is valid to pass a nil dst.
+//
+// On success, the returned slice is never nil, even if the decoded block is
+// empty.
+//
+// Decode is safe to use on untrusted input: it never panics or reads or writes
+// out of bounds, whatever src holds, but returns an error if src is not a
+// valid block. Both the assembly and the pure Go implementations check every
+// literal length and copy offset and length against the bounds of src and
+// dst. This is checked by FuzzDecode.
+//
+// The decoded length that src's header claims is checked before any
+// allocation: it must be at most 0xffffffff, in the shortest varint encoding,
+// and at most 64/3 times the length of the rest of src, which is the most that
+// any valid block decodes to. Otherwise, Decode returns ErrCorrupt. So
+// Decode(nil, src) never allocates more than about 21 times len(src), but that
+// may still be up to 4 GiB. DecodeLimited takes a tighter limit.
 func Decode(dst, src []byte) ([]byte, error) {
+	return DecodeLimited(dst, src, int(^uint(0)>>1))
+}
+
+// DecodeLimited is like Decode, but returns ErrTooLarge, without decoding or
+// allocating anything, if src's header claims a decoded length of more than
+// maxLen bytes. It is for untrusted input whose decoded size the caller can
+// bound, such as a network message with a maximum size.
+func DecodeLimited(dst, src []byte, maxLen int) ([]byte, error) {
 	dLen, s, err := decodedLen(src)
 	if err != nil {
 		return nil, err
 	}
-	if dLen <= len(dst) {
+	if dLen > maxLen {
+		return nil, ErrTooLarge
+	}
+	if dst != nil && dLen <= len(dst) {
 		dst = dst[:dLen]
+	} else if !plausibleLen(dLen, len(src)-s) {
+		return nil, ErrCorrupt
 	} else {
 		dst = make([]byte, dLen)
 	}
@@ -71,15 +156,186 @@ func Decode(dst, src []byte) ([]byte, error) {
 	return nil, ErrCorrupt
 }
 
+// DecodeInto decodes src into dst, returning the number of bytes decoded. It
+// never allocates: if dst is shorter than the decoded length, which DecodedLen
+// reports, it returns io.ErrShortBuffer without decoding anything. This lets
+// callers decode into memory that they manage themselves.
+//
+// The dst and src must not overlap.
+func DecodeInto(dst, src []byte) (n int, err error) {
+	dLen, s, err := decodedLen(src)
+	if err != nil {
+		return 0, err
+	}
+	if dLen > len(dst) {
+		return 0, io.ErrShortBuffer
+	}
+	switch decode(dst[:dLen], src[s:]) {
+	case 0:
+		return dLen, nil
+	case decodeErrCodeUnsupportedLiteralLength:
+		return 0, errUnsupportedLiteralLength
+	}
+	return 0, ErrCorrupt
+}
+
+// DecodeRawBlock is like Decode, but src holds just the tags of a block,
+// without the varint-encoded decoded length that a block starts with. That
+// length is passed as decodedLen instead, for formats that store it
+// separately. It returns ErrCorrupt if the tags do not decode to exactly
+// decodedLen bytes.
+func DecodeRawBlock(dst, src []byte, decodedLen int) ([]byte, error) {
+	if decodedLen < 0 || uint64(decodedLen) > 0xffffffff {
+		return nil, ErrCorrupt
+	}
+	if dst != nil && decodedLen <= len(dst) {
+		dst = dst[:decodedLen]
+	} else if !plausibleLen(decodedLen, len(src)) {
+		return nil, ErrCorrupt
+	} else {
+		dst = make([]byte, decodedLen)
+	}
+	switch decode(dst, src) {
+	case 0:
+		return dst, nil
+	case decodeErrCodeUnsupportedLiteralLength:
+		return nil, errUnsupportedLiteralLength
+	}
+	return nil, ErrCorrupt
+}
+
+// DecodeNoCopy is like Decode, except that if the entire block is a single
+// literal, as is typical for incompressible input, the returned slice is a
+// sub-slice of src instead of a copy. The aliased result reports whether that
+// happened, in which case the caller must not modify src, or the returned
+// slice, for as long as either is in use.
+//
+// Blocks that contain more than one tag are decoded into a newly allocated
+// slice, exactly as Decode(nil, src) would do.
+func DecodeNoCopy(src []byte) (dst []byte, aliased bool, err error) {
+	dLen, s, err := decodedLen(src)
+	if err != nil {
+		return nil, false, err
+	}
+	if lit, ok := singleLiteral(src[s:], dLen); ok {
+		return lit, true, nil
+	}
+	dst, err = Decode(nil, src)
+	return dst, false, err
+}
+
+// DecodeAndCRC decodes the block src, and returns the decoded bytes along with
+// their masked CRC-32C checksum, which is what a chunk of the framing format
+// holding those bytes would record as its checksum.
+func DecodeAndCRC(src []byte) (decoded []byte, maskedCRC uint32, err error) {
+	decoded, err = Decode(nil, src)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decoded, crc(decoded), nil
+}
+
+// singleLiteral returns the literal bytes of src if src consists of exactly
+// one literal tag whose length is dLen.
+func singleLiteral(src []byte, dLen int) ([]byte, bool) {
+	if len(src) == 0 || src[0]&0x03 != tagLiteral {
+		return nil, false
+	}
+	x, s := uint32(src[0]>>2), 1
+	if x >= 60 {
+		s += int(x) - 59
+		if s > len(src) {
+			return nil, false
+		}
+		x = 0
+		for i := s - 1; i > 0; i-- {
+			x = x<<8 | uint32(src[i])
+		}
+	}
+	if uint64(x)+1 != uint64(dLen) || len(src)-s != dLen {
+		return nil, false
+	}
+	return src[s:], true
+}
+
 // NewReader returns a new Reader that decompresses from r, using the framing
 // format described at
 // https://github.com/google/snappy/blob/master/framing_format.txt
+//
+// If r is a *bufio.Reader, chunk bodies that fit in its buffer are decoded in
+// place rather than first being copied into the Reader's own buffer.
+//
+// The Reader reads exactly the bytes of each chunk from r, never any further,
+// and only reads the next chunk once the caller has read everything decoded
+// from the previous one. So a stream embedded in a larger file can be read
+// through an io.SectionReader that ends where the stream ends, with Read
+// returning io.EOF there, and leaving whatever follows untouched.
 func NewReader(r io.Reader) *Reader {
-	return &Reader{
-		r:       r,
-		decoded: make([]byte, maxBlockSize),
-		buf:     make([]byte, maxEncodedLenOfMaxBlockSize+checksumSize),
+	x := &Reader{
+		buf: make([]byte, maxEncodedLenOfMaxBlockSize+checksumSize),
+	}
+	x.setSource(r)
+	return x
+}
+
+// NewAutoReader returns an io.Reader of the decompressed contents of r, which
+// holds either a stream in the framing format or a single block as returned by
+// Encode.
+//
+// It tells them apart by peeking at the first 10 bytes of r: a stream in the
+// framing format starts with its stream identifier chunk, and is read with a
+// Reader as usual. Otherwise, r is assumed to hold exactly one block, which is
+// read in full and decoded before NewAutoReader returns, so any error in
+// reading or decoding it is returned then. No valid block starts with a
+// stream identifier chunk, so valid input is never misidentified. But a framed
+// stream that is truncated within its first 10 bytes, or that does not start
+// with a stream identifier, is treated as a block, and usually reported as
+// ErrCorrupt. Multiple concatenated blocks are not supported.
+func NewAutoReader(r io.Reader) (io.Reader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(r, maxEncodedLenOfMaxBlockSize+checksumSize)
+	}
+	if p, _ := br.Peek(len(magicChunk)); string(p) == magicChunk {
+		return NewReader(br), nil
+	}
+	src, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
 	}
+	dst, err := Decode(nil, src)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(dst), nil
+}
+
+// NewReadCloser is like NewReader, but the returned io.ReadCloser's Close
+// method closes rc, such as an HTTP response body, when the caller is done.
+func NewReadCloser(rc io.ReadCloser) io.ReadCloser {
+	return readCloser{NewReader(rc), rc}
+}
+
+// NewVerifiedReader is like NewReader, but the Reader returned also checks the
+// end-of-stream marker written by a Writer from
+// NewBufferedWriterWithTerminator, which records the checksum of all of the
+// stream's uncompressed data. If that does not match the data read, Read
+// returns ErrStreamChecksum. This catches chunks that were dropped, duplicated
+// or reordered, which the per-chunk checksums cannot.
+//
+// A stream without the marker is read as usual, unless SetRequireTerminator is
+// also used, in which case it is reported as truncated. Each marker covers the
+// data since the stream identifier that starts its stream, so concatenated
+// streams are verified separately, whether or not each of them has a marker.
+func NewVerifiedReader(r io.Reader) *Reader {
+	x := NewReader(r)
+	x.verifyStream = true
+	return x
+}
+
+type readCloser struct {
+	*Reader
+	io.Closer
 }
 
 // Reader is an io.Reader that can read Snappy-compressed bytes.
@@ -91,21 +347,250 @@ type Reader struct {
 	// decoded[i:j] contains decoded bytes that have not yet been passed on.
 	i, j       int
 	readHeader bool
+	// optionalHeader is whether the stream may start with a data chunk
+	// instead of a stream identifier.
+	optionalHeader bool
+	// canUnread is whether UnreadBlock may rewind r.i to the start of the
+	// current block.
+	canUnread bool
+
+	// br is r as a *bufio.Reader, if it is one. brSkip is the number of
+	// bytes returned by br.Peek that must be discarded before reading more.
+	br     *bufio.Reader
+	brSkip int
+
+	// messageEnd is whether the last chunk read by decodeBlock was an
+	// end-of-message marker written by a MessageWriter, in which case
+	// messageLen is the length that it declared, or -1 if it was malformed,
+	// and messageSum the checksum that it recorded, if hasMessageSum.
+	// messageSumFunc, if non-nil, is the function set by
+	// SetMessageChecksum.
+	messageEnd     bool
+	messageLen     int64
+	messageSum     uint32
+	hasMessageSum  bool
+	messageSumFunc func([]byte) uint32
+
+	// requireTerminator is whether a stream must end with an end-of-stream
+	// chunk, and terminated is whether the last chunk read was one.
+	requireTerminator bool
+	terminated        bool
+
+	// allowReserved is whether reserved unskippable chunks are passed to
+	// reservedHandler, if set, instead of being rejected.
+	allowReserved   bool
+	reservedHandler func(chunkType byte, body []byte) error
+
+	// maxRead, if positive, is the most bytes that Read returns at once.
+	maxRead int
+
+	// noChecksum is whether data chunks lack the checksum field.
+	noChecksum bool
+
+	// streamLen is the length recorded by a stream length chunk, if
+	// hasStreamLen.
+	streamLen    int64
+	hasStreamLen bool
+
+	// params are the parameters recorded by a parameter header chunk, if
+	// hasParams.
+	params    StreamParams
+	hasParams bool
+
+	// verifyStream is whether end-of-stream markers are checked against
+	// streamCRC, the unmasked CRC-32C of the data decoded since the last
+	// stream identifier or marker.
+	verifyStream bool
+	streamCRC    uint32
+
+	// srcPos is the number of bytes consumed from r, and blockStart and
+	// blockEnd are the positions in r of the chunk of the last block decoded.
+	srcPos     int64
+	blockStart int64
+	blockEnd   int64
+
+	// getBuf and putBuf are the buffer pool set by SetBufferPool, and
+	// putDecoded, if non-nil, is the function that decoded, which came from
+	// a pool, must be returned with.
+	getBuf     func(n int) []byte
+	putBuf     func(b []byte)
+	putDecoded func(b []byte)
+
+	// decodedLimit, if positive, is the most bytes that the stream may decode
+	// to, and decodedTotal is the number of bytes decoded so far.
+	decodedLimit int64
+	decodedTotal int64
+
+	// trackStored is whether to record the storedRanges of the decoded data
+	// that came from uncompressed data chunks, and stored is whether the last
+	// block decoded came from one.
+	trackStored  bool
+	stored       bool
+	storedRanges []Range
+}
+
+// A Range is a range of positions in a stream, [Start, End).
+type Range struct {
+	Start, End int64
 }
 
 // Reset discards any buffered data, resets all state, and switches the Snappy
 // reader to read from r. This permits reusing a Reader rather than allocating
 // a new one.
 func (r *Reader) Reset(reader io.Reader) {
-	r.r = reader
+	r.releaseBlock()
+	r.setSource(reader)
 	r.err = nil
 	r.i = 0
 	r.j = 0
+	r.canUnread = false
 	r.readHeader = false
+	r.messageEnd = false
+	r.terminated = false
+	r.streamLen, r.hasStreamLen = 0, false
+	r.params, r.hasParams = StreamParams{}, false
+	r.decodedTotal = 0
+	r.storedRanges = r.storedRanges[:0]
+	r.streamCRC = 0
+	r.srcPos, r.blockStart, r.blockEnd = 0, 0, 0
+}
+
+// SetRequireTerminator sets whether the Reader requires the stream to end with
+// the end-of-stream marker written by a Writer from
+// NewBufferedWriterWithTerminator. If so, a stream that ends anywhere else,
+// such as one that was cut short by a crash, is reported as truncated with
+// io.ErrUnexpectedEOF instead of ending with io.EOF.
+//
+// The setting survives Reset.
+func (r *Reader) SetRequireTerminator(require bool) {
+	r.requireTerminator = require
+}
+
+// SetTrackStoredRanges sets whether the Reader records the ranges of the
+// decoded data that were stored uncompressed in the stream, in uncompressed
+// data chunks, as a Writer does with data that does not compress. They are
+// returned by StoredRanges, to find out which parts of the data resisted
+// compression, such as already compressed content embedded in it. By default,
+// they are not recorded, as their number grows with the stream.
+//
+// The setting survives Reset.
+func (r *Reader) SetTrackStoredRanges(track bool) {
+	r.trackStored = track
+}
+
+// StoredRanges returns the ranges of positions in the decoded data that were
+// stored uncompressed, of the blocks decoded so far, in order, with adjacent
+// ranges merged. Positions count the bytes decoded since the Reader was
+// created or last Reset. It returns nil unless SetTrackStoredRanges(true) was
+// called before the blocks were decoded.
+//
+// The Reader decodes a block when a Read needs its first byte, so after a
+// Read, the ranges cover all of the data returned so far, and possibly the
+// rest of the block that the last byte came from. The returned slice must
+// not be modified, and is only valid until the next call to a method of the
+// Reader.
+func (r *Reader) StoredRanges() []Range {
+	if len(r.storedRanges) == 0 {
+		return nil
+	}
+	return r.storedRanges
+}
+
+// SetRequireStreamHeader sets whether the Reader requires the stream to start
+// with a stream identifier, as the framing format does, and as is the
+// default. If not, a stream may also start straight with a compressed or
+// uncompressed data chunk, for interoperating with encoders that omit the
+// identifier. Any other first chunk is still rejected with ErrCorrupt.
+//
+// The setting survives Reset.
+func (r *Reader) SetRequireStreamHeader(require bool) {
+	r.optionalHeader = !require
+}
+
+// startStream checks that chunkType is a valid type for the first chunk of
+// the stream, setting r.err to ErrCorrupt if not.
+func (r *Reader) startStream(chunkType byte) bool {
+	switch {
+	case chunkType == chunkTypeStreamIdentifier:
+	case r.optionalHeader && (chunkType == chunkTypeCompressedData || chunkType == chunkTypeUncompressedData):
+	default:
+		r.err = ErrCorrupt
+		return false
+	}
+	r.readHeader = true
+	return true
+}
+
+// SetTotalDecodedLimit sets the most bytes that the stream may decode to, if
+// n is positive, to guard against untrusted streams that decode to far more
+// data than expected, even though each block is within bounds. Once a block
+// would take the total over n, Read returns ErrDecodedLimit instead of that
+// block's bytes, so the bytes returned before the error may fall short of n
+// by up to a block. By default, or if n is zero or negative, there is no
+// limit.
+//
+// The total counts from when the Reader was created or last Reset. The setting
+// survives Reset.
+func (r *Reader) SetTotalDecodedLimit(n int64) {
+	r.decodedLimit = n
+}
+
+// SetMaxReadSize sets the most bytes that each call to Read returns, if n is
+// positive. The rest of a decoded block is kept for subsequent calls. By
+// default, or if n is zero or negative, a Read returns as much of the current
+// block as fits in its buffer, which may be up to 64 KiB.
+//
+// The setting survives Reset.
+func (r *Reader) SetMaxReadSize(n int) {
+	r.maxRead = n
+}
+
+// SetNoChecksumFormat sets whether the Reader reads a non-standard variant of
+// the framing format, produced by some other tools, in which data chunks do
+// not start with the 4-byte checksum of their data: their bodies are just a
+// block, as produced by Encode, or the uncompressed data. The data is then
+// not checked at all, beyond the validity of each block.
+//
+// The variant is incompatible with the standard format: a standard stream
+// read as the variant, or the other way around, fails, or worse, is
+// misread. Only use this for input that is known to be in the variant, from
+// a producer that cannot be changed. No Writer in this package produces it.
+//
+// The setting survives Reset.
+func (r *Reader) SetNoChecksumFormat(noChecksum bool) {
+	r.noChecksum = noChecksum
+}
+
+// checksumSize returns the length of the checksum at the start of the bodies
+// of data chunks.
+func (r *Reader) checksumSize() int {
+	if r.noChecksum {
+		return 0
+	}
+	return checksumSize
+}
+
+func (r *Reader) setSource(reader io.Reader) {
+	r.r = reader
+	r.br, _ = reader.(*bufio.Reader)
+	r.brSkip = 0
+}
+
+// discardPeeked consumes the bytes last returned by readBody, if they were
+// peeked at rather than read.
+func (r *Reader) discardPeeked() {
+	if r.brSkip > 0 {
+		r.br.Discard(r.brSkip)
+		r.brSkip = 0
+	}
 }
 
 func (r *Reader) readFull(p []byte, allowEOF bool) (ok bool) {
-	if _, r.err = io.ReadFull(r.r, p); r.err != nil {
+	r.discardPeeked()
+	var n int
+	n, r.err = io.ReadFull(r.r, p)
+	r.srcPos += int64(n)
+	if r.err != nil {
 		if r.err == io.ErrUnexpectedEOF || (r.err == io.EOF && !allowEOF) {
 			r.err = ErrCorrupt
 		}
@@ -114,32 +599,350 @@ func (r *Reader) readFull(p []byte, allowEOF bool) (ok bool) {
 	return true
 }
 
+// SetAllowReserved sets whether the Reader accepts chunks of the types that
+// the framing format reserves for future unskippable chunks, 0x02 to 0x7f. By
+// default, as the format requires, it stops with ErrUnsupported at such a
+// chunk. If allowed, each one is passed to the function set by
+// SetReservedChunkHandler, or skipped if there is none.
+//
+// This is meant for experimenting with extensions of the format. Streams that
+// rely on it cannot be read by other implementations, or by default Readers.
+// The setting survives Reset.
+func (r *Reader) SetAllowReserved(allow bool) {
+	r.allowReserved = allow
+}
+
+// SetReservedChunkHandler sets the function that a Reader for which reserved
+// chunks are allowed calls with each one's type and body. The body is only
+// valid for the duration of the call. If the function returns an error, the
+// Reader stops, and returns that error from Read.
+//
+// The setting survives Reset.
+func (r *Reader) SetReservedChunkHandler(h func(chunkType byte, body []byte) error) {
+	r.reservedHandler = h
+}
+
+// readChunkHeader reads the next chunk header into r.buf[:4]. At the end of the
+// stream, it returns false with r.err set to io.EOF, or to io.ErrUnexpectedEOF
+// if a terminator was required but the last chunk was not one.
+func (r *Reader) readChunkHeader() (ok bool) {
+	if !r.readFull(r.buf[:4], true) {
+		if r.err == io.EOF && r.requireTerminator && !r.terminated {
+			r.err = io.ErrUnexpectedEOF
+		}
+		return false
+	}
+	r.terminated = r.buf[0] == chunkTypeEndOfStream
+	return true
+}
+
+// readBody returns the next n bytes of the underlying reader, which are only
+// valid until the next read. When reading from a *bufio.Reader, they are
+// peeked at in its buffer instead of being copied into r.buf.
+func (r *Reader) readBody(n int) (body []byte, ok bool) {
+	if r.br != nil && n <= r.br.Size() {
+		r.discardPeeked()
+		if body, err := r.br.Peek(n); err == nil {
+			r.brSkip = n
+			r.srcPos += int64(n)
+			return body, true
+		}
+		// Fall back to readFull, which reports the error.
+	}
+	body = r.buf[:n]
+	return body, r.readFull(body, false)
+}
+
+// NextChunk reads the next chunk of the stream, and returns its type and its
+// raw body, without decoding it or verifying its checksum. For data chunks
+// (types 0x00 and 0x01), the body starts with the 4-byte masked checksum,
+// unless SetNoChecksumFormat is in effect. The
+// body is only valid until the next call to a method of the Reader. It
+// returns io.EOF at the end of the stream.
+//
+// NextChunk checks the framing of the stream, as Read does: the stream must
+// start with a well-formed stream identifier, and data chunks must be long
+// enough to hold a checksum. All other chunks, including the stream
+// identifiers, padding and reserved chunks, are returned as they are, for the
+// caller to inspect, decode or skip. It is meant for tools that analyze or
+// repair streams, and should not be mixed with Read.
+func (r *Reader) NextChunk() (chunkType byte, body []byte, err error) {
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	if !r.readChunkHeader() {
+		return 0, nil, r.err
+	}
+	chunkType = r.buf[0]
+	if !r.readHeader && !r.startStream(chunkType) {
+		return 0, nil, r.err
+	}
+	chunkLen := int(r.buf[1]) | int(r.buf[2])<<8 | int(r.buf[3])<<16
+	if chunkLen > len(r.buf) {
+		r.err = ErrUnsupported
+		return 0, nil, r.err
+	}
+	body, ok := r.readBody(chunkLen)
+	if !ok {
+		return 0, nil, r.err
+	}
+	switch chunkType {
+	case chunkTypeCompressedData, chunkTypeUncompressedData:
+		if chunkLen < r.checksumSize() {
+			r.err = ErrCorrupt
+			return 0, nil, r.err
+		}
+	case chunkTypeStreamIdentifier:
+		if string(body) != magicBody {
+			r.err = ErrCorrupt
+			return 0, nil, r.err
+		}
+	}
+	return chunkType, body, nil
+}
+
 // Read satisfies the io.Reader interface.
 func (r *Reader) Read(p []byte) (int, error) {
 	if r.err != nil {
 		return 0, r.err
 	}
+	if !r.fill() {
+		return 0, r.err
+	}
+	if r.maxRead > 0 && len(p) > r.maxRead {
+		p = p[:r.maxRead]
+	}
+	n := copy(p, r.decoded[r.i:r.j])
+	r.i += n
+	r.canUnread = true
+	return n, nil
+}
+
+// Discard skips the next n decoded bytes, returning the number of bytes
+// discarded. If it discards fewer than n bytes, it also returns an error,
+// which is io.EOF if the stream ended cleanly first.
+//
+// The blocks are decoded as usual, so that their checksums are verified, but
+// are not copied anywhere, which makes Discard cheaper than reading the bytes
+// into a buffer that is then thrown away.
+func (r *Reader) Discard(n int) (discarded int, err error) {
+	r.canUnread = false
+	for discarded < n {
+		if r.err != nil {
+			return discarded, r.err
+		}
+		if !r.fill() {
+			return discarded, r.err
+		}
+		m := r.j - r.i
+		if m > n-discarded {
+			m = n - discarded
+		}
+		r.i += m
+		discarded += m
+	}
+	return discarded, nil
+}
+
+// ReadBuffers returns the decoded bytes of the next block, or what remains of
+// the current block if a Read has returned only part of it, as a net.Buffers
+// that can be written with a single writev system call, for example to a
+// net.Conn. It returns io.EOF at the end of the stream.
+//
+// The buffers alias the Reader's internal buffer, instead of being copied
+// out, so they are only valid until the next call to a method of the Reader,
+// and must be written, or copied, before that. There is one buffer per block,
+// and so, for now, one per call, but callers should not rely on that.
+func (r *Reader) ReadBuffers() (net.Buffers, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !r.fill() {
+		return nil, r.err
+	}
+	b := r.decoded[r.i:r.j]
+	r.i = r.j
+	r.canUnread = true
+	return net.Buffers{b[:len(b):len(b)]}, nil
+}
+
+// ReadBlock returns the decoded bytes of the next data chunk, whole, or io.EOF
+// at the end of the stream. Unlike Read, it never returns part of a block, or
+// more than one, so a stream written one record per block, such as with a
+// Flush after each record, is read back one record per call. Empty blocks are
+// returned too, as empty slices.
+//
+// The returned slice may alias the Reader's internal buffer, so it is only
+// valid until the next call to a method of the Reader. If a Read has returned
+// only part of a block, ReadBlock returns the rest of that block first, and
+// after UnreadBlock, it returns the pushed-back block again.
+func (r *Reader) ReadBlock() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.i < r.j {
+		b := r.decoded[r.i:r.j]
+		r.i = r.j
+		r.canUnread = true
+		return b[:len(b):len(b)], nil
+	}
 	for {
-		if r.i < r.j {
-			n := copy(p, r.decoded[r.i:r.j])
-			r.i += n
-			return n, nil
+		n, ok := r.nextBlock()
+		if !ok {
+			r.i, r.j = 0, 0
+			return nil, r.err
+		}
+		if r.messageEnd {
+			continue
+		}
+		r.i, r.j = n, n
+		r.canUnread = n > 0
+		return r.decoded[:n:n], nil
+	}
+}
+
+// LastBlockSourceRange returns the range of positions in the underlying
+// io.Reader, [start, end), of the data chunk, header included, of the block
+// that the last Read returned bytes from. Positions count the bytes that the
+// Reader has consumed from the io.Reader since it was created or last Reset.
+// Before the first block, it returns zero for both.
+//
+// Together with the number of decoded bytes read, this lets a single scan of
+// a stream build an index from decoded offsets to chunk positions, for later
+// seeking. Note that a Reader reads a block ahead only when a Read needs it,
+// so after a Read that ends exactly at the end of a block, the range is still
+// that block's.
+func (r *Reader) LastBlockSourceRange() (start, end int64) {
+	return r.blockStart, r.blockEnd
+}
+
+// UnreadBlock rewinds the Reader to the start of the decoded block that the
+// last Read returned bytes from, so that subsequent Reads return that whole
+// block again, without reading or decoding it again. The block is that of a
+// single data chunk, which may be smaller than the Read's buffer, but is never
+// more than 64 KiB.
+//
+// Only one block can be pushed back: calling UnreadBlock again before another
+// Read, or before any Read at all, returns ErrInvalidUnreadBlock. So does
+// calling it after a Read has failed, including at the end of the stream.
+func (r *Reader) UnreadBlock() error {
+	if !r.canUnread || r.j == 0 || r.err != nil {
+		return ErrInvalidUnreadBlock
+	}
+	r.i = 0
+	r.canUnread = false
+	return nil
+}
+
+// SetBufferPool makes the Reader decode each block into a buffer obtained by
+// calling get with the block's decoded length, instead of into a buffer of its
+// own. get must return a buffer of at least that length, which may be zero;
+// otherwise, Read returns an error. The buffer is passed to put once the Reader
+// is done with it: when it decodes the next block, which happens once all of
+// the block's bytes have been read, or when it is Reset. This lets the Reader
+// share memory with an application's own pool or arena.
+//
+// Calling SetBufferPool(nil, nil) makes the Reader use a buffer of its own
+// again. The setting takes effect from the next block to be decoded, and
+// survives Reset.
+func (r *Reader) SetBufferPool(get func(n int) []byte, put func(b []byte)) {
+	r.getBuf, r.putBuf = get, put
+}
+
+// releaseBlock returns r.decoded to the buffer pool that it came from, if any.
+func (r *Reader) releaseBlock() {
+	if r.putDecoded != nil {
+		r.putDecoded(r.decoded)
+		r.decoded, r.putDecoded = nil, nil
+	}
+}
+
+// poolBuffer returns a buffer from the buffer pool to decode a block of n
+// bytes into, and makes it r.decoded.
+func (r *Reader) poolBuffer(n int) (b []byte, ok bool) {
+	b = r.getBuf(n)
+	if len(b) < n {
+		r.err = errShortPoolBuffer
+		return nil, false
+	}
+	r.decoded, r.putDecoded = b, r.putBuf
+	if r.putDecoded == nil {
+		r.putDecoded = func([]byte) {}
+	}
+	return b, true
+}
+
+// nextBlock is decodeBlock, decoding into r.decoded, which it replaces with a
+// buffer from the buffer pool, if there is one.
+func (r *Reader) nextBlock() (n int, ok bool) {
+	r.releaseBlock()
+	if r.getBuf != nil {
+		n, ok = r.decodeBlock(nil)
+	} else {
+		if r.decoded == nil {
+			r.decoded = make([]byte, maxBlockSize)
+		}
+		n, ok = r.decodeBlock(r.decoded)
+	}
+	if !ok {
+		return 0, false
+	}
+	r.decodedTotal += int64(n)
+	if r.decodedLimit > 0 && r.decodedTotal > r.decodedLimit {
+		r.err = ErrDecodedLimit
+		return 0, false
+	}
+	if r.trackStored && r.stored && n > 0 {
+		start := r.decodedTotal - int64(n)
+		if k := len(r.storedRanges) - 1; k >= 0 && r.storedRanges[k].End == start {
+			r.storedRanges[k].End = r.decodedTotal
+		} else {
+			r.storedRanges = append(r.storedRanges, Range{start, r.decodedTotal})
+		}
+	}
+	return n, true
+}
+
+// fill makes sure that r.decoded[r.i:r.j] is non-empty, decoding the next
+// non-empty block if necessary. It returns false if it could not do so, with
+// r.err set to the reason, which may be io.EOF.
+func (r *Reader) fill() bool {
+	for r.i >= r.j {
+		n, ok := r.nextBlock()
+		if !ok {
+			return false
 		}
-		if !r.readFull(r.buf[:4], true) {
-			return 0, r.err
+		r.i, r.j = 0, n
+	}
+	return true
+}
+
+// decodeBlock reads chunks until it finds a data chunk, and then decodes that
+// chunk's contents into dst, which must be at least maxBlockSize bytes long,
+// or nil to decode into a buffer from the buffer pool set by SetBufferPool.
+// It returns the number of decoded bytes, which may be zero. It returns false
+// if it could not do so, with r.err set to the reason, which may be io.EOF.
+//
+// It also stops, returning zero bytes and setting r.messageEnd, after reading
+// an end-of-message marker.
+func (r *Reader) decodeBlock(dst []byte) (n int, ok bool) {
+	r.messageEnd = false
+	r.stored = false
+	// Leave the underlying reader positioned just after the chunk.
+	defer r.discardPeeked()
+	for {
+		start := r.srcPos
+		if !r.readChunkHeader() {
+			return 0, false
 		}
 		chunkType := r.buf[0]
-		if !r.readHeader {
-			if chunkType != chunkTypeStreamIdentifier {
-				r.err = ErrCorrupt
-				return 0, r.err
-			}
-			r.readHeader = true
+		if !r.readHeader && !r.startStream(chunkType) {
+			return 0, false
 		}
 		chunkLen := int(r.buf[1]) | int(r.buf[2])<<8 | int(r.buf[3])<<16
 		if chunkLen > len(r.buf) {
 			r.err = ErrUnsupported
-			return 0, r.err
+			return 0, false
 		}
 
 		// The chunk types are specified at
@@ -147,91 +950,414 @@ func (r *Reader) Read(p []byte) (int, error) {
 		switch chunkType {
 		case chunkTypeCompressedData:
 			// Section 4.2. Compressed data (chunk type 0x00).
-			if chunkLen < checksumSize {
+			if chunkLen < r.checksumSize() {
 				r.err = ErrCorrupt
-				return 0, r.err
+				return 0, false
 			}
-			buf := r.buf[:chunkLen]
-			if !r.readFull(buf, false) {
-				return 0, r.err
+			buf, ok := r.readBody(chunkLen)
+			if !ok {
+				return 0, false
+			}
+			var checksum uint32
+			if !r.noChecksum {
+				checksum = uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16 | uint32(buf[3])<<24
+				buf = buf[checksumSize:]
 			}
-			checksum := uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16 | uint32(buf[3])<<24
-			buf = buf[checksumSize:]
 
 			n, err := DecodedLen(buf)
 			if err != nil {
 				r.err = err
-				return 0, r.err
+				return 0, false
 			}
-			if n > len(r.decoded) {
+			if n > maxBlockSize {
 				r.err = ErrCorrupt
-				return 0, r.err
+				return 0, false
+			}
+			if dst == nil {
+				if dst, ok = r.poolBuffer(n); !ok {
+					return 0, false
+				}
 			}
-			if _, err := Decode(r.decoded, buf); err != nil {
+			if _, err := Decode(dst, buf); err != nil {
 				r.err = err
-				return 0, r.err
+				return 0, false
 			}
-			if crc(r.decoded[:n]) != checksum {
+			if !r.noChecksum && crc(dst[:n]) != checksum {
 				r.err = ErrCorrupt
-				return 0, r.err
+				return 0, false
 			}
-			r.i, r.j = 0, n
-			continue
+			if r.verifyStream {
+				r.addStreamCRC(dst[:n], checksum)
+			}
+			r.blockStart, r.blockEnd = start, r.srcPos
+			return n, true
 
 		case chunkTypeUncompressedData:
 			// Section 4.3. Uncompressed data (chunk type 0x01).
-			if chunkLen < checksumSize {
+			if chunkLen < r.checksumSize() {
 				r.err = ErrCorrupt
-				return 0, r.err
+				return 0, false
 			}
-			buf := r.buf[:checksumSize]
-			if !r.readFull(buf, false) {
-				return 0, r.err
+			var checksum uint32
+			if !r.noChecksum {
+				buf := r.buf[:checksumSize]
+				if !r.readFull(buf, false) {
+					return 0, false
+				}
+				checksum = uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16 | uint32(buf[3])<<24
 			}
-			checksum := uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16 | uint32(buf[3])<<24
-			// Read directly into r.decoded instead of via r.buf.
-			n := chunkLen - checksumSize
-			if n > len(r.decoded) {
+			// Read directly into dst instead of via r.buf.
+			n := chunkLen - r.checksumSize()
+			if n > maxBlockSize {
 				r.err = ErrCorrupt
-				return 0, r.err
+				return 0, false
+			}
+			if dst == nil {
+				var ok bool
+				if dst, ok = r.poolBuffer(n); !ok {
+					return 0, false
+				}
 			}
-			if !r.readFull(r.decoded[:n], false) {
-				return 0, r.err
+			if !r.readFull(dst[:n], false) {
+				return 0, false
 			}
-			if crc(r.decoded[:n]) != checksum {
+			if !r.noChecksum && crc(dst[:n]) != checksum {
 				r.err = ErrCorrupt
-				return 0, r.err
+				return 0, false
 			}
-			r.i, r.j = 0, n
-			continue
+			if r.verifyStream {
+				r.addStreamCRC(dst[:n], checksum)
+			}
+			r.blockStart, r.blockEnd = start, r.srcPos
+			r.stored = true
+			return n, true
 
 		case chunkTypeStreamIdentifier:
 			// Section 4.1. Stream identifier (chunk type 0xff).
 			if chunkLen != len(magicBody) {
 				r.err = ErrCorrupt
-				return 0, r.err
+				return 0, false
 			}
 			if !r.readFull(r.buf[:len(magicBody)], false) {
-				return 0, r.err
+				return 0, false
 			}
 			for i := 0; i < len(magicBody); i++ {
 				if r.buf[i] != magicBody[i] {
 					r.err = ErrCorrupt
-					return 0, r.err
+					return 0, false
+				}
+			}
+			// A stream identifier starts a new stream, such as the next of
+			// several concatenated ones, whose marker covers only its own data.
+			r.streamCRC = 0
+			continue
+
+		case chunkTypeStreamLength:
+			buf, ok := r.readBody(chunkLen)
+			if !ok {
+				return 0, false
+			}
+			if len(buf) == streamLengthLen {
+				r.streamLen = int64(binary.LittleEndian.Uint64(buf))
+				r.hasStreamLen = r.streamLen >= 0
+			}
+			continue
+
+		case chunkTypeParams:
+			buf, ok := r.readBody(chunkLen)
+			if !ok {
+				return 0, false
+			}
+			r.params, r.hasParams = parseParams(buf)
+			continue
+
+		case chunkTypeEndOfStream:
+			buf, ok := r.readBody(chunkLen)
+			if !ok {
+				return 0, false
+			}
+			if r.verifyStream {
+				if len(buf) != checksumSize {
+					r.err = ErrCorrupt
+					return 0, false
+				}
+				if want := binary.LittleEndian.Uint32(buf); want != maskCRC(r.streamCRC) {
+					r.err = ErrStreamChecksum
+					return 0, false
 				}
+				r.streamCRC = 0
 			}
 			continue
+
+		case chunkTypeMessageEnd:
+			buf, ok := r.readBody(chunkLen)
+			if !ok {
+				return 0, false
+			}
+			v, n := binary.Uvarint(buf)
+			r.messageEnd, r.messageLen = true, int64(v)
+			r.hasMessageSum = false
+			switch {
+			case n <= 0 || v > 1<<62:
+				r.messageLen = -1
+			case len(buf) == n+checksumSize:
+				r.messageSum, r.hasMessageSum = binary.LittleEndian.Uint32(buf[n:]), true
+			case len(buf) != n:
+				r.messageLen = -1
+			}
+			return 0, true
 		}
 
 		if chunkType <= 0x7f {
 			// Section 4.5. Reserved unskippable chunks (chunk types 0x02-0x7f).
-			r.err = ErrUnsupported
-			return 0, r.err
+			if !r.allowReserved {
+				r.err = ErrUnsupported
+				return 0, false
+			}
+			body, ok := r.readBody(chunkLen)
+			if !ok {
+				return 0, false
+			}
+			if r.reservedHandler != nil {
+				if err := r.reservedHandler(chunkType, body); err != nil {
+					r.err = err
+					return 0, false
+				}
+			}
+			continue
 		}
 		// Section 4.4 Padding (chunk type 0xfe).
 		// Section 4.6. Reserved skippable chunks (chunk types 0x80-0xfd).
-		if !r.readFull(r.buf[:chunkLen], false) {
-			return 0, r.err
+		if _, ok := r.readBody(chunkLen); !ok {
+			return 0, false
+		}
+	}
+}
+
+// addStreamCRC adds the bytes p, just decoded from a data chunk, to
+// r.streamCRC. checksum is the chunk's masked checksum, which has been
+// verified, and is reused unless it is missing.
+func (r *Reader) addStreamCRC(p []byte, checksum uint32) {
+	c := unmaskCRC(checksum)
+	if r.noChecksum {
+		c = crc32.Update(0, crcTable, p)
+	}
+	r.streamCRC = crcCombine(r.streamCRC, c, int64(len(p)))
+}
+
+// DecodeFramedProgress reads a stream in the framing format from r, and writes
+// its decompressed contents to w. After writing each block, which holds at
+// most 64 KiB, it calls progress, if not nil, with the total number of bytes
+// decoded so far. The calls are made synchronously, from the calling
+// goroutine, so progress should be cheap.
+//
+// It returns nil at the end of the stream, or else the first error from
+// reading, decoding or writing.
+func DecodeFramedProgress(w io.Writer, r io.Reader, progress func(bytesDecoded int64)) error {
+	x := NewReader(r)
+	x.decoded = make([]byte, maxBlockSize)
+	var total int64
+	for {
+		n, ok := x.decodeBlock(x.decoded)
+		if !ok {
+			if x.err == io.EOF {
+				return nil
+			}
+			return x.err
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err := w.Write(x.decoded[:n]); err != nil {
+			return err
+		}
+		total += int64(n)
+		if progress != nil {
+			progress(total)
+		}
+	}
+}
+
+// DecodeFramedLenient is like DecodeFramedProgress without the progress, but
+// it can recover from damage to the stream, such as a corrupt block, instead
+// of giving up on the rest of the stream.
+//
+// On finding damage, it calls onError with the index of the data chunk that
+// is affected, counting from zero, and the error that a Reader would report.
+// If onError returns false, DecodeFramedLenient returns that error. Otherwise,
+// it skips ahead, byte by byte, to the next chunk that is fully intact: a
+// stream identifier, or a data chunk whose checksum matches. It then resumes
+// decoding from there. Chunk indexes only count the data chunks that are found
+// in this way, and the one at which the damage is detected, so those of later
+// chunks may not match their positions in the undamaged stream.
+//
+// It returns nil at the end of the stream, or else the first error from
+// reading r or writing w, or that onError chose not to recover from.
+func DecodeFramedLenient(w io.Writer, r io.Reader, onError func(blockIndex int, err error) bool) error {
+	br := bufio.NewReaderSize(r, chunkHeaderSize+maxEncodedLenOfMaxBlockSize+checksumSize)
+	decoded := make([]byte, maxBlockSize)
+	blockIndex := 0
+	readHeader, resync := false, false
+	for {
+		header, err := br.Peek(chunkHeaderSize)
+		if err != nil {
+			if err == io.EOF {
+				if len(header) == 0 || resync {
+					return nil
+				}
+				err = ErrCorrupt
+				if !onError(blockIndex, err) {
+					return err
+				}
+				return nil
+			}
+			return err
+		}
+		chunkType := header[0]
+		chunkLen := int(header[1]) | int(header[2])<<8 | int(header[3])<<16
+
+		// Find out if the chunk is intact, and whether it is a data chunk. In
+		// resync mode, only data chunks and stream identifiers are looked at.
+		var block []byte
+		isData := chunkType == chunkTypeCompressedData || chunkType == chunkTypeUncompressedData
+		ok := !resync || isData || chunkType == chunkTypeStreamIdentifier
+		if ok {
+			chunk, err := br.Peek(chunkHeaderSize + chunkLen)
+			if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+				return err
+			}
+			ok = err == nil
+			if ok {
+				body := chunk[chunkHeaderSize:]
+				switch {
+				case !readHeader && !resync && chunkType != chunkTypeStreamIdentifier:
+					ok = false
+				case isData:
+					block, ok = decodeDataChunk(decoded, chunkType, body)
+				case chunkType == chunkTypeStreamIdentifier:
+					ok = string(body) == magicBody
+				case chunkType <= 0x7f:
+					// Reserved unskippable chunks (chunk types 0x02-0x7f).
+					if !onError(blockIndex, ErrUnsupported) {
+						return ErrUnsupported
+					}
+					ok, resync = false, true
+				}
+			}
+		}
+
+		if !ok {
+			if !resync {
+				if !onError(blockIndex, ErrCorrupt) {
+					return ErrCorrupt
+				}
+				resync = true
+				if isData {
+					blockIndex++
+				}
+			}
+			br.Discard(1)
+			continue
+		}
+		br.Discard(chunkHeaderSize + chunkLen)
+		readHeader, resync = true, false
+		if isData {
+			blockIndex++
+			if _, err := w.Write(block); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// AuditFramed reads the stream r in the framing format, and calls fn for each
+// data chunk, in order, with the chunk's index counting from zero, its decoded
+// bytes, the checksum recorded in the chunk and the checksum of the decoded
+// bytes. Unlike a Reader, it does not stop at a checksum mismatch, but leaves
+// it to fn to report, for auditing archives whose integrity is in doubt. The
+// decoded bytes are only valid until fn returns.
+//
+// Other chunks are skipped, except for reserved unskippable chunks, at which
+// AuditFramed returns ErrUnsupported.
+//
+// AuditFramed returns nil at the end of the stream, or else the first error
+// from fn or from reading r, or ErrCorrupt if the stream's framing is broken
+// or a block does not decode. DecodeFramedLenient can get past such damage.
+func AuditFramed(r io.Reader, fn func(blockIndex int, decoded []byte, storedCRC, computedCRC uint32) error) error {
+	fr := NewReader(r)
+	decoded := make([]byte, maxBlockSize)
+	for blockIndex := 0; ; blockIndex++ {
+		chunkType, body, err := fr.NextChunk()
+		// Skip to the next data chunk, of type 0x00 or 0x01.
+		for err == nil && chunkType > chunkTypeUncompressedData {
+			if chunkType <= 0x7f {
+				return ErrUnsupported
+			}
+			chunkType, body, err = fr.NextChunk()
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(body) < checksumSize {
+			return ErrCorrupt
+		}
+		stored := binary.LittleEndian.Uint32(body)
+		block := body[checksumSize:]
+		if chunkType == chunkTypeCompressedData {
+			if n, err := DecodedLen(block); err != nil || n > maxBlockSize {
+				return ErrCorrupt
+			}
+			if block, err = Decode(decoded, block); err != nil {
+				return ErrCorrupt
+			}
+		} else if len(block) > maxBlockSize {
+			return ErrCorrupt
+		}
+		if err := fn(blockIndex, block, stored, crc(block)); err != nil {
+			return err
+		}
+	}
+}
+
+// DecodeFramed decompresses src, a complete stream in the framing format such
+// as that returned by EncodeFramed. It is the framing format's analog of
+// Decode.
+func DecodeFramed(src []byte) ([]byte, error) {
+	dst, err := DecodeAll(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// DecodeAll reads and decompresses the whole of a stream in the framing format
+// from r. It is equivalent to, but more efficient than, calling ioutil.ReadAll
+// on NewReader(r), as each block is decoded directly into the returned slice.
+//
+// Checksums are verified as usual. If the stream is truncated or corrupt,
+// DecodeAll returns the bytes decoded before the problem was detected, along
+// with the error.
+func DecodeAll(r io.Reader) ([]byte, error) {
+	x := &Reader{
+		buf: make([]byte, maxEncodedLenOfMaxBlockSize+checksumSize),
+	}
+	x.setSource(r)
+	var dst []byte
+	for {
+		if cap(dst)-len(dst) < maxBlockSize {
+			grown := make([]byte, len(dst), 2*cap(dst)+maxBlockSize)
+			copy(grown, dst)
+			dst = grown
+		}
+		n, ok := x.decodeBlock(dst[len(dst) : len(dst)+maxBlockSize])
+		if !ok {
+			if x.err == io.EOF {
+				return dst, nil
+			}
+			return dst, x.err
 		}
+		dst = dst[:len(dst)+n]
 	}
 }
@@ -0,0 +1,64 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+// deltaWindow returns the part of base that a block encoded by EncodeDelta
+// can refer to.
+func deltaWindow(base []byte) []byte {
+	if len(base) > continueWindow {
+		return base[len(base)-continueWindow:]
+	}
+	return base
+}
+
+// EncodeDelta is like Encode, but the block returned may also copy bytes from
+// base, such as the previous version of a document of which src is the new
+// version, which then compresses to little more than the differences. The
+// block can only be decoded by DecodeDelta, given the same base.
+//
+// Copies reach at most 65535 bytes back from the byte being encoded, so only
+// the last 65535 bytes of base can be referred to, and less of it the further
+// into src the copy is. For larger documents, split base and src into
+// corresponding pieces of well under 64 KiB, such as by record or section,
+// and encode each piece against its counterpart. Copies within src are found
+// as usual.
+//
+// EncodeDelta hashes every position of base on each call. To encode several
+// blocks against the same base, build a Dictionary of it once and use
+// EncodeDict instead.
+//
+// The returned slice may be a sub-slice of dst if dst was large enough to hold
+// the entire encoded block. Otherwise, a newly allocated slice will be
+// returned. The dst must not overlap base or src.
+func EncodeDelta(dst, base, src []byte) []byte {
+	if n := MaxEncodedLen(len(src)); n < 0 {
+		panic(ErrTooLarge)
+	} else if len(dst) < n {
+		dst = make([]byte, n)
+	}
+	window := deltaWindow(base)
+	c := &continueState{
+		buf: make([]byte, len(window), len(window)+len(src)),
+	}
+	copy(c.buf, window)
+	c.seedTable()
+	return c.encode(dst, src)
+}
+
+// DecodeDelta returns the decoded form of src, a block returned by
+// EncodeDelta for the same base. The returned slice may be a sub-slice of dst
+// if dst was large enough to hold the entire decoded block. Otherwise, a newly
+// allocated slice will be returned.
+//
+// It returns ErrCorrupt, or the error that Decode would, if src is not a valid
+// block. Passing a different base than the block was encoded against is only
+// detected if the block's copies then reach outside it, and otherwise gives
+// the wrong output, so callers that cannot be sure of the base should check a
+// checksum of the result.
+func DecodeDelta(dst, base, src []byte) ([]byte, error) {
+	window := deltaWindow(base)
+	c := &ContinueDecoder{buf: append([]byte(nil), window...)}
+	return c.Decode(dst, src)
+}
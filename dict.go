@@ -0,0 +1,84 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"sync"
+)
+
+// A Dictionary holds bytes that blocks can be encoded against, such as the
+// common parts of the messages of a protocol with a fixed schema, together
+// with a hash table of every position in them. NewDictionary builds that table
+// once, so EncodeDict, unlike EncodeDelta, does not have to hash the
+// dictionary again for each block, which dominates the cost of encoding small
+// blocks against a large dictionary.
+//
+// As with EncodeDelta, copies reach at most 65535 bytes back, so only the
+// last 65535 bytes of the dictionary are kept.
+//
+// A Dictionary is safe for concurrent use by multiple goroutines.
+type Dictionary struct {
+	// seed holds the dictionary, as the window of a continueState, and the
+	// hash table of every position in it. EncodeDict copies it rather than
+	// modifying it.
+	seed continueState
+}
+
+// NewDictionary returns a new Dictionary of the last 65535 bytes of dict,
+// which it copies.
+func NewDictionary(dict []byte) *Dictionary {
+	d := &Dictionary{}
+	d.seed.buf = append([]byte(nil), deltaWindow(dict)...)
+	d.seed.seedTable()
+	return d
+}
+
+// dictStatePool holds *continueState values for EncodeDict to copy a
+// Dictionary into.
+var dictStatePool sync.Pool
+
+// EncodeDict is like EncodeDelta, with the dictionary d as the base, but does
+// not have to hash the dictionary. The block can only be decoded by DecodeDict,
+// given the same dictionary, or by DecodeDelta, given the same bytes as base.
+//
+// The returned slice may be a sub-slice of dst if dst was large enough to hold
+// the entire encoded block. Otherwise, a newly allocated slice will be
+// returned. The dst must not overlap src.
+func EncodeDict(dst []byte, d *Dictionary, src []byte) []byte {
+	if n := MaxEncodedLen(len(src)); n < 0 {
+		panic(ErrTooLarge)
+	} else if len(dst) < n {
+		dst = make([]byte, n)
+	}
+	c, _ := dictStatePool.Get().(*continueState)
+	if c == nil {
+		c = &continueState{}
+	}
+	c.table = d.seed.table
+	c.buf = append(c.buf[:0], d.seed.buf...)
+	dst = c.encode(dst, src)
+	if cap(c.buf) > 2*continueWindow {
+		// Do not keep the copy of a large src alive.
+		c.buf = nil
+	}
+	dictStatePool.Put(c)
+	return dst
+}
+
+// DecodeDict returns the decoded form of src, a block returned by EncodeDict
+// for the same dictionary. It is otherwise like DecodeDelta.
+func DecodeDict(dst []byte, d *Dictionary, src []byte) ([]byte, error) {
+	return DecodeDelta(dst, d.seed.buf, src)
+}
+
+// seedTable records every position of c.buf in c.table, rather than only
+// those that encoding would look at, so that later blocks can match it
+// anywhere.
+func (c *continueState) seedTable() {
+	const shift = 32 - 14
+	for i := 0; i+4 <= len(c.buf); i++ {
+		c.table[hash(load32(c.buf, i), shift)&tableMask] = c.pos + uint32(i) + 1
+	}
+}
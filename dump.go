@@ -0,0 +1,126 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"fmt"
+	"io"
+)
+
+// DumpTags writes a human-readable listing of the block src to w, one line
+// per element: the decoded length, then each literal and copy tag with its
+// position in src and in the decoded output. It is meant for debugging blocks
+// that Decode rejects.
+//
+// If src is malformed, DumpTags lists the tags up to the problem, then a line
+// describing it, including the offending byte, and returns ErrCorrupt (or the
+// error that Decode would return). Otherwise, it returns nil, or the first
+// error from writing to w.
+func DumpTags(src []byte, w io.Writer) error {
+	p := &tagPrinter{w: w}
+	dLen, s, err := decodedLen(src)
+	if err != nil {
+		p.printf("bad decoded length varint at srcpos=0: %v\n", err)
+		return p.result(err)
+	}
+	p.printf("decoded length=%d\n", dLen)
+
+	d := 0
+	for s < len(src) {
+		tag := src[s]
+		var length, offset, n int
+		switch tag & 0x03 {
+		case tagLiteral:
+			x := uint32(tag >> 2)
+			if x >= 60 {
+				// The length is in the next 1-4 bytes, little-endian.
+				n = int(x) - 59
+				if len(src)-s-1 < n {
+					p.printf("truncated literal length at srcpos=%d (tag byte %#02x)\n", s, tag)
+					return p.result(ErrCorrupt)
+				}
+				x = 0
+				for i := n; i > 0; i-- {
+					x = x<<8 | uint32(src[s+i])
+				}
+			}
+			length = int(x) + 1
+			if length <= 0 {
+				p.printf("unsupported literal length at srcpos=%d (tag byte %#02x)\n", s, tag)
+				return p.result(errUnsupportedLiteralLength)
+			}
+			p.printf("literal len=%d at srcpos=%d dstpos=%d\n", length, s, d)
+			if length > len(src)-s-1-n {
+				p.printf("literal overruns src by %d bytes\n", length-(len(src)-s-1-n))
+				return p.result(ErrCorrupt)
+			}
+			if length > dLen-d {
+				p.printf("literal overruns the decoded length by %d bytes\n", length-(dLen-d))
+				return p.result(ErrCorrupt)
+			}
+			s += 1 + n + length
+			d += length
+			continue
+
+		case tagCopy1:
+			n = 1
+		case tagCopy2:
+			n = 2
+		case tagCopy4:
+			n = 4
+		}
+		if len(src)-s-1 < n {
+			p.printf("truncated copy at srcpos=%d (tag byte %#02x)\n", s, tag)
+			return p.result(ErrCorrupt)
+		}
+		switch n {
+		case 1:
+			length = 4 + int(tag)>>2&0x7
+			offset = int(uint32(tag)&0xe0<<3 | uint32(src[s+1]))
+		case 2:
+			length = 1 + int(tag)>>2
+			offset = int(uint32(src[s+1]) | uint32(src[s+2])<<8)
+		case 4:
+			length = 1 + int(tag)>>2
+			offset = int(uint32(src[s+1]) | uint32(src[s+2])<<8 | uint32(src[s+3])<<16 | uint32(src[s+4])<<24)
+		}
+		p.printf("copy offset=%d len=%d at srcpos=%d dstpos=%d\n", offset, length, s, d)
+		if offset <= 0 || offset > d {
+			p.printf("copy offset is outside the %d bytes decoded so far (tag byte %#02x)\n", d, tag)
+			return p.result(ErrCorrupt)
+		}
+		if length > dLen-d {
+			p.printf("copy overruns the decoded length by %d bytes\n", length-(dLen-d))
+			return p.result(ErrCorrupt)
+		}
+		s += 1 + n
+		d += length
+	}
+	if d != dLen {
+		p.printf("src ends after %d of %d decoded bytes\n", d, dLen)
+		return p.result(ErrCorrupt)
+	}
+	return p.result(nil)
+}
+
+// tagPrinter writes DumpTags' output, remembering the first write error.
+type tagPrinter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *tagPrinter) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+// result returns err, unless writing the output failed.
+func (p *tagPrinter) result(err error) error {
+	if p.err != nil {
+		return p.err
+	}
+	return err
+}
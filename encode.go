@@ -5,9 +5,14 @@
 package snappy
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"io"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // Encode returns the encoded form of src. The returned slice may be a sub-
@@ -15,7 +20,23 @@ import (
 // Otherwise, a newly allocated slice will be returned.
 //
 // The dst and src must not overlap. It is valid to pass a nil dst.
+//
+// An empty src is encoded as the single byte 0x00, the varint encoding of a
+// zero decoded length.
+//
+// The encoding is deterministic: a given src always encodes to the same bytes,
+// regardless of GOARCH and of whether the assembly or the pure Go
+// implementation is in use (see the noasm build tag), and regardless of the
+// host's endianness. Those bytes are also those of an Encoder with the default
+// configuration. This is tested, and is safe to rely on for content-addressed
+// storage, although the output may change between releases of this package.
 func Encode(dst, src []byte) []byte {
+	return encode(dst, src, encodeBlock)
+}
+
+// encode implements Encode, calling encodeBlockFunc to encode each block that
+// is at least minNonLiteralBlockSize bytes long.
+func encode(dst, src []byte, encodeBlockFunc func(dst, src []byte) int) []byte {
 	if n := MaxEncodedLen(len(src)); n < 0 {
 		panic(ErrTooLarge)
 	} else if len(dst) < n {
@@ -24,7 +45,14 @@ func Encode(dst, src []byte) []byte {
 
 	// The block starts with the varint-encoded length of the decompressed bytes.
 	d := binary.PutUvarint(dst, uint64(len(src)))
+	d += encodeTags(dst[d:], src, encodeBlockFunc)
+	return dst[:d]
+}
 
+// encodeTags writes the tags that encode src to dst, which must be at least
+// MaxRawEncodedLen(len(src)) bytes long, and returns the number of bytes
+// written.
+func encodeTags(dst, src []byte, encodeBlockFunc func(dst, src []byte) int) (d int) {
 	for len(src) > 0 {
 		p := src
 		src = nil
@@ -34,12 +62,232 @@ func Encode(dst, src []byte) []byte {
 		if len(p) < minNonLiteralBlockSize {
 			d += emitLiteral(dst[d:], p)
 		} else {
-			d += encodeBlock(dst[d:], p)
+			d += encodeBlockFunc(dst[d:], p)
 		}
 	}
+	return d
+}
+
+// EncodeRawBlock is like Encode, but returns just the tags of the block,
+// without the varint-encoded decoded length that Encode writes first. It is for
+// formats that store that length separately, and DecodeRawBlock is its
+// inverse. An empty src is encoded as zero bytes.
+//
+// The returned slice is a sub-slice of dst if dst is at least
+// MaxRawEncodedLen(len(src)) bytes long.
+func EncodeRawBlock(dst, src []byte) []byte {
+	if n := MaxRawEncodedLen(len(src)); n < 0 {
+		panic(ErrTooLarge)
+	} else if len(dst) < n {
+		dst = make([]byte, n)
+	}
+	return dst[:encodeTags(dst, src, encodeBlock)]
+}
+
+// EncodeLiteralsOnly is like Encode, but the block returned holds src as
+// literals only, without any copies, for decoders that do not support them,
+// such as some hardware decoders. It is always a little longer than src: each
+// literal holds up to 64 KiB, and its tag takes 1 to 3 bytes.
+//
+// The returned slice is a sub-slice of dst if dst is at least
+// MaxEncodedLen(len(src)) bytes long.
+func EncodeLiteralsOnly(dst, src []byte) []byte {
+	if n := MaxEncodedLen(len(src)); n < 0 {
+		panic(ErrTooLarge)
+	} else if len(dst) < n {
+		dst = make([]byte, n)
+	}
+	d := binary.PutUvarint(dst, uint64(len(src)))
+	if len(src) > 0 {
+		d += emitLongLiteral(dst[d:], src)
+	}
 	return dst[:d]
 }
 
+// EncodeFramed returns src compressed as a complete stream in the framing
+// format, as written by a buffered Writer that is then closed. It is the
+// framing format's analog of Encode, and DecodeFramed is its inverse.
+func EncodeFramed(src []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Grow(MaxFramedLen(len(src)))
+	w := NewBufferedWriter(buf)
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+// EncodeFramedReader reads r until io.EOF and returns what it read compressed
+// as a complete stream in the framing format, as EncodeFramed does for a byte
+// slice. The data is read straight into the block buffer of a Writer, so
+// readers that return it in small pieces are still compressed in full blocks.
+// The returned error is the first, other than io.EOF, from reading r.
+func EncodeFramedReader(r io.Reader) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := TranscodeFromReader(buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeBudget encodes as much of src as it can into a block of at most
+// maxOut bytes, and returns the block and the length of the prefix of src that
+// it holds, so that decoding out gives src[:consumed]. The returned slice may
+// be a sub-slice of dst if dst was large enough.
+//
+// src is encoded in 64 KiB pieces, as by Encode, and the prefix is all of the
+// pieces that fit, and then as much of the next piece as a binary search can
+// fit, so it is close to, but not necessarily, the longest prefix that fits.
+// If maxOut is too small for even an empty block, EncodeBudget returns nil and
+// 0.
+func EncodeBudget(dst, src []byte, maxOut int) (out []byte, consumed int) {
+	fits := func(dLen, bodyLen int) bool {
+		var buf [binary.MaxVarintLen64]byte
+		return binary.PutUvarint(buf[:], uint64(dLen))+bodyLen <= maxOut
+	}
+	if !fits(0, 0) {
+		return nil, 0
+	}
+	var body []byte
+	scratch := make([]byte, MaxEncodedLen(maxBlockSize))
+	encodePiece := func(p []byte) []byte {
+		if len(p) < minNonLiteralBlockSize {
+			return scratch[:emitLiteral(scratch, p)]
+		}
+		return scratch[:encodeBlock(scratch, p)]
+	}
+	for consumed < len(src) {
+		p := src[consumed:]
+		if len(p) > maxBlockSize {
+			p = p[:maxBlockSize]
+		}
+		if e := encodePiece(p); fits(consumed+len(p), len(body)+len(e)) {
+			body = append(body, e...)
+			consumed += len(p)
+			continue
+		}
+		// Only part of p fits: lo bytes do, and hi bytes do not.
+		lo, hi := 0, len(p)
+		for hi-lo > 1 {
+			mid := lo + (hi-lo)/2
+			if fits(consumed+mid, len(body)+len(encodePiece(p[:mid]))) {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		if lo > 0 {
+			body = append(body, encodePiece(p[:lo])...)
+			consumed += lo
+		}
+		break
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	h := binary.PutUvarint(header[:], uint64(consumed))
+	if n := h + len(body); len(dst) >= n {
+		dst = dst[:n]
+	} else {
+		dst = make([]byte, n)
+	}
+	copy(dst, header[:h])
+	copy(dst[h:], body)
+	return dst, consumed
+}
+
+// ErrPoorCompression is returned by EncodeRequireRatio when src does not
+// compress well enough.
+var ErrPoorCompression = errors.New("snappy: insufficient compression")
+
+// EncodeRequireRatio is like Encode, but returns ErrPoorCompression instead of
+// the encoded block if the compression ratio achieved, len(src) divided by the
+// length of the encoded block, is less than minRatio. For example, a minRatio
+// of 1.25 requires the encoded block to be at most 80% of the size of src.
+//
+// This lets a caller with a strict size budget fall back to storing src by
+// other means. An empty src always fails for a positive minRatio.
+func EncodeRequireRatio(dst, src []byte, minRatio float64) ([]byte, error) {
+	encoded := Encode(dst, src)
+	if float64(len(src)) < minRatio*float64(len(encoded)) {
+		return nil, ErrPoorCompression
+	}
+	return encoded, nil
+}
+
+// EncodeInfo describes a block encoded by EncodeWithResult.
+type EncodeInfo struct {
+	// EncodedLen is the length of the encoded block.
+	EncodedLen int
+
+	// LiteralBytes is the number of bytes of src that were emitted as
+	// literals, rather than as copies of earlier bytes.
+	LiteralBytes int
+
+	// LikelyIncompressible is whether copies cover less than an eighth of a
+	// non-empty src. The encoder skips ahead ever faster through input in
+	// which it finds no matches, so this is what happens when it gives up on
+	// most of src, and storing src as it is would likely be as good.
+	LikelyIncompressible bool
+}
+
+// EncodeWithResult is like Encode, but also returns a description of the
+// encoded block, so that callers can decide how to store it without a second
+// pass over the data.
+func EncodeWithResult(dst, src []byte) (out []byte, info EncodeInfo) {
+	out = Encode(dst, src)
+	info.EncodedLen = len(out)
+	info.LiteralBytes = literalBytes(out)
+	info.LikelyIncompressible = 8*(len(src)-info.LiteralBytes) < len(src)
+	return out, info
+}
+
+// literalBytes returns the total length of the literals in the valid block
+// src.
+func literalBytes(src []byte) (total int) {
+	_, s, _ := decodedLen(src)
+	for s < len(src) {
+		tag := src[s]
+		switch tag & 0x03 {
+		case tagLiteral:
+			x := uint32(tag >> 2)
+			n := 0
+			if x >= 60 {
+				n = int(x) - 59
+				x = 0
+				for i := n; i > 0; i-- {
+					x = x<<8 | uint32(src[s+i])
+				}
+			}
+			total += int(x) + 1
+			s += 1 + n + int(x) + 1
+		case tagCopy1:
+			s += 2
+		case tagCopy2:
+			s += 3
+		case tagCopy4:
+			s += 5
+		}
+	}
+	return total
+}
+
+// load32 and load64 read little-endian values byte by byte, rather than
+// through unsafe or the host's byte order, so that the pure Go encoder
+// produces the same output on big-endian architectures such as s390x.
+func load32(b []byte, i int) uint32 {
+	b = b[i : i+4 : len(b)] // Help the compiler eliminate bounds checks on the next line.
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func load64(b []byte, i int) uint64 {
+	b = b[i : i+8 : len(b)] // Help the compiler eliminate bounds checks on the next line.
+	return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
+		uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56
+}
+
+func hash(u, shift uint32) uint32 {
+	return (u * 0x1e35a7bd) >> shift
+}
+
 // inputMargin is the minimum number of extra input bytes to keep, inside
 // encodeBlock's inner loop. On some architectures, this margin lets us
 // implement a fast path for emitLiteral, where the copy of short (<= 16 byte)
@@ -69,6 +317,51 @@ const inputMargin = 16 - 1
 // TestSameEncodingAsCppShortCopies.
 const minNonLiteralBlockSize = 1 + 1 + inputMargin
 
+// MinCompressibleLen returns the length below which Encode never compresses
+// its input: it encodes shorter input as a single literal, without looking for
+// matches, so the output for non-empty input shorter than this is always 2
+// bytes longer than the input. (Empty input encodes to a single byte.) Input
+// of at least this length may compress, if it has repeated bytes. The same
+// holds for each block of a Writer, and for each 64 KiB piece of longer input
+// to Encode.
+//
+// The threshold is a property of this implementation, not of the format, and
+// lets adaptive codecs skip trial encodings of tiny inputs.
+func MinCompressibleLen() int {
+	return minNonLiteralBlockSize
+}
+
+// EncodedLen returns the length of Encode(nil, src), exactly, without
+// returning the encoded bytes, for formats that write the length of a block
+// before the block itself. It costs as much time as Encode, as it has to find
+// the same matches, but it needs no buffer for the whole output: each 64 KiB
+// piece of src is encoded into a scratch buffer that is reused.
+func EncodedLen(src []byte) int {
+	if MaxEncodedLen(len(src)) < 0 {
+		panic(ErrTooLarge)
+	}
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], uint64(len(src)))
+	buf := encodedLenPool.Get().(*[maxEncodedLenOfMaxBlockSize]byte)
+	for len(src) > 0 {
+		p := src
+		src = nil
+		if len(p) > maxBlockSize {
+			p, src = p[:maxBlockSize], p[maxBlockSize:]
+		}
+		n += encodeTags(buf[:], p, encodeBlock)
+	}
+	encodedLenPool.Put(buf)
+	return n
+}
+
+// encodedLenPool holds the scratch buffers of EncodedLen.
+var encodedLenPool = sync.Pool{
+	New: func() interface{} {
+		return new([maxEncodedLenOfMaxBlockSize]byte)
+	},
+}
+
 // MaxEncodedLen returns the maximum length of a snappy block, given its
 // uncompressed length.
 //
@@ -105,7 +398,71 @@ func MaxEncodedLen(srcLen int) int {
 	return int(n)
 }
 
-var errClosed = errors.New("snappy: Writer is closed")
+// MaxFramedLen returns the maximum length of a stream in the framing format
+// holding srcLen bytes, as returned by EncodeFramed or written by a Writer from
+// NewBufferedWriter with the default options that is written to and then
+// closed.
+//
+// That is less than MaxEncodedLen suggests, as the Writer stores each 64 KiB
+// block uncompressed if compressing it does not save enough: each chunk is at
+// most the length of its data plus an 8-byte header, which holds the chunk's
+// type, length and checksum. The stream also starts with a 10-byte stream
+// identifier.
+//
+// It will return a negative value if srcLen is negative, or if the length
+// overflows an int.
+func MaxFramedLen(srcLen int) int {
+	if srcLen < 0 {
+		return -1
+	}
+	numChunks := (uint64(srcLen) + maxBlockSize - 1) / maxBlockSize
+	n := uint64(len(magicChunk)) + numChunks*(chunkHeaderSize+checksumSize) + uint64(srcLen)
+	if n > uint64(^uint(0)>>1) {
+		return -1
+	}
+	return int(n)
+}
+
+// MaxRawEncodedLen returns the maximum length of a block as encoded by
+// EncodeRawBlock, given its uncompressed length. That is MaxEncodedLen less the
+// longest possible varint-encoded length.
+//
+// It will return a negative value if srcLen is too large to encode.
+func MaxRawEncodedLen(srcLen int) int {
+	n := MaxEncodedLen(srcLen)
+	if n < 0 {
+		return -1
+	}
+	return n - binary.MaxVarintLen32
+}
+
+var (
+	errClosed               = errors.New("snappy: Writer is closed")
+	errInvalidBlockSize     = errors.New("snappy: invalid block size")
+	errOutputBufferTooSmall = errors.New("snappy: output buffer is too small for the block size")
+	errInvalidAutoFlush     = errors.New("snappy: invalid auto-flush size")
+	errInvalidAlignment     = errors.New("snappy: invalid padding alignment")
+	errInvalidDeadline      = errors.New("snappy: invalid block deadline")
+	errAddWriterTooLate     = errors.New("snappy: AddWriter called after output was written")
+	errAddWriterLength      = errors.New("snappy: AddWriter is not supported with a length-prefixed stream")
+	errTryWriteCDC          = errors.New("snappy: TryWrite is not supported with content-defined chunking")
+)
+
+// ErrWouldBlock is returned by Writer.TryWrite when it cannot accept all of
+// its input without writing to the underlying io.Writer.
+var ErrWouldBlock = errors.New("snappy: write would block")
+
+// A RoundTripError is returned by a Writer with the VerifyRoundTrip option
+// when a block that it encoded does not decode back to the original bytes.
+type RoundTripError struct {
+	// Offset is the offset of the start of the block in the uncompressed
+	// stream, counting from when the Writer was created or last Reset.
+	Offset int64
+}
+
+func (e *RoundTripError) Error() string {
+	return "snappy: encoded block at offset " + strconv.FormatInt(e.Offset, 10) + " does not round-trip"
+}
 
 // NewWriter returns a new Writer that compresses to w.
 //
@@ -118,8 +475,10 @@ var errClosed = errors.New("snappy: Writer is closed")
 // that Writer when done.
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		w:    w,
-		obuf: make([]byte, obufLen),
+		w:         w,
+		obuf:      make([]byte, obufLen),
+		blockSize: maxBlockSize,
+		obufSize:  obufLen,
 	}
 }
 
@@ -130,14 +489,237 @@ func NewWriter(w io.Writer) *Writer {
 // The Writer returned buffers writes. Users must call Close to guarantee all
 // data has been forwarded to the underlying io.Writer. They may also call
 // Flush zero or more times before calling Close.
-func NewBufferedWriter(w io.Writer) *Writer {
-	return &Writer{
-		w:    w,
-		ibuf: make([]byte, 0, maxBlockSize),
-		obuf: make([]byte, obufLen),
+//
+// The Writer's configuration can be changed from the defaults by passing
+// WriterOption values. If any of them are invalid, the Writer uses the
+// defaults instead, and every call to Write, Flush or Close returns the
+// configuration error.
+func NewBufferedWriter(w io.Writer, opts ...WriterOption) *Writer {
+	x := configureWriter(w, opts)
+	x.ibuf = make([]byte, 0, x.blockSize)
+	x.obuf = make([]byte, x.obufSize)
+	return x
+}
+
+// configureWriter returns a Writer configured as NewBufferedWriter's, but
+// without its buffers.
+func configureWriter(w io.Writer, opts []WriterOption) *Writer {
+	x := &Writer{
+		w:         w,
+		blockSize: maxBlockSize,
+	}
+	for _, opt := range opts {
+		if x.optErr = opt(x); x.optErr != nil {
+			break
+		}
+	}
+	if x.optErr == nil && x.obufSize != 0 && x.obufSize < obufHeaderLen+MaxEncodedLen(x.blockSize) {
+		x.optErr = errOutputBufferTooSmall
+	}
+	if x.optErr == nil && x.adaptiveMin > x.blockSize {
+		x.optErr = errInvalidBlockSize
+	}
+	if x.optErr != nil {
+		// Fall back to the default configuration.
+		*x = Writer{
+			w:         w,
+			err:       x.optErr,
+			blockSize: maxBlockSize,
+			optErr:    x.optErr,
+		}
+	}
+	if x.obufSize == 0 {
+		x.obufSize = obufHeaderLen + MaxEncodedLen(x.blockSize)
+	}
+	x.adaptiveTarget = x.blockSize
+	return x
+}
+
+// NewBufferedWriterWithTerminator is like NewBufferedWriter, but the Writer
+// returned also writes an end-of-stream marker when it is closed. A Reader
+// whose SetRequireTerminator method has been called treats a stream that ends
+// without that marker as truncated.
+//
+// The marker is a chunk of a reserved skippable type, so the stream remains
+// readable by any decoder of the framing format.
+func NewBufferedWriterWithTerminator(w io.Writer, opts ...WriterOption) *Writer {
+	x := NewBufferedWriter(w, opts...)
+	x.terminate = true
+	return x
+}
+
+// A WriterOption configures a Writer returned by NewBufferedWriter.
+type WriterOption func(*Writer) error
+
+// BlockSize sets the maximum number of uncompressed bytes in each chunk, which
+// is also the size of the Writer's buffer for incoming (uncompressed) bytes.
+// It must be in the range [1, 65536]. The default is 65536.
+//
+// Smaller blocks use less memory, but generally compress less well.
+func BlockSize(n int) WriterOption {
+	return func(w *Writer) error {
+		if n < 1 || n > maxBlockSize {
+			return errInvalidBlockSize
+		}
+		w.blockSize = n
+		return nil
+	}
+}
+
+// OutputBufferSize sets the size of the Writer's buffer for outgoing
+// (compressed) bytes. It must be large enough to hold the worst case encoding
+// of a full block, plus the stream and chunk headers: at least
+// MaxEncodedLen(blockSize)+18 bytes, where blockSize is 65536 unless changed by
+// the BlockSize option. That minimum is also the default.
+func OutputBufferSize(n int) WriterOption {
+	return func(w *Writer) error {
+		if n < obufHeaderLen {
+			return errOutputBufferTooSmall
+		}
+		w.obufSize = n
+		return nil
+	}
+}
+
+// AutoFlushBytes makes Write flush the Writer whenever it has buffered at
+// least n bytes, instead of only when the buffer is full. It must be in the
+// range [1, 65536], and has no effect if it is not less than the block size.
+//
+// A smaller n reduces the latency between a Write and the corresponding output
+// reaching the underlying io.Writer, at the expense of compression ratio, as
+// the output is split into smaller, more frequent chunks. The output is still
+// in the standard framing format.
+func AutoFlushBytes(n int) WriterOption {
+	return func(w *Writer) error {
+		if n < 1 || n > maxBlockSize {
+			return errInvalidAutoFlush
+		}
+		w.autoFlush = n
+		return nil
+	}
+}
+
+// FlushOnByte makes the Writer flush whenever b is written, such as '\n' for
+// a line-oriented log, so that a consumer tailing the output can read each
+// delimited record promptly, without waiting for a full block. A Write that
+// contains b is compressed up to and including its last b, then flushed, and
+// the rest is buffered as usual. So a Write of several records still makes a
+// single chunk, if they fit in one, and records written by separate Writes
+// make separate chunks, at a cost in compression ratio.
+func FlushOnByte(b byte) WriterOption {
+	return func(w *Writer) error {
+		w.flushOnByte, w.flushByte = true, b
+		return nil
+	}
+}
+
+// VerifyRoundTrip makes the Writer decode each block that it compresses and
+// compare the result with the original bytes before writing it out. On a
+// mismatch, nothing more is written and the Writer fails with a
+// *RoundTripError.
+//
+// This guards against silent encoder bugs, for example when archiving data
+// that will not otherwise be read back soon, at roughly twice the CPU cost.
+func VerifyRoundTrip() WriterOption {
+	return func(w *Writer) error {
+		w.verify = true
+		return nil
+	}
+}
+
+// AdaptiveBlockSize makes the Writer vary the amount of data that it buffers
+// before compressing and forwarding it, between min and max bytes, instead of
+// always filling blocks of the size set by the BlockSize option. Both bounds
+// must be in the range [1, 65536], with min <= max. The option sets the
+// Writer's block size to max, and a later BlockSize option must not set it
+// below min. Without this option, which is the default, or with min == max,
+// every block is filled before being written.
+//
+// The Writer compresses and forwards its buffer once a Write takes it to at
+// least a target size, which starts at max. The heuristic that adjusts the
+// target, which may change, works from the outcome of each block compressed:
+//
+//   - If a block compresses to half its size or less, the target size doubles,
+//     as data that compresses well benefits from the longer matches that larger
+//     blocks allow.
+//   - If a block does not compress enough to be stored compressed, the target
+//     size halves, as larger blocks would not help, and smaller ones reach the
+//     underlying io.Writer sooner.
+//
+// The target is also kept at no less than twice the moving average size of
+// recent Writes, so that a block holds at least a couple of typical Writes,
+// up to max. As with AutoFlushBytes, the output is in the standard framing
+// format.
+func AdaptiveBlockSize(min, max int) WriterOption {
+	return func(w *Writer) error {
+		if min < 1 || min > max || max > maxBlockSize {
+			return errInvalidBlockSize
+		}
+		w.adaptiveMin = min
+		w.blockSize = max
+		return nil
 	}
 }
 
+// ComparisonEncoder makes the Writer also pass each block that it compresses to
+// fn, which returns the length of that block compressed by some other codec.
+// That length, and the time taken by fn, are accumulated in the Writer's Stats
+// alongside those of Snappy, so that codecs can be compared on real traffic.
+// Whatever fn produces is otherwise discarded: the Writer's output is
+// unchanged. fn must not retain src.
+func ComparisonEncoder(fn func(src []byte) (compressedLen int)) WriterOption {
+	return func(w *Writer) error {
+		w.compare = fn
+		return nil
+	}
+}
+
+// BlockDeadline bounds the time that the Writer spends compressing each block
+// to d, which must be positive. A block that takes longer is written
+// uncompressed instead, trading compression ratio for predictable latency.
+//
+// Each block is compressed on another goroutine, from a copy of the data, so
+// that the Writer can stop waiting for it. That goroutine finishes compressing
+// in the background, and its result is discarded. This costs some time even
+// for blocks that meet the deadline, so the option is only worth using when
+// the occasional slow block matters more than the average speed.
+func BlockDeadline(d time.Duration) WriterOption {
+	return func(w *Writer) error {
+		if d <= 0 {
+			return errInvalidDeadline
+		}
+		w.deadline = d
+		return nil
+	}
+}
+
+// WriterStats holds statistics about the blocks that a Writer has compressed.
+type WriterStats struct {
+	// Blocks is the number of blocks compressed, and UncompressedBytes is
+	// their total length.
+	Blocks            int64
+	UncompressedBytes int64
+
+	// CompressedBytes is the total length of the blocks as encoded by Snappy,
+	// whether or not each was then written compressed or stored.
+	CompressedBytes int64
+
+	// ComparisonBytes is the total of the lengths returned by the function
+	// passed to the ComparisonEncoder option. It is zero without that option.
+	ComparisonBytes int64
+
+	// EncodeTime and ComparisonTime are the total time spent encoding the
+	// blocks with Snappy and with the ComparisonEncoder function. They are
+	// only measured with that option, and are zero otherwise.
+	EncodeTime     time.Duration
+	ComparisonTime time.Duration
+
+	// TimedOut is the number of blocks written uncompressed because
+	// compressing them took longer than the BlockDeadline option allows.
+	// Their compressed lengths are not counted in CompressedBytes.
+	TimedOut int64
+}
+
 // Writer is an io.Writer than can write Snappy-compressed bytes.
 type Writer struct {
 	w   io.Writer
@@ -153,19 +735,144 @@ type Writer struct {
 	// obuf is a buffer for the outgoing (compressed) bytes.
 	obuf []byte
 
+	// blockSize is the maximum number of uncompressed bytes per chunk.
+	blockSize int
+
+	// obufSize is the size of obuf, as configured by the OutputBufferSize
+	// option or else defaulted from blockSize.
+	obufSize int
+
+	// optErr is the error, if any, from applying the WriterOption values. It
+	// survives Reset.
+	optErr error
+
+	// terminate is whether Close writes an end-of-stream chunk.
+	terminate bool
+
+	// paramHeader is whether each stream starts with a parameter header
+	// chunk, recording params as well as the Writer's own settings.
+	paramHeader bool
+	params      map[string]string
+
+	// lengthSeeker, if non-nil, is the underlying io.WriteSeeker of a Writer
+	// from NewLengthPrefixedWriter, and lengthPos is the position in it of the
+	// body of the stream length chunk, which Close fills in.
+	lengthSeeker io.WriteSeeker
+	lengthPos    int64
+
+	// verify is whether to check that each compressed block decodes back to
+	// its input, using vbuf as scratch space.
+	verify bool
+	vbuf   []byte
+
+	// adaptiveMin, if positive, is the smallest block size that the
+	// AdaptiveBlockSize option allows, and adaptiveTarget is the block size
+	// that it is currently aiming for. avgWrite is a moving average of the
+	// sizes of recent Writes.
+	adaptiveMin    int
+	adaptiveTarget int
+	avgWrite       int
+
+	// compare is the function set by the ComparisonEncoder option, and stats
+	// accumulates the statistics returned by Stats.
+	compare func([]byte) int
+	stats   WriterStats
+
+	// deadline, if positive, is the time allowed for compressing each block.
+	// sbuf and dbuf are copies of the block and the buffer that it is
+	// compressed into, owned by the goroutine that compresses it.
+	deadline time.Duration
+	sbuf     []byte
+	dbuf     []byte
+
+	// autoFlush, if positive, is the number of buffered bytes at which Write
+	// flushes.
+	autoFlush int
+
+	// flushOnByte is whether Write flushes after writing flushByte.
+	flushOnByte bool
+	flushByte   byte
+
+	// cdcMask, if non-zero, selects the bits of the rolling hash cdcHash that
+	// must be zero to end a block of at least cdcMin bytes, for a Writer from
+	// NewCDCWriter.
+	cdcMask uint64
+	cdcMin  int
+	cdcHash uint64
+
 	// wroteStreamHeader is whether we have written the stream header.
 	wroteStreamHeader bool
+
+	// streamCRC is the unmasked CRC-32C of all of the uncompressed bytes
+	// written so far. It is built up from the per-chunk checksums.
+	streamCRC uint32
+
+	// written is the number of uncompressed bytes written so far.
+	written int64
+
+	// outputLen is the number of bytes written to w so far.
+	outputLen int64
+
+	// sinks are the additional io.Writers added by AddWriter, and sinkErrs
+	// are the errors, if any, that stopped output to each of them.
+	sinks    []io.Writer
+	sinkErrs []error
 }
 
 // Reset discards the writer's state and switches the Snappy writer to write to
 // w. This permits reusing a Writer rather than allocating a new one.
 func (w *Writer) Reset(writer io.Writer) {
 	w.w = writer
-	w.err = nil
+	w.err = w.optErr
 	if w.ibuf != nil {
 		w.ibuf = w.ibuf[:0]
 	}
 	w.wroteStreamHeader = false
+	w.streamCRC = 0
+	w.written = 0
+	w.outputLen = 0
+	w.adaptiveTarget = w.blockSize
+	w.avgWrite = 0
+	w.cdcHash = 0
+	w.stats = WriterStats{}
+	w.sinks, w.sinkErrs = nil, nil
+	if w.lengthSeeker != nil {
+		if ws, ok := writer.(io.WriteSeeker); ok {
+			w.startLengthPrefix(ws)
+		} else if w.err == nil {
+			w.err = errLengthNotSeekable
+		}
+	}
+}
+
+// Stats returns statistics about the blocks that the Writer has compressed
+// since it was created or last Reset.
+func (w *Writer) Stats() WriterStats {
+	return w.stats
+}
+
+// Pending returns the number of uncompressed bytes that have been written to
+// the Writer but not yet compressed and forwarded to the underlying
+// io.Writer. It never exceeds BlockSize, and is always zero for a Writer
+// returned by NewWriter, which does not buffer.
+func (w *Writer) Pending() int {
+	return len(w.ibuf)
+}
+
+// Available returns how many more bytes can be written to the Writer before it
+// has to compress and forward its buffer. A Write of at most that many bytes
+// is compressed into the same chunk as the bytes already buffered, even with
+// the AutoFlushBytes option. It is always zero for a Writer returned by
+// NewWriter, which does not buffer.
+func (w *Writer) Available() int {
+	return cap(w.ibuf) - len(w.ibuf)
+}
+
+// BlockSize returns the maximum number of uncompressed bytes per chunk, as
+// configured by the BlockSize option. A buffered Writer compresses and
+// forwards its buffer whenever it holds that many bytes.
+func (w *Writer) BlockSize() int {
+	return w.blockSize
 }
 
 // Write satisfies the io.Writer interface.
@@ -177,6 +884,27 @@ func (w *Writer) Write(p []byte) (nRet int, errRet error) {
 		// compatibility with code that doesn't explicitly Flush or Close.
 		return w.write(p)
 	}
+	if w.flushOnByte {
+		if i := bytes.LastIndexByte(p, w.flushByte); i >= 0 {
+			n, err := w.writeBuffered(p[:i+1])
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				return n, err
+			}
+			m, err := w.writeBuffered(p[i+1:])
+			return n + m, err
+		}
+	}
+	return w.writeBuffered(p)
+}
+
+// writeBuffered implements Write for a buffered Writer.
+func (w *Writer) writeBuffered(p []byte) (nRet int, errRet error) {
+	if w.cdcMask != 0 {
+		return w.writeCDC(p)
+	}
 
 	// The remainder of this method is based on bufio.Writer.Write from the
 	// standard library.
@@ -201,39 +929,180 @@ func (w *Writer) Write(p []byte) (nRet int, errRet error) {
 	n := copy(w.ibuf[len(w.ibuf):cap(w.ibuf)], p)
 	w.ibuf = w.ibuf[:len(w.ibuf)+n]
 	nRet += n
+	if w.adaptiveMin > 0 {
+		w.avgWrite += (nRet - w.avgWrite) / 8
+	}
+	if t := w.flushThreshold(); t > 0 && len(w.ibuf) >= t {
+		if err := w.Flush(); err != nil {
+			return nRet, err
+		}
+	}
 	return nRet, nil
 }
 
+// TryWrite is like Write, but it never writes to the underlying io.Writer: it
+// only accepts as many bytes of p as fit in the Writer's buffer before the
+// buffer would have to be compressed and forwarded. It returns the number of
+// bytes accepted, which are buffered as by Write, and ErrWouldBlock if that is
+// fewer than len(p). The caller should then call Flush, once the underlying
+// io.Writer can take more, and retry the rest of p. This lets a producer apply
+// backpressure upstream rather than block in Write on a slow sink.
+//
+// ErrWouldBlock does not stop the Writer. Any other error is that which Write
+// would return. The buffer ends where Write would flush it, so after the
+// number of bytes set by the AutoFlushBytes option, or the delimiter set by
+// FlushOnByte, nothing more is accepted until the next Flush. A Writer
+// returned by NewWriter, which does not buffer, accepts nothing, and one from
+// NewCDCWriter does not support TryWrite.
+func (w *Writer) TryWrite(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.cdcMask != 0 {
+		return 0, errTryWriteCDC
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	room := cap(w.ibuf) - len(w.ibuf)
+	if t := w.flushThreshold(); t > 0 && t-len(w.ibuf) < room {
+		room = t - len(w.ibuf)
+	}
+	if w.flushOnByte && len(w.ibuf) > 0 && w.ibuf[len(w.ibuf)-1] == w.flushByte {
+		room = 0
+	}
+	if room <= 0 {
+		return 0, ErrWouldBlock
+	}
+	if room > len(p) {
+		room = len(p)
+	}
+	if w.flushOnByte {
+		if i := bytes.IndexByte(p[:room], w.flushByte); i >= 0 {
+			room = i + 1
+		}
+	}
+	w.ibuf = append(w.ibuf, p[:room]...)
+	if room < len(p) {
+		return room, ErrWouldBlock
+	}
+	return room, nil
+}
+
+// ReadFrom implements the io.ReaderFrom interface, so that io.Copy to a Writer
+// uses it. A buffered Writer reads from r directly into its buffer, a block at
+// a time, and compresses each block as soon as it is full, avoiding the copy
+// that Write would make. As with Write, any final partial block stays buffered
+// until the next Flush or Close. A Writer from NewCDCWriter, or with the
+// FlushOnByte option, passes what it reads to Write instead.
+func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.ibuf == nil || w.cdcMask != 0 || w.flushOnByte {
+		write := w.write
+		if w.ibuf != nil {
+			write = w.Write
+		}
+		buf := make([]byte, w.blockSize)
+		for {
+			m, rerr := r.Read(buf)
+			n += int64(m)
+			if _, err := write(buf[:m]); err != nil {
+				return n, err
+			}
+			if rerr != nil {
+				if rerr == io.EOF {
+					rerr = nil
+				}
+				return n, rerr
+			}
+		}
+	}
+
+	emptyReads := 0
+	for {
+		if len(w.ibuf) == cap(w.ibuf) {
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
+		}
+		m, rerr := r.Read(w.ibuf[len(w.ibuf):cap(w.ibuf)])
+		w.ibuf = w.ibuf[:len(w.ibuf)+m]
+		n += int64(m)
+		if t := w.flushThreshold(); t > 0 && len(w.ibuf) >= t {
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				rerr = nil
+			}
+			return n, rerr
+		}
+		// Guard against readers that return neither data nor an error, as
+		// bufio.Writer.ReadFrom does.
+		if m > 0 {
+			emptyReads = 0
+		} else if emptyReads++; emptyReads >= 100 {
+			return n, io.ErrNoProgress
+		}
+	}
+}
+
 func (w *Writer) write(p []byte) (nRet int, errRet error) {
 	if w.err != nil {
 		return 0, w.err
 	}
 	for len(p) > 0 {
-		obufStart := len(magicChunk)
-		if !w.wroteStreamHeader {
-			w.wroteStreamHeader = true
-			copy(w.obuf, magicChunk)
-			obufStart = 0
+		obufStart := w.startStream()
+		if w.err != nil {
+			return nRet, w.err
 		}
 
 		var uncompressed []byte
-		if len(p) > maxBlockSize {
-			uncompressed, p = p[:maxBlockSize], p[maxBlockSize:]
+		if len(p) > w.blockSize {
+			uncompressed, p = p[:w.blockSize], p[w.blockSize:]
 		} else {
 			uncompressed, p = p, nil
 		}
-		checksum := crc(uncompressed)
+		c := crc32.Update(0, crcTable, uncompressed)
+		w.streamCRC = crcCombine(w.streamCRC, c, int64(len(uncompressed)))
+		checksum := maskCRC(c)
 
 		// Compress the buffer, discarding the result if the improvement
 		// isn't at least 12.5%.
-		compressed := Encode(w.obuf[obufHeaderLen:], uncompressed)
+		var start time.Time
+		if w.compare != nil {
+			start = time.Now()
+		}
+		var compressed []byte
+		timedOut := false
+		if w.deadline > 0 {
+			compressed, timedOut = w.encodeWithDeadline(uncompressed)
+		} else {
+			compressed = Encode(w.obuf[obufHeaderLen:], uncompressed)
+		}
+		if w.compare != nil {
+			w.compareBlock(uncompressed, time.Since(start))
+		}
+		w.stats.Blocks++
+		w.stats.UncompressedBytes += int64(len(uncompressed))
+		w.stats.CompressedBytes += int64(len(compressed))
 		chunkType := uint8(chunkTypeCompressedData)
 		chunkLen := 4 + len(compressed)
 		obufEnd := obufHeaderLen + len(compressed)
-		if len(compressed) >= len(uncompressed)-len(uncompressed)/8 {
+		if timedOut || len(compressed) >= len(uncompressed)-len(uncompressed)/8 {
 			chunkType = chunkTypeUncompressedData
 			chunkLen = 4 + len(uncompressed)
 			obufEnd = obufHeaderLen
+		} else if w.verify && !w.roundTrips(compressed, uncompressed) {
+			w.err = &RoundTripError{Offset: w.written}
+			return nRet, w.err
+		}
+		if w.adaptiveMin > 0 {
+			w.adaptBlockSize(len(uncompressed), len(compressed), chunkType == chunkTypeUncompressedData)
 		}
 
 		// Fill in the per-chunk header that comes before the body.
@@ -246,21 +1115,357 @@ func (w *Writer) write(p []byte) (nRet int, errRet error) {
 		w.obuf[len(magicChunk)+6] = uint8(checksum >> 16)
 		w.obuf[len(magicChunk)+7] = uint8(checksum >> 24)
 
-		if _, err := w.w.Write(w.obuf[obufStart:obufEnd]); err != nil {
-			w.err = err
+		if err := w.output(w.obuf[obufStart:obufEnd]); err != nil {
 			return nRet, err
 		}
 		if chunkType == chunkTypeUncompressedData {
-			if _, err := w.w.Write(uncompressed); err != nil {
-				w.err = err
+			if err := w.output(uncompressed); err != nil {
 				return nRet, err
 			}
 		}
 		nRet += len(uncompressed)
+		w.written += int64(len(uncompressed))
 	}
 	return nRet, nil
 }
 
+// encodeWithDeadline compresses src into w.obuf, as write does, but gives up,
+// returning true, if that takes longer than w.deadline.
+func (w *Writer) encodeWithDeadline(src []byte) (compressed []byte, timedOut bool) {
+	if w.sbuf == nil {
+		w.sbuf = make([]byte, w.blockSize)
+		w.dbuf = make([]byte, MaxEncodedLen(w.blockSize))
+	}
+	sbuf, dbuf := w.sbuf[:copy(w.sbuf, src)], w.dbuf
+	done := make(chan []byte, 1)
+	go func() {
+		done <- Encode(dbuf, sbuf)
+	}()
+	timer := time.NewTimer(w.deadline)
+	defer timer.Stop()
+	select {
+	case c := <-done:
+		n := copy(w.obuf[obufHeaderLen:], c)
+		return w.obuf[obufHeaderLen : obufHeaderLen+n], false
+	case <-timer.C:
+		// The goroutine still owns the buffers.
+		w.sbuf, w.dbuf = nil, nil
+		w.stats.TimedOut++
+		return nil, true
+	}
+}
+
+// flushThreshold returns the number of buffered bytes at which Write flushes
+// before its buffer is full, or 0 if it does not.
+func (w *Writer) flushThreshold() int {
+	t := w.autoFlush
+	if w.adaptiveMin > 0 {
+		a := w.adaptiveTarget
+		if 2*w.avgWrite > a {
+			a = 2 * w.avgWrite
+		}
+		if a < w.blockSize && (t == 0 || a < t) {
+			t = a
+		}
+	}
+	return t
+}
+
+// adaptBlockSize updates the AdaptiveBlockSize option's target block size,
+// given the outcome of compressing a block.
+func (w *Writer) adaptBlockSize(uncompressedLen, compressedLen int, stored bool) {
+	switch {
+	case stored:
+		w.adaptiveTarget /= 2
+	case 2*compressedLen <= uncompressedLen:
+		w.adaptiveTarget *= 2
+	}
+	if w.adaptiveTarget < w.adaptiveMin {
+		w.adaptiveTarget = w.adaptiveMin
+	} else if w.adaptiveTarget > w.blockSize {
+		w.adaptiveTarget = w.blockSize
+	}
+}
+
+// compareBlock runs the ComparisonEncoder option's function on a block that
+// took d to encode with Snappy, and records the outcome.
+func (w *Writer) compareBlock(uncompressed []byte, d time.Duration) {
+	w.stats.EncodeTime += d
+	start := time.Now()
+	n := w.compare(uncompressed)
+	w.stats.ComparisonTime += time.Since(start)
+	w.stats.ComparisonBytes += int64(n)
+}
+
+// roundTrips returns whether compressed decodes to uncompressed.
+func (w *Writer) roundTrips(compressed, uncompressed []byte) bool {
+	if w.vbuf == nil {
+		w.vbuf = make([]byte, w.blockSize)
+	}
+	decoded, err := Decode(w.vbuf, compressed)
+	return err == nil && bytes.Equal(decoded, uncompressed)
+}
+
+// startStream starts the stream, if that has not been done yet, and returns
+// the offset in w.obuf at which to start writing the next chunk: 0 if the
+// stream identifier, which w.obuf then starts with, is still to be written
+// along with that chunk, and len(magicChunk) otherwise.
+//
+// Streams that start with more chunks, a parameter header or a stream length,
+// have the stream identifier and those chunks written straight away, and any
+// error in doing so is left in w.err. They are written then, with the first
+// output, rather than when the Writer is created or Reset, so that AddWriter
+// can still be called and the underlying io.Writer may be nil until then.
+func (w *Writer) startStream() (obufStart int) {
+	if w.wroteStreamHeader {
+		return len(magicChunk)
+	}
+	w.wroteStreamHeader = true
+	copy(w.obuf, magicChunk)
+	if !w.paramHeader && w.lengthSeeker == nil {
+		return 0
+	}
+	if w.output(w.obuf[:len(magicChunk)]) != nil {
+		return len(magicChunk)
+	}
+	if w.paramHeader {
+		w.writeParams()
+	}
+	if w.lengthSeeker != nil {
+		w.writeLengthPlaceholder()
+	}
+	return len(magicChunk)
+}
+
+// writeChunk writes a chunk with the given type and body, preceded by the
+// stream identifier if that has not been written yet. The caller is
+// responsible for flushing any buffered data first.
+func (w *Writer) writeChunk(chunkType uint8, body []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(body) >= 1<<24 {
+		w.err = ErrTooLarge
+		return w.err
+	}
+	obufStart := w.startStream()
+	if w.err != nil {
+		return w.err
+	}
+	w.obuf[len(magicChunk)+0] = chunkType
+	w.obuf[len(magicChunk)+1] = uint8(len(body) >> 0)
+	w.obuf[len(magicChunk)+2] = uint8(len(body) >> 8)
+	w.obuf[len(magicChunk)+3] = uint8(len(body) >> 16)
+	obufEnd := len(magicChunk) + chunkHeaderSize
+
+	// Small bodies are copied so that the chunk takes only one Write call.
+	if len(body) <= len(w.obuf)-obufEnd {
+		obufEnd += copy(w.obuf[obufEnd:], body)
+		body = nil
+	}
+	if err := w.output(w.obuf[obufStart:obufEnd]); err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		return w.output(body)
+	}
+	return nil
+}
+
+// output writes p to the underlying io.Writer, keeping count of the bytes
+// written, and then to any sinks added by AddWriter that have not failed.
+func (w *Writer) output(p []byte) error {
+	n, err := w.w.Write(p)
+	w.outputLen += int64(n)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	for i, s := range w.sinks {
+		if w.sinkErrs[i] != nil {
+			continue
+		}
+		if n, err := s.Write(p); err != nil {
+			w.sinkErrs[i] = err
+		} else if n != len(p) {
+			w.sinkErrs[i] = io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// AddWriter adds another io.Writer to which the Writer writes its output, so
+// that the same compressed stream goes to several destinations, such as a
+// local file and a network connection, while compressing it only once. It
+// must be called before any output is written, that is, before the first
+// Write, Flush or Close since the Writer was created or last Reset, and
+// returns an error otherwise. Reset removes the added io.Writers.
+//
+// The io.Writer that the Writer was created or Reset with remains the
+// primary one: an error in writing to it fails the Writer, as usual, and
+// nothing more is written anywhere. An error in writing to an added io.Writer
+// only stops output to that one, whose stream is then incomplete and possibly
+// cut off mid-chunk, while the others carry on unaffected. Such errors are not
+// returned by the Writer's methods, but by SinkErrors.
+//
+// A Writer from NewLengthPrefixedWriter does not support AddWriter, which
+// returns an error, as Close fills in the stream length by seeking in the
+// primary io.Writer only, and would leave a length of zero in the others.
+func (w *Writer) AddWriter(x io.Writer) error {
+	if w.lengthSeeker != nil {
+		return errAddWriterLength
+	}
+	if w.wroteStreamHeader || w.outputLen > 0 {
+		return errAddWriterTooLate
+	}
+	w.sinks = append(w.sinks, x)
+	w.sinkErrs = append(w.sinkErrs, nil)
+	return nil
+}
+
+// SinkErrors returns, for each io.Writer added by AddWriter, in the order in
+// which they were added, the error that stopped output to it, or nil if it
+// has received all of the output so far.
+func (w *Writer) SinkErrors() []error {
+	return append([]error(nil), w.sinkErrs...)
+}
+
+// WritePreEncoded flushes the Writer and then writes compressed, a block as
+// returned by Encode, as a compressed data chunk, without re-encoding it. This
+// avoids compressing data twice when its compressed form is already at hand,
+// such as from a cache. The block must decode to uncompressedLen bytes, at
+// most 64 KiB, and crc must be the masked CRC-32C checksum of those bytes, as
+// returned by DecodeAndCRC.
+//
+// Only the decoded length that the block's header declares is checked, and
+// that the block is no longer than MaxEncodedLen of it, as no block from
+// Encode is, unless the Writer has the VerifyRoundTrip option, in which case
+// the block is decoded and its checksum verified too, and a mismatch fails the
+// Writer with a *RoundTripError. Otherwise, a wrong checksum or a corrupt
+// block is only detected when the stream is read. A block that fails the
+// first checks is rejected before the Writer is flushed.
+func (w *Writer) WritePreEncoded(compressed []byte, uncompressedLen int, crc uint32) error {
+	if n, err := DecodedLen(compressed); err != nil || n != uncompressedLen {
+		return ErrCorrupt
+	}
+	if uncompressedLen > maxBlockSize {
+		return ErrTooLarge
+	}
+	if len(compressed) > MaxEncodedLen(uncompressedLen) {
+		// Its chunk could be longer than Readers accept, or than the chunk
+		// header can record.
+		return ErrCorrupt
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if w.verify && !w.verifyPreEncoded(compressed, crc) {
+		w.err = &RoundTripError{Offset: w.written}
+		return w.err
+	}
+
+	obufStart := w.startStream()
+	if w.err != nil {
+		return w.err
+	}
+	w.streamCRC = crcCombine(w.streamCRC, unmaskCRC(crc), int64(uncompressedLen))
+	chunkLen := checksumSize + len(compressed)
+	w.obuf[len(magicChunk)+0] = chunkTypeCompressedData
+	w.obuf[len(magicChunk)+1] = uint8(chunkLen >> 0)
+	w.obuf[len(magicChunk)+2] = uint8(chunkLen >> 8)
+	w.obuf[len(magicChunk)+3] = uint8(chunkLen >> 16)
+	w.obuf[len(magicChunk)+4] = uint8(crc >> 0)
+	w.obuf[len(magicChunk)+5] = uint8(crc >> 8)
+	w.obuf[len(magicChunk)+6] = uint8(crc >> 16)
+	w.obuf[len(magicChunk)+7] = uint8(crc >> 24)
+	if err := w.output(w.obuf[obufStart:obufHeaderLen]); err != nil {
+		return err
+	}
+	if err := w.output(compressed); err != nil {
+		return err
+	}
+	w.stats.Blocks++
+	w.stats.UncompressedBytes += int64(uncompressedLen)
+	w.stats.CompressedBytes += int64(len(compressed))
+	w.written += int64(uncompressedLen)
+	return nil
+}
+
+// verifyPreEncoded returns whether compressed is a valid block whose decoded
+// bytes have the checksum crc.
+func (w *Writer) verifyPreEncoded(compressed []byte, crc uint32) bool {
+	if w.vbuf == nil {
+		w.vbuf = make([]byte, w.blockSize)
+	}
+	decoded, err := Decode(w.vbuf, compressed)
+	if err != nil {
+		return false
+	}
+	return maskCRC(crc32.Update(0, crcTable, decoded)) == crc
+}
+
+// maxPadAlignment is the largest alignment that PadTo supports. Aligning to it
+// can take a padding chunk of up to maxPadAlignment+3 bytes, which is the most
+// that a chunk's 24-bit length field allows, counting the chunk header.
+const maxPadAlignment = 1 << 24
+
+// PadTo flushes the Writer and then, if necessary, writes a padding chunk so
+// that the total length of the output so far is a multiple of alignment. This
+// is useful when the output goes to storage that is faster with aligned
+// writes, such as a block device: after PadTo(512), the next Flush writes
+// starting on a sector boundary. Readers skip padding chunks.
+//
+// The output length counts from when the Writer was created or last Reset.
+// The alignment must be in the range [1, 1<<24]. A padding chunk is at least
+// 4 bytes long, so the padding may be up to alignment+3 bytes.
+func (w *Writer) PadTo(alignment int) error {
+	if alignment < 1 || alignment > maxPadAlignment {
+		return errInvalidAlignment
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if w.startStream() == 0 {
+		w.output(w.obuf[:len(magicChunk)])
+	}
+	if w.err != nil {
+		return w.err
+	}
+	n := int(w.outputLen % int64(alignment))
+	if n == 0 {
+		return nil
+	}
+	n = alignment - n
+	for n < chunkHeaderSize {
+		n += alignment
+	}
+
+	// Write the padding chunk from w.obuf, after the stream identifier, with
+	// as much of its body as fits zeroed, and the rest of the body from the
+	// same zeros, rather than allocate a body of up to 16 MiB.
+	n -= chunkHeaderSize
+	putChunkHeader(w.obuf[len(magicChunk):], chunkTypePadding, n)
+	zeros := w.obuf[len(magicChunk)+chunkHeaderSize:]
+	if len(zeros) > n {
+		zeros = zeros[:n]
+	}
+	for i := range zeros {
+		zeros[i] = 0
+	}
+	if err := w.output(w.obuf[len(magicChunk) : len(magicChunk)+chunkHeaderSize+len(zeros)]); err != nil {
+		return err
+	}
+	for n -= len(zeros); n > 0; n -= len(zeros) {
+		if len(zeros) > n {
+			zeros = zeros[:n]
+		}
+		if err := w.output(zeros); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Flush flushes the Writer to its underlying io.Writer.
 func (w *Writer) Flush() error {
 	if w.err != nil {
@@ -275,11 +1480,53 @@ func (w *Writer) Flush() error {
 }
 
 // Close calls Flush and then closes the Writer.
+//
+// If nothing was written since the Writer was created or last Reset, Close
+// still writes the stream identifier, so that the output is a valid, empty
+// stream.
 func (w *Writer) Close() error {
 	w.Flush()
+	if w.terminate {
+		var body [checksumSize]byte
+		binary.LittleEndian.PutUint32(body[:], maskCRC(w.streamCRC))
+		w.writeChunk(chunkTypeEndOfStream, body[:])
+	} else if w.err == nil && w.startStream() == 0 {
+		w.output(w.obuf[:len(magicChunk)])
+	}
+	if w.err == nil && w.lengthSeeker != nil {
+		w.patchLength()
+	}
 	ret := w.err
 	if w.err == nil {
 		w.err = errClosed
 	}
 	return ret
 }
+
+// CloseWithDigest is like Close, but also returns a checksum of all of the
+// uncompressed bytes written since the Writer was created or last Reset.
+//
+// The checksum is masked in the same way as the framing format's per-chunk
+// checksums, so it equals the checksum that a single chunk holding all of
+// that data would record. It is derived from the per-chunk checksums, so it
+// costs very little to compute.
+func (w *Writer) CloseWithDigest() (uint32, error) {
+	err := w.Close()
+	return maskCRC(w.streamCRC), err
+}
+
+// RollingCRC returns the masked CRC-32C checksum of all of the uncompressed
+// bytes written since the Writer was created or last Reset, including any
+// that are still buffered, as CloseWithDigest would if called now. It is
+// meant for checking the data against an independently computed checksum at
+// checkpoints along the stream.
+//
+// The checksum is maintained as blocks are written, so the cost of a call is
+// that of checksumming the buffered bytes, of which there are at most 64 KiB.
+func (w *Writer) RollingCRC() uint32 {
+	c := w.streamCRC
+	if len(w.ibuf) > 0 {
+		c = crcCombine(c, crc32.Update(0, crcTable, w.ibuf), int64(len(w.ibuf)))
+	}
+	return maskCRC(c)
+}
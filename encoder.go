@@ -0,0 +1,380 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+// An Encoder encodes blocks in the same format as the Encode function, but
+// with configurable trade-offs between encoding speed and output size. The
+// output of its Encode and EncodeBatch methods can always be decoded by
+// Decode, regardless of its configuration.
+//
+// An Encoder always uses the portable (pure Go) block encoder, even on
+// architectures where the Encode function uses assembly. With the default
+// configuration, its output is identical to that of Encode.
+//
+// Reusing an Encoder is cheaper than calling Encode for many small inputs, as
+// an Encoder keeps its hash table between calls, and avoids having to clear it
+// before each block by tagging its entries with a per-block generation number.
+// (On amd64, the assembly behind Encode clears only the part of its table that
+// it uses, and is faster than an Encoder regardless.)
+//
+// Encode and EncodeBatch encode every block independently of those before
+// it: its copies can only refer to earlier bytes of the same block, and its
+// hash table starts out empty. So the first block that they encode
+// compresses exactly as well as any later one. The EncodeBlockContinue method
+// is the exception: its blocks may also copy from the blocks that it encoded
+// before them, and so can not be decoded by Decode, but only in sequence by a
+// ContinueDecoder.
+//
+// For the same reason, there is no way to prime an Encoder with sample data:
+// a hash table entry pointing into the sample would give a copy from bytes
+// that Decode never sees, and one pointing into the block itself is found
+// without priming. To compress small blocks against shared context, use
+// NewDictionary and EncodeDict instead.
+//
+// An Encoder is not safe for concurrent use by multiple goroutines.
+type Encoder struct {
+	// dense is whether to look for matches at every position, instead of
+	// skipping ahead through incompressible input.
+	dense bool
+
+	// runs is whether to look for matches at short, fixed distances, as well
+	// as in the hash table.
+	runs bool
+
+	// skipInit and skipShift parameterize the match skipping heuristic. See
+	// SkipHeuristic. A zero skipInit means the default of 32 and 5.
+	skipInit  int
+	skipShift uint
+
+	// probe is whether to store blocks that a sample shows to be
+	// incompressible, without looking for matches.
+	probe bool
+
+	// table is the hash table of encodeBlock. It is kept between calls, so
+	// that it need not be zeroed for each block, which otherwise dominates the
+	// cost of encoding small blocks.
+	//
+	// Each entry holds a generation number in its high 16 bits and a position
+	// in src in its low 16 bits. Entries from earlier generations (earlier
+	// blocks) read as zero, exactly as if the table had been zeroed, so the
+	// output does not depend on what was encoded before. The table is only
+	// actually zeroed when the generation number wraps around.
+	table [maxTableSize]uint32
+	gen   uint32
+
+	// cont is the state of EncodeBlockContinue, allocated on first use.
+	cont *continueState
+}
+
+const (
+	// maxTableSize is the maximum size of the encodeBlock hash table.
+	maxTableSize = 1 << 14
+	// tableMask is redundant, but helps the compiler eliminate bounds checks.
+	tableMask = maxTableSize - 1
+)
+
+// An EncoderOption configures an Encoder returned by NewEncoder.
+type EncoderOption func(*Encoder)
+
+// DenseMatching makes the Encoder look up match candidates at every input
+// position, and record every position of each match it finds, instead of
+// progressively skipping ahead through input that has not recently matched.
+//
+// This finds more of the matches that are shifted by arbitrary amounts
+// relative to each other, such as in edited documents, giving smaller output
+// at the cost of slower encoding, especially of incompressible input.
+func DenseMatching() EncoderOption {
+	return func(e *Encoder) {
+		e.dense = true
+	}
+}
+
+// RunMatching makes the Encoder look for matches at distances of 1, 2, 4 and 8
+// bytes before the position being encoded, in addition to those that it finds
+// by hashing. This catches runs of a repeated byte, and of repeated 2, 4 or 8
+// byte values, such as in columns of fixed-width integers that change slowly
+// or that have been delta encoded, which the hash table otherwise misses after
+// it has been overwritten by other positions.
+//
+// The output is still a standard block, and is typically smaller for such
+// data. Encoding is slightly slower, as up to four more comparisons are made
+// at each position that is looked at.
+func RunMatching() EncoderOption {
+	return func(e *Encoder) {
+		e.runs = true
+	}
+}
+
+// SkipHeuristic tunes how quickly the Encoder gives up on looking for matches
+// in input that does not compress. The Encoder looks up candidates every
+// (skip >> shift) bytes, where skip starts at initialSkip after each match and
+// grows by that stride at each lookup, so the lookups become progressively
+// sparser. The default is SkipHeuristic(32, 5), as used by Encode: one lookup
+// per byte for the first 32 bytes after a match, then every 2 bytes, and so
+// on.
+//
+// A larger initialSkip relative to 1<<shift skips sooner, encoding
+// incompressible data faster but missing more matches, and a larger shift
+// slows the acceleration. Reasonable values have shift in [4, 8] and
+// initialSkip in [1<<shift, 8<<shift]. The output is a valid block whatever
+// the values, but NewEncoder panics if initialSkip is less than 1<<shift, or
+// shift is more than 16. The DenseMatching option overrides this one.
+func SkipHeuristic(initialSkip int, shift uint) EncoderOption {
+	return func(e *Encoder) {
+		if shift > 16 || initialSkip < 1<<shift {
+			panic("snappy: invalid SkipHeuristic parameters")
+		}
+		e.skipInit, e.skipShift = initialSkip, shift
+	}
+}
+
+// ProbeIncompressible makes the Encoder sample each block of more than 4 KiB
+// before encoding it, and store the block as a single literal, without looking
+// for matches, if the sample's bytes are so evenly distributed that the block
+// is very unlikely to compress, as with encrypted or already compressed data.
+// For such data, this saves most of the cost of the match search, which the
+// skip heuristic reduces but does not remove, although copying the block into
+// the output then still takes a good part of the time.
+//
+// The sample is about 256 bytes spread evenly over the block, and the test is
+// that they are about as varied as random bytes. It costs little for blocks
+// that do compress, which are then encoded as usual. But it has false
+// negatives: data whose bytes are evenly distributed, but which repeats, such
+// as random bytes copied over and over within 64 KiB, may be stored although
+// the match search would compress it. Blocks of at most 4 KiB are always
+// encoded as usual.
+func ProbeIncompressible() EncoderOption {
+	return func(e *Encoder) {
+		e.probe = true
+	}
+}
+
+// NewEncoder returns a new Encoder with the given options.
+func NewEncoder(opts ...EncoderOption) *Encoder {
+	e := &Encoder{}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Encode returns the encoded form of src. The returned slice may be a sub-
+// slice of dst if dst was large enough to hold the entire encoded block.
+// Otherwise, a newly allocated slice will be returned.
+//
+// The dst and src must not overlap. It is valid to pass a nil dst.
+func (e *Encoder) Encode(dst, src []byte) []byte {
+	return encode(dst, src, e.encodeBlock)
+}
+
+// EncodeBatch encodes each of srcs, returning a slice whose i'th element is
+// the same as the result of e.Encode(dsts[i], srcs[i]). The dsts may be nil,
+// or have nil elements, but otherwise must be the same length as srcs.
+//
+// It is equivalent to, but cheaper than, calling Encode for each element, as
+// the results for which the corresponding dst is too small are carved out of
+// a single allocation, which is sized for the worst case of the whole batch.
+func (e *Encoder) EncodeBatch(dsts, srcs [][]byte) [][]byte {
+	if dsts != nil && len(dsts) != len(srcs) {
+		panic("snappy: EncodeBatch called with mismatched dsts and srcs")
+	}
+	dstAt := func(i int) []byte {
+		if dsts == nil {
+			return nil
+		}
+		return dsts[i]
+	}
+
+	shared := 0
+	for i, src := range srcs {
+		n := MaxEncodedLen(len(src))
+		if n < 0 {
+			panic(ErrTooLarge)
+		}
+		if len(dstAt(i)) < n {
+			shared += n
+		}
+	}
+	buf := make([]byte, shared)
+
+	encoded := make([][]byte, len(srcs))
+	for i, src := range srcs {
+		dst, n := dstAt(i), MaxEncodedLen(len(src))
+		if len(dst) >= n {
+			encoded[i] = e.Encode(dst, src)
+			continue
+		}
+		d := e.Encode(buf[:n:n], src)
+		encoded[i], buf = d[:len(d):len(d)], buf[len(d):]
+	}
+	return encoded
+}
+
+// encodeBlock has the same semantics as the encodeBlock function in
+// encode_other.go, which it follows closely, but it is always compiled and it
+// honors the Encoder's configuration.
+func (e *Encoder) encodeBlock(dst, src []byte) (d int) {
+	if e.probe && looksIncompressible(src) {
+		return emitLiteral(dst, src)
+	}
+	shift := uint32(32 - 8)
+	for tableSize := 1 << 8; tableSize < maxTableSize && tableSize < len(src); tableSize *= 2 {
+		shift--
+	}
+	e.gen++
+	if e.gen == 1<<16 {
+		e.table = [maxTableSize]uint32{}
+		e.gen = 1
+	}
+	table, gen := &e.table, e.gen<<16
+
+	sLimit := len(src) - inputMargin
+	nextEmit := 0
+	s := 1
+	nextHash := hash(load32(src, s), shift)
+
+	skipInit, skipShift := e.skipInit, e.skipShift
+	if skipInit == 0 {
+		skipInit, skipShift = 32, 5
+	}
+	for {
+		// See encode_other.go for the match skipping heuristic, which
+		// SkipHeuristic parameterizes. With dense matching, skip never grows,
+		// and every position is looked at.
+		skip := skipInit
+		if e.dense {
+			skip = 1 << skipShift
+		}
+
+		nextS := s
+		candidate := 0
+		for {
+			s = nextS
+			bytesBetweenHashLookups := skip >> skipShift
+			nextS = s + bytesBetweenHashLookups
+			if !e.dense {
+				skip += bytesBetweenHashLookups
+			}
+			if nextS > sLimit {
+				goto emitRemainder
+			}
+			candidate = 0
+			if v := table[nextHash&tableMask]; v&^0xffff == gen {
+				candidate = int(v & 0xffff)
+			}
+			table[nextHash&tableMask] = gen | uint32(s)
+			nextHash = hash(load32(src, nextS), shift)
+			if load32(src, s) == load32(src, candidate) {
+				break
+			}
+			if e.runs {
+				if c := runCandidate(src, s); c >= 0 {
+					candidate = c
+					break
+				}
+			}
+		}
+
+		d += emitLiteral(dst[d:], src[nextEmit:s])
+
+		for {
+			base := s
+			s += 4
+			for i := candidate + 4; s < len(src) && src[i] == src[s]; i, s = i+1, s+1 {
+			}
+
+			d += emitCopy(dst[d:], base-candidate, s-base)
+			nextEmit = s
+			if s >= sLimit {
+				goto emitRemainder
+			}
+
+			if e.dense {
+				// Record the positions inside the match, not just the ones
+				// at its end, so that later input can match any of them.
+				for i := base + 1; i < s-1; i++ {
+					table[hash(load32(src, i), shift)&tableMask] = gen | uint32(i)
+				}
+			}
+
+			// Check for another match straight after the copy, recording
+			// s-1 on the way. This costs about as much as one step of the
+			// main loop, so there is no option to skip it and go back to
+			// that loop instead: doing so would take more steps, not fewer,
+			// and find fewer matches.
+			x := load64(src, s-1)
+			prevHash := hash(uint32(x>>0), shift)
+			table[prevHash&tableMask] = gen | uint32(s-1)
+			currHash := hash(uint32(x>>8), shift)
+			candidate = 0
+			if v := table[currHash&tableMask]; v&^0xffff == gen {
+				candidate = int(v & 0xffff)
+			}
+			table[currHash&tableMask] = gen | uint32(s)
+			if uint32(x>>8) != load32(src, candidate) {
+				if e.runs {
+					if c := runCandidate(src, s); c >= 0 {
+						candidate = c
+						continue
+					}
+				}
+				nextHash = hash(uint32(x>>16), shift)
+				s++
+				break
+			}
+		}
+	}
+
+emitRemainder:
+	if nextEmit < len(src) {
+		d += emitLiteral(dst[d:], src[nextEmit:])
+	}
+	return d
+}
+
+// runCandidate returns the start of a match for the 4 bytes at src[s:] at a
+// distance of 1, 2, 4 or 8 bytes, or -1 if there is none.
+func runCandidate(src []byte, s int) int {
+	v := load32(src, s)
+	for _, distance := range [...]int{1, 2, 4, 8} {
+		if distance <= s && load32(src, s-distance) == v {
+			return s - distance
+		}
+	}
+	return -1
+}
+
+const (
+	// probeMinLen is the length above which the ProbeIncompressible option
+	// samples blocks, and probeSamples is about how many bytes it samples.
+	probeMinLen  = 4096
+	probeSamples = 256
+)
+
+// looksIncompressible returns whether a sample of src, which is at most
+// maxBlockSize bytes long, has its bytes so evenly distributed that src is
+// very unlikely to compress.
+//
+// The test is on the number of pairs of sampled bytes that are equal. For
+// uniformly random bytes, a pair is equal with probability 1/256, and the
+// sample is considered random if its pairs are equal less than 1.5 times as
+// often as that. For text, for example, they are equal more than 10 times as
+// often.
+func looksIncompressible(src []byte) bool {
+	if len(src) <= probeMinLen {
+		return false
+	}
+	var counts [256]int
+	n := 0
+	for i, stride := 0, len(src)/probeSamples; i < len(src); i += stride {
+		counts[src[i]]++
+		n++
+	}
+	equal := 0
+	for _, c := range counts {
+		equal += c * (c - 1) / 2
+	}
+	return equal*256*2 < 3*n*(n-1)/2
+}
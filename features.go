@@ -0,0 +1,85 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+// BlockFeatures describes which features of the block format a block uses,
+// for consumers, such as hardware decoders, that only support some of them.
+type BlockFeatures struct {
+	// Literals and Copies are the numbers of literal and copy tags.
+	Literals int
+	Copies   int
+
+	// MaxOffset is the largest offset of any copy, or zero if there are
+	// none.
+	MaxOffset int
+
+	// OverlappingCopies is the number of copies whose length exceeds their
+	// offset, so that they copy bytes that they have themselves produced, as
+	// in run-length encoding.
+	OverlappingCopies int
+
+	// Copy4Tags is the number of copies encoded with 4-byte offsets (tag
+	// 0x03), which encoders no longer produce, except in blocks longer than
+	// 64 KiB.
+	Copy4Tags int
+}
+
+// DecodeWithFeatures is like Decode, but also reports which features of the
+// block format src uses. The features are only reported for valid blocks.
+//
+// It is slower than Decode, as it makes a second pass over the tags, and is
+// meant for checking blocks as they are ingested, rather than for decoding in
+// general.
+func DecodeWithFeatures(dst, src []byte) (out []byte, features BlockFeatures, err error) {
+	out, err = Decode(dst, src)
+	if err != nil {
+		return nil, BlockFeatures{}, err
+	}
+	// Decode has checked the whole block, so the tags need no checking here.
+	_, s, _ := decodedLen(src)
+	f := &features
+	for s < len(src) {
+		tag := src[s]
+		var length, offset int
+		switch tag & 0x03 {
+		case tagLiteral:
+			x := uint32(tag >> 2)
+			n := 0
+			if x >= 60 {
+				// The length is in the next 1-4 bytes, little-endian.
+				n = int(x) - 59
+				x = 0
+				for i := n; i > 0; i-- {
+					x = x<<8 | uint32(src[s+i])
+				}
+			}
+			s += 1 + n + int(x) + 1
+			f.Literals++
+			continue
+
+		case tagCopy1:
+			length = 4 + int(tag)>>2&0x7
+			offset = int(uint32(tag)&0xe0<<3 | uint32(src[s+1]))
+			s += 2
+		case tagCopy2:
+			length = 1 + int(tag)>>2
+			offset = int(uint32(src[s+1]) | uint32(src[s+2])<<8)
+			s += 3
+		case tagCopy4:
+			length = 1 + int(tag)>>2
+			offset = int(uint32(src[s+1]) | uint32(src[s+2])<<8 | uint32(src[s+3])<<16 | uint32(src[s+4])<<24)
+			s += 5
+			f.Copy4Tags++
+		}
+		f.Copies++
+		if offset > f.MaxOffset {
+			f.MaxOffset = offset
+		}
+		if length > offset {
+			f.OverlappingCopies++
+		}
+	}
+	return out, features, nil
+}
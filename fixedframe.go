@@ -0,0 +1,133 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrFrameTooLarge is returned by FixedFrameWriter.WriteFrame when a record
+// does not fit in a frame.
+var ErrFrameTooLarge = errors.New("snappy: record does not fit in frame")
+
+var errInvalidFrameSize = errors.New("snappy: invalid frame size")
+
+const (
+	// frameHeaderLen is the length of a frame's stream identifier, data chunk
+	// header and checksum, which come before the record's bytes.
+	frameHeaderLen = len(magicChunk) + chunkHeaderSize + checksumSize
+
+	// minFrameSize and maxFrameSize bound the frame size of a
+	// FixedFrameWriter. The smallest frame holds an empty record, whose
+	// compressed form is a single byte, and the largest is as long as a
+	// padding chunk can make it.
+	minFrameSize = frameHeaderLen + 1
+	maxFrameSize = 1 << 24
+)
+
+// A FixedFrameWriter writes records as frames of the framing format that are
+// all exactly the same size, so that record n starts at byte n*frameSize of
+// the output, for record stores that want to seek to a record without an
+// index.
+//
+// Each frame starts with a stream identifier, making it a complete stream on
+// its own, which holds the record as a single data chunk, followed by a
+// padding chunk that fills the rest of the frame. So a whole sequence of
+// frames is also a valid stream, of the records' concatenation, and record n
+// can be read with:
+//
+//	NewReader(io.NewSectionReader(f, n*frameSize, frameSize))
+type FixedFrameWriter struct {
+	w         io.Writer
+	frameSize int
+	err       error
+
+	// buf holds the frame being written. It is long enough to hold the
+	// record before finding out whether it fits.
+	buf []byte
+}
+
+// NewFixedFrameWriter returns a new FixedFrameWriter that writes frames of
+// frameSize bytes to w. The frame size must be in the range [19, 1<<24].
+// Otherwise, every call to WriteFrame returns an error.
+func NewFixedFrameWriter(w io.Writer, frameSize int) *FixedFrameWriter {
+	f := &FixedFrameWriter{
+		w:         w,
+		frameSize: frameSize,
+	}
+	if frameSize < minFrameSize || frameSize > maxFrameSize {
+		f.err = errInvalidFrameSize
+		return f
+	}
+	n := frameHeaderLen + maxEncodedLenOfMaxBlockSize
+	if n < frameSize {
+		n = frameSize
+	}
+	f.buf = make([]byte, n)
+	return f
+}
+
+// WriteFrame writes p, which must be no longer than 64 KiB, as the next
+// frame. The record is compressed if that makes it shorter, and stored
+// otherwise.
+//
+// If the record does not fit in a frame, WriteFrame returns ErrFrameTooLarge
+// and writes nothing, and the FixedFrameWriter can still be used. A record
+// fits if the frame needs no padding or at least 4 bytes of it, the size of an
+// empty padding chunk, so a record may not fit when it would leave 1 to 3
+// bytes of the frame unused. Any error from the underlying io.Writer is
+// returned by this and every later call.
+func (f *FixedFrameWriter) WriteFrame(p []byte) error {
+	if f.err != nil {
+		return f.err
+	}
+	if len(p) > maxBlockSize {
+		return ErrFrameTooLarge
+	}
+	chunkType := uint8(chunkTypeCompressedData)
+	n := len(Encode(f.buf[frameHeaderLen:], p))
+	if n >= len(p) || !f.fits(n) {
+		// Store the record instead, if that fits. Stored, it is never
+		// shorter than compressed, but may fit where the compressed form
+		// would leave too little room for padding.
+		if f.fits(len(p)) {
+			chunkType = chunkTypeUncompressedData
+			n = copy(f.buf[frameHeaderLen:], p)
+		} else if !f.fits(n) {
+			return ErrFrameTooLarge
+		}
+	}
+	copy(f.buf, magicChunk)
+	putChunkHeader(f.buf[len(magicChunk):], chunkType, checksumSize+n)
+	binary.LittleEndian.PutUint32(f.buf[len(magicChunk)+chunkHeaderSize:], crc(p))
+	if pad := f.buf[frameHeaderLen+n : f.frameSize]; len(pad) > 0 {
+		putChunkHeader(pad, chunkTypePadding, len(pad)-chunkHeaderSize)
+		pad = pad[chunkHeaderSize:]
+		for i := range pad {
+			pad[i] = 0
+		}
+	}
+	if _, err := f.w.Write(f.buf[:f.frameSize]); err != nil {
+		f.err = err
+	}
+	return f.err
+}
+
+// fits returns whether a record whose chunk holds n bytes after its checksum
+// fits in a frame.
+func (f *FixedFrameWriter) fits(n int) bool {
+	pad := f.frameSize - frameHeaderLen - n
+	return pad == 0 || pad >= chunkHeaderSize
+}
+
+// putChunkHeader writes the header of a chunk with a body of n bytes to b.
+func putChunkHeader(b []byte, chunkType uint8, n int) {
+	b[0] = chunkType
+	b[1] = uint8(n >> 0)
+	b[2] = uint8(n >> 8)
+	b[3] = uint8(n >> 16)
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package snappy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// The fuzz targets here are run on their seed corpora by "go test", and can be
+// run continuously with, for example:
+//
+//	go test -run=NONE -fuzz=FuzzDecode
+//	go test -run=NONE -fuzz=FuzzRoundTrip
+
+// maxFuzzDecodedLen is the largest decoded length that the fuzz targets will
+// allocate for, so that fuzzing explores the decoder, not the allocator.
+const maxFuzzDecodedLen = 1 << 20
+
+// addFuzzSeeds adds a variety of valid and invalid blocks to f's corpus.
+func addFuzzSeeds(f *testing.F) {
+	tDir := filepath.FromSlash(*testdataDir)
+	if golden, err := ioutil.ReadFile(filepath.Join(tDir, goldenCompressed)); err == nil {
+		f.Add(golden[:1000])
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x00})
+	f.Add([]byte("\x03\x08\xff\xff\xff"))
+	f.Add([]byte("\x0f\x0cabcd\x11\x04\x08xyz"))
+	f.Add([]byte("\x0f\x0cabcd\x11\x05\x08xyz"))
+	f.Add([]byte("\x40\x12\x00\x00"))
+	f.Add([]byte("\x05\xf4\xff\xff\xff\xff"))
+	f.Add(Encode(nil, []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")))
+}
+
+// FuzzDecode checks that Decode never panics, and that whenever it succeeds,
+// its output has the length that the block's header claims.
+func FuzzDecode(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		n, err := DecodedLen(src)
+		if err != nil || n > maxFuzzDecodedLen {
+			return
+		}
+		got, err := Decode(nil, src)
+		if err != nil {
+			return
+		}
+		if len(got) != n {
+			t.Fatalf("decoded %d bytes, but DecodedLen is %d", len(got), n)
+		}
+		// A too-small dst must not matter.
+		got2, err := Decode(make([]byte, n/2), src)
+		if err != nil {
+			t.Fatalf("Decode with a short dst: %v", err)
+		}
+		if err := cmp(got2, got); err != nil {
+			t.Fatalf("Decode with a short dst: %v", err)
+		}
+	})
+}
+
+// FuzzRoundTrip checks that every way of encoding src decodes back to src, and
+// that the pure Go Encoder agrees with Encode.
+func FuzzRoundTrip(f *testing.F) {
+	tDir := filepath.FromSlash(*testdataDir)
+	if text, err := ioutil.ReadFile(filepath.Join(tDir, goldenText)); err == nil {
+		f.Add(text[:2000])
+	}
+	f.Add([]byte{})
+	f.Add([]byte("a"))
+	f.Add([]byte("abcabcabcabcabcabcabcabcabcabc"))
+	f.Add(make([]byte, 1000))
+	f.Fuzz(func(t *testing.T, src []byte) {
+		encoded := Encode(nil, src)
+		got, err := Decode(nil, encoded)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if err := cmp(got, src); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if err := cmp(NewEncoder().Encode(nil, src), encoded); err != nil {
+			t.Fatalf("Encoder differs from Encode: %v", err)
+		}
+
+		for _, opt := range []EncoderOption{DenseMatching(), RunMatching()} {
+			got, err = Decode(nil, NewEncoder(opt).Encode(nil, src))
+			if err != nil {
+				t.Fatalf("Decode of Encoder output: %v", err)
+			}
+			if err := cmp(got, src); err != nil {
+				t.Fatalf("Decode of Encoder output: %v", err)
+			}
+		}
+
+		got, err = DecodeFramed(EncodeFramed(src))
+		if err != nil {
+			t.Fatalf("DecodeFramed: %v", err)
+		}
+		if err := cmp(got, src); err != nil {
+			t.Fatalf("DecodeFramed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// streamLengthLen is the length of the body of a stream length chunk.
+const streamLengthLen = 8
+
+var errLengthNotSeekable = errors.New("snappy: cannot seek to record the stream length")
+
+// NewLengthPrefixedWriter is like NewBufferedWriter, but the stream that the
+// Writer returned writes starts with a record of the total length of its
+// uncompressed data. As that is not known until the end, the Writer writes a
+// placeholder, and its Close method seeks back to fill it in, and then seeks
+// back to the end of the stream. A Reader reports the length from its
+// StreamLength method, so that the data's destination can be sized up front.
+//
+// The record is a chunk of a reserved skippable type, just after the stream
+// identifier, so the stream remains readable by any decoder of the framing
+// format.
+//
+// If ws cannot seek, such as when it is a pipe, the Writer fails, with every
+// call to Write, Flush or Close returning an error that says so. Reset must be
+// passed an io.WriteSeeker too.
+func NewLengthPrefixedWriter(ws io.WriteSeeker, opts ...WriterOption) *Writer {
+	x := NewBufferedWriter(ws, opts...)
+	x.startLengthPrefix(ws)
+	return x
+}
+
+// startLengthPrefix makes the Writer start its stream with a stream length
+// chunk, written by writeLengthPlaceholder, checking up front that ws can
+// seek.
+func (w *Writer) startLengthPrefix(ws io.WriteSeeker) {
+	w.lengthSeeker = ws
+	if w.err != nil {
+		return
+	}
+	if _, err := ws.Seek(0, io.SeekCurrent); err != nil {
+		w.err = errLengthNotSeekable
+	}
+}
+
+// writeLengthPlaceholder writes a stream length chunk with a zero length, and
+// remembers where its body is, for patchLength to fill in.
+func (w *Writer) writeLengthPlaceholder() {
+	pos, err := w.lengthSeeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		w.err = errLengthNotSeekable
+		return
+	}
+	w.lengthPos = pos + chunkHeaderSize
+	var body [streamLengthLen]byte
+	w.writeChunk(chunkTypeStreamLength, body[:])
+}
+
+// patchLength fills in the stream length chunk written by
+// writeLengthPlaceholder, leaving the underlying io.WriteSeeker positioned at
+// the end of the stream.
+func (w *Writer) patchLength() error {
+	ws := w.lengthSeeker
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = ws.Seek(w.lengthPos, io.SeekStart)
+	}
+	if err != nil {
+		w.err = errLengthNotSeekable
+		return w.err
+	}
+	var body [streamLengthLen]byte
+	binary.LittleEndian.PutUint64(body[:], uint64(w.written))
+	if _, err := ws.Write(body[:]); err != nil {
+		w.err = err
+		return err
+	}
+	if _, err := ws.Seek(end, io.SeekStart); err != nil {
+		w.err = errLengthNotSeekable
+		return w.err
+	}
+	return nil
+}
+
+// StreamLength returns the total length of the stream's uncompressed data,
+// as recorded at its start by a Writer from NewLengthPrefixedWriter, and true.
+// It returns false if the stream has no such record.
+//
+// If nothing has been read from the Reader yet, StreamLength reads up to and
+// including the first data chunk to look for the record, keeping the decoded
+// data for subsequent Reads. Any error in doing so is returned by the next
+// Read.
+func (r *Reader) StreamLength() (n int64, ok bool) {
+	if r.j == 0 && r.err == nil {
+		r.fill()
+	}
+	return r.streamLen, r.hasStreamLen
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+// encodeTableSize is the size of the hash table that Encode uses while
+// compressing a block, which is allocated on the stack of the calling
+// goroutine rather than kept by a Writer.
+const encodeTableSize = 2 * maxTableSize
+
+// WriterMemoryFootprint returns the approximate number of bytes of memory
+// that a Writer returned by NewBufferedWriter with the given options uses, for
+// sizing pools of Writers against a memory budget. Invalid options are treated
+// as NewBufferedWriter treats them, by falling back to the defaults.
+//
+// The total comprises the input and output buffers, which are allocated by
+// NewBufferedWriter, the buffers that the VerifyRoundTrip and BlockDeadline
+// options allocate on first use, and the hash table used while compressing a
+// block, which is only live during a Write, Flush or Close. It excludes the
+// Writer struct itself and the small, constant overheads of other options.
+// With the default options, it is about 170 KiB.
+func WriterMemoryFootprint(opts ...WriterOption) int {
+	x := configureWriter(nil, opts)
+	n := x.blockSize + x.obufSize + encodeTableSize
+	if x.verify {
+		n += x.blockSize
+	}
+	if x.deadline > 0 {
+		n += x.blockSize + MaxEncodedLen(x.blockSize)
+	}
+	return n
+}
+
+// ReaderMemoryFootprint returns the approximate number of bytes of memory
+// that a Reader returned by NewReader uses: its buffers for a decoded block
+// and for a chunk's compressed body, of about 64 KiB and 75 KiB. The first is
+// only allocated when the Reader decodes its first block, and never if it
+// has a buffer pool set by SetBufferPool by then, which leaves only the
+// second. The Reader's other settings do not change it.
+func ReaderMemoryFootprint() int {
+	return maxBlockSize + maxEncodedLenOfMaxBlockSize + checksumSize
+}
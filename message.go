@@ -0,0 +1,158 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ErrMessageChecksum is returned by Reader.ReadMessage when a message's data
+// does not match the checksum that was written with it.
+var ErrMessageChecksum = errors.New("snappy: message checksum mismatch")
+
+// A MessageWriter writes a sequence of discrete messages as a single stream in
+// the framing format. Each message is flushed to the underlying io.Writer as
+// soon as it is written, and is followed by a skippable chunk that marks the
+// end of the message, so that a Reader's ReadMessage method can recover the
+// messages exactly.
+//
+// Readers that are not looking for messages, including those of other snappy
+// implementations, see the concatenation of all of the messages.
+type MessageWriter struct {
+	w *Writer
+
+	// sum, if non-nil, computes the checksum that each end-of-message marker
+	// records.
+	sum func([]byte) uint32
+}
+
+// NewMessageWriter returns a new MessageWriter that writes to w.
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	return &MessageWriter{
+		w: NewBufferedWriter(w),
+	}
+}
+
+// NewMessageWriterWithChecksum is like NewMessageWriter, but each
+// end-of-message marker also records a checksum of the message, computed by
+// sum, or the CRC-32C if sum is nil. ReadMessage verifies it. This gives each
+// message a check of its own, such as an application-specific one for the
+// records of a database's write-ahead log, in addition to the framing
+// format's checksum of each block.
+func NewMessageWriterWithChecksum(w io.Writer, sum func([]byte) uint32) *MessageWriter {
+	if sum == nil {
+		sum = crc32c
+	}
+	return &MessageWriter{
+		w:   NewBufferedWriter(w),
+		sum: sum,
+	}
+}
+
+// WriteMessage compresses p, splitting it into multiple chunks if necessary,
+// and writes it to the underlying io.Writer followed by an end-of-message
+// marker. Empty messages are allowed.
+func (m *MessageWriter) WriteMessage(p []byte) error {
+	if m.sum != nil {
+		return m.WriteMessageSum(p, m.sum(p))
+	}
+	return m.writeMessage(p, nil)
+}
+
+// WriteMessageSum is like WriteMessage, but the end-of-message marker records
+// the given checksum of p, for applications that already have one, whether or
+// not the MessageWriter computes checksums itself.
+func (m *MessageWriter) WriteMessageSum(p []byte, sum uint32) error {
+	var b [checksumSize]byte
+	binary.LittleEndian.PutUint32(b[:], sum)
+	return m.writeMessage(p, b[:])
+}
+
+// writeMessage writes p followed by an end-of-message marker, which records
+// the checksum sum, if non-nil.
+func (m *MessageWriter) writeMessage(p, sum []byte) error {
+	if _, err := m.w.Write(p); err != nil {
+		return err
+	}
+	if err := m.w.Flush(); err != nil {
+		return err
+	}
+	var buf [binary.MaxVarintLen64 + checksumSize]byte
+	n := binary.PutUvarint(buf[:], uint64(len(p)))
+	n += copy(buf[n:], sum)
+	return m.w.writeChunk(chunkTypeMessageEnd, buf[:n])
+}
+
+// Close closes the MessageWriter. It does not close the underlying io.Writer.
+func (m *MessageWriter) Close() error {
+	return m.w.Close()
+}
+
+// ReadMessage reads the next message written by a MessageWriter, decoding data
+// chunks until it reaches the next end-of-message marker. Any bytes that were
+// decoded but not yet returned by Read are treated as the start of the message.
+//
+// If the marker records a checksum, ReadMessage verifies the message against
+// it, using the function set by SetMessageChecksum, and returns
+// ErrMessageChecksum if they do not match. The stream itself is then intact,
+// so the next call reads the message after it.
+//
+// It returns io.EOF if the stream ends cleanly, between two messages, and
+// io.ErrUnexpectedEOF if the stream ends in the middle of a message.
+func (r *Reader) ReadMessage() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	msg := append([]byte{}, r.decoded[r.i:r.j]...)
+	partial := r.i < r.j
+	r.i, r.j = 0, 0
+	r.canUnread = false
+	for {
+		n, ok := r.nextBlock()
+		if !ok {
+			if r.err == io.EOF && partial {
+				r.err = io.ErrUnexpectedEOF
+			}
+			return nil, r.err
+		}
+		if r.messageEnd {
+			if r.messageLen != int64(len(msg)) {
+				r.err = ErrCorrupt
+				return nil, r.err
+			}
+			if r.hasMessageSum {
+				sum := r.messageSumFunc
+				if sum == nil {
+					sum = crc32c
+				}
+				if sum(msg) != r.messageSum {
+					return nil, ErrMessageChecksum
+				}
+			}
+			return msg, nil
+		}
+		msg = append(msg, r.decoded[:n]...)
+		partial = true
+	}
+}
+
+// SetMessageChecksum sets the function with which ReadMessage verifies the
+// checksums recorded by a MessageWriter from NewMessageWriterWithChecksum. It
+// must be the function that the messages were written with. The default, or
+// nil, is the CRC-32C, as for such a MessageWriter.
+//
+// The setting survives Reset.
+func (r *Reader) SetMessageChecksum(sum func([]byte) uint32) {
+	r.messageSumFunc = sum
+}
+
+// crc32c returns the CRC-32C of p, the default checksum of a MessageWriter
+// from NewMessageWriterWithChecksum.
+func crc32c(p []byte) uint32 {
+	return crc32.Checksum(p, crcTable)
+}
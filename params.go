@@ -0,0 +1,167 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WriterVersion identifies the version of this package's Writer, as recorded
+// by the ParameterHeader option. It is incremented when the Writer's output
+// changes in a way that a reader might need to know about.
+const WriterVersion = 1
+
+// maxParamsLen is the most bytes that the body of a parameter header may take.
+const maxParamsLen = 1 << 16
+
+// These are the keys of the parameters that a Writer records about itself.
+// The "snappy." prefix is reserved for them.
+const (
+	paramsPrefix    = "snappy."
+	paramsVersion   = paramsPrefix + "version"
+	paramsBlockSize = paramsPrefix + "block-size"
+)
+
+var errInvalidParams = errors.New("snappy: invalid parameter header")
+
+// StreamParams describes how a stream was written, as recorded by a Writer
+// with the ParameterHeader option.
+type StreamParams struct {
+	// Version is the WriterVersion of the Writer that wrote the stream.
+	Version int
+
+	// BlockSize is the Writer's setting of the BlockSize option.
+	BlockSize int
+
+	// Extra holds the application's own parameters, as passed to
+	// ParameterHeader.
+	Extra map[string]string
+}
+
+// ParameterHeader makes the Writer start each stream with a record of how it
+// was written: the version of this package's Writer, its block size, and the
+// application's own parameters, extra, if any, which may be nil. A Reader
+// returns them from its StreamParams method, so that future readers of
+// archived streams can find out how they were produced.
+//
+// The record is a chunk of a reserved skippable type, just after the stream
+// identifier, so the stream remains readable by any decoder of the framing
+// format. It is written with the stream identifier, when the Writer first
+// writes to the underlying io.Writer after it is created or Reset. The keys
+// of extra must not start with "snappy.", and they and the values must take
+// less than 64 KiB in all.
+func ParameterHeader(extra map[string]string) WriterOption {
+	return func(w *Writer) error {
+		size := 0
+		for k, v := range extra {
+			if strings.HasPrefix(k, paramsPrefix) {
+				return errInvalidParams
+			}
+			size += 2*binary.MaxVarintLen32 + len(k) + len(v)
+		}
+		if size >= maxParamsLen {
+			return errInvalidParams
+		}
+		w.params = extra
+		w.paramHeader = true
+		return nil
+	}
+}
+
+// writeParams writes the parameter header chunk, after the stream identifier.
+func (w *Writer) writeParams() {
+	if w.err != nil {
+		return
+	}
+	params := map[string]string{
+		paramsVersion:   strconv.Itoa(WriterVersion),
+		paramsBlockSize: strconv.Itoa(w.blockSize),
+	}
+	for k, v := range w.params {
+		params[k] = v
+	}
+	// Sort the keys, so that the output does not depend on the order of
+	// iteration over the map.
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var body []byte
+	for _, k := range keys {
+		body = appendParamsString(body, k)
+		body = appendParamsString(body, params[k])
+	}
+	w.writeChunk(chunkTypeParams, body)
+}
+
+// appendParamsString appends s to b, preceded by its length as a uvarint.
+func appendParamsString(b []byte, s string) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(s)))]...)
+	return append(b, s...)
+}
+
+// parseParams parses the body of a parameter header chunk, which is a
+// sequence of keys and values, each preceded by its length as a uvarint. Keys
+// that it does not know with the "snappy." prefix are ignored, so that later
+// versions can add more.
+func parseParams(body []byte) (p StreamParams, ok bool) {
+	next := func() (string, bool) {
+		n, k := binary.Uvarint(body)
+		if k <= 0 || n > uint64(len(body)-k) {
+			return "", false
+		}
+		s := string(body[k : k+int(n)])
+		body = body[k+int(n):]
+		return s, true
+	}
+	for len(body) > 0 {
+		key, ok1 := next()
+		value, ok2 := next()
+		if !ok1 || !ok2 {
+			return StreamParams{}, false
+		}
+		if !strings.HasPrefix(key, paramsPrefix) {
+			if p.Extra == nil {
+				p.Extra = map[string]string{}
+			}
+			p.Extra[key] = value
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		switch key {
+		case paramsVersion:
+			p.Version = n
+		case paramsBlockSize:
+			p.BlockSize = n
+		default:
+			continue
+		}
+		if err != nil {
+			return StreamParams{}, false
+		}
+	}
+	return p, true
+}
+
+// StreamParams returns the parameters recorded at the start of the stream by
+// a Writer with the ParameterHeader option, and true. It returns false if the
+// stream has no such record, or if it is malformed.
+//
+// If nothing has been read from the Reader yet, StreamParams reads up to and
+// including the first data chunk to look for the record, keeping the decoded
+// data for subsequent Reads. Any error in doing so is returned by the next
+// Read.
+func (r *Reader) StreamParams() (StreamParams, bool) {
+	if r.j == 0 && r.err == nil {
+		r.fill()
+	}
+	return r.params, r.hasParams
+}
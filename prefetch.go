@@ -0,0 +1,135 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var errPrefetchClosed = errors.New("snappy: PrefetchReader is closed")
+
+// A PrefetchReader is like a Reader, but reads and decodes ahead on a
+// background goroutine, so that reading from the underlying io.Reader and
+// decoding overlap with the caller's processing of the data already returned.
+// This helps when both are slow, such as when decoding from the network to a
+// consumer that does substantial work per block.
+//
+// A PrefetchReader is not safe for concurrent use by multiple goroutines, but
+// it may be closed from another goroutine than the one reading from it.
+type PrefetchReader struct {
+	blocks chan prefetchBlock
+	free   chan []byte
+	done   chan struct{}
+	once   sync.Once
+
+	// cur is the block being returned by Read, of which cur.buf[i:] has not
+	// yet been returned.
+	cur prefetchBlock
+	i   int
+	err error
+}
+
+// prefetchBlock is a decoded block, or the error that ended the stream.
+type prefetchBlock struct {
+	buf []byte
+	err error
+}
+
+// NewPrefetchReader returns a new PrefetchReader that decompresses from r,
+// keeping up to depth decoded blocks (of up to 64 KiB each) ready ahead of
+// the caller. A depth of less than 1 is treated as 1.
+//
+// The background goroutine starts reading from r straight away. Users must
+// call Close to stop it if they stop reading before the end of the stream.
+func NewPrefetchReader(r io.Reader, depth int) *PrefetchReader {
+	if depth < 1 {
+		depth = 1
+	}
+	p := &PrefetchReader{
+		blocks: make(chan prefetchBlock, depth),
+		// Besides those in blocks, one buffer is being decoded into, and one
+		// is being returned by Read.
+		free: make(chan []byte, depth+2),
+		done: make(chan struct{}),
+	}
+	// The Reader decodes into the buffers from p.free, so it needs no
+	// buffer of its own for decoded bytes.
+	x := &Reader{buf: make([]byte, maxEncodedLenOfMaxBlockSize+checksumSize)}
+	x.setSource(r)
+	go p.run(x)
+	return p
+}
+
+// run decodes blocks from r, and sends them to p.blocks, until the end of the
+// stream, an error, or p is closed.
+func (p *PrefetchReader) run(r *Reader) {
+	for {
+		var buf []byte
+		select {
+		case <-p.done:
+			return
+		case buf = <-p.free:
+		default:
+			buf = make([]byte, maxBlockSize)
+		}
+		n, ok := r.decodeBlock(buf)
+		if ok && n == 0 {
+			// An empty chunk, or an end-of-message marker.
+			p.free <- buf
+			continue
+		}
+		b := prefetchBlock{buf: buf[:n]}
+		if !ok {
+			b = prefetchBlock{err: r.err}
+		}
+		select {
+		case p.blocks <- b:
+		case <-p.done:
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// Read satisfies the io.Reader interface.
+func (p *PrefetchReader) Read(b []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, errPrefetchClosed
+	default:
+	}
+	for p.i == len(p.cur.buf) {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if p.cur.buf != nil {
+			p.free <- p.cur.buf[:cap(p.cur.buf)]
+			p.cur.buf = nil
+		}
+		select {
+		case p.cur = <-p.blocks:
+			p.i = 0
+			p.err = p.cur.err
+		case <-p.done:
+			p.err = errPrefetchClosed
+		}
+	}
+	n := copy(b, p.cur.buf[p.i:])
+	p.i += n
+	return n, nil
+}
+
+// Close stops the background goroutine, after which Read returns an error.
+// It does not close the underlying io.Reader. If the goroutine is blocked in a
+// Read of the underlying io.Reader, it exits once that Read returns, without
+// reading any further.
+func (p *PrefetchReader) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
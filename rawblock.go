@@ -0,0 +1,87 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// A RawBlockWriter compresses a stream of bytes into a sequence of blocks, as
+// returned by Encode, each preceded by its length as a uvarint, without the
+// framing format's stream identifier, chunk headers and checksums. It is for
+// containers that provide their own framing and integrity checks, such as the
+// files of a storage engine, for which it has the least overhead.
+//
+// Each block holds up to 64 KiB of uncompressed data.
+type RawBlockWriter struct {
+	w   io.Writer
+	err error
+
+	// ibuf is a buffer for the incoming (uncompressed) bytes, and obuf for
+	// the length prefix and block that are written for it.
+	ibuf []byte
+	obuf []byte
+}
+
+// NewRawBlockWriter returns a new RawBlockWriter that compresses to w. Users
+// must call Close to guarantee all data has been forwarded to w.
+func NewRawBlockWriter(w io.Writer) *RawBlockWriter {
+	return &RawBlockWriter{
+		w:    w,
+		ibuf: make([]byte, 0, maxBlockSize),
+		obuf: make([]byte, binary.MaxVarintLen32+maxEncodedLenOfMaxBlockSize),
+	}
+}
+
+// Write satisfies the io.Writer interface. Only whole blocks of 64 KiB are
+// written to the underlying io.Writer, the rest being buffered until the next
+// Write, Flush or Close.
+func (b *RawBlockWriter) Write(p []byte) (nRet int, errRet error) {
+	for len(p) > 0 {
+		if b.err != nil {
+			return nRet, b.err
+		}
+		n := copy(b.ibuf[len(b.ibuf):cap(b.ibuf)], p)
+		b.ibuf = b.ibuf[:len(b.ibuf)+n]
+		nRet += n
+		p = p[n:]
+		if len(b.ibuf) == cap(b.ibuf) {
+			b.Flush()
+		}
+	}
+	return nRet, b.err
+}
+
+// Flush writes any buffered data to the underlying io.Writer, as a block that
+// may be shorter than 64 KiB.
+func (b *RawBlockWriter) Flush() error {
+	if b.err != nil || len(b.ibuf) == 0 {
+		return b.err
+	}
+	// Encode the block after room for its length, and then write the length
+	// just before it, so that both go out in a single Write.
+	block := Encode(b.obuf[binary.MaxVarintLen32:], b.ibuf)
+	var prefix [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(block)))
+	start := binary.MaxVarintLen32 - n
+	copy(b.obuf[start:], prefix[:n])
+	b.ibuf = b.ibuf[:0]
+	if _, err := b.w.Write(b.obuf[start : binary.MaxVarintLen32+len(block)]); err != nil {
+		b.err = err
+	}
+	return b.err
+}
+
+// Close calls Flush and then closes the RawBlockWriter. It does not close the
+// underlying io.Writer.
+func (b *RawBlockWriter) Close() error {
+	b.Flush()
+	ret := b.err
+	if b.err == nil {
+		b.err = errClosed
+	}
+	return ret
+}
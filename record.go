@@ -0,0 +1,154 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// recordStartLen is the length of the body of a record start chunk.
+const recordStartLen = 8 + 8 + checksumSize
+
+// WriteRecord writes p as a record with the given ID: it flushes any buffered
+// data, writes a skippable chunk that marks the start of the record, and then
+// writes and flushes p. ScanRecords can then find the record again, even if
+// the stream is damaged before or after it, such as in a write-ahead log that
+// was cut short by a crash.
+//
+// Readers that are not looking for records, including those of other snappy
+// implementations, see the concatenation of all of the data written.
+func (w *Writer) WriteRecord(id uint64, p []byte) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var body [recordStartLen]byte
+	binary.LittleEndian.PutUint64(body[0:], id)
+	binary.LittleEndian.PutUint64(body[8:], uint64(len(p)))
+	binary.LittleEndian.PutUint32(body[16:], crc(body[:16]))
+	if err := w.writeChunk(chunkTypeRecordStart, body[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(p); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ScanRecords reads a stream written with Writer.WriteRecord from r, and calls
+// fn with the ID and contents of each complete and intact record, in order.
+// The data is only valid for the duration of the call.
+//
+// Damage to the stream does not stop the scan. A record with any corrupt,
+// missing or extra data is skipped, and so are any data chunks that are not
+// part of a record. After damage, ScanRecords searches byte by byte for the
+// next valid record start chunk, whose contents are checksummed, and resumes
+// from there. A truncated record at the end of the stream is skipped.
+//
+// ScanRecords returns nil at the end of r, or else the first error from
+// reading r or returned by fn.
+func ScanRecords(r io.Reader, fn func(id uint64, data []byte) error) error {
+	br := bufio.NewReaderSize(r, chunkHeaderSize+maxEncodedLenOfMaxBlockSize+checksumSize)
+	decoded := make([]byte, maxBlockSize)
+	var (
+		// inRecord is whether data holds the start of the record with the
+		// given ID and length.
+		inRecord bool
+		id       uint64
+		length   uint64
+		data     []byte
+
+		// resync is whether the scan is looking for a record start after
+		// damage to the stream.
+		resync bool
+	)
+	for {
+		header, err := br.Peek(chunkHeaderSize)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		chunkType := header[0]
+		chunkLen := int(header[1]) | int(header[2])<<8 | int(header[3])<<16
+
+		ok := !resync || chunkType == chunkTypeRecordStart
+		var chunk []byte
+		if ok {
+			chunk, err = br.Peek(chunkHeaderSize + chunkLen)
+			if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+				return err
+			}
+			ok = err == nil
+		}
+		if ok {
+			body := chunk[chunkHeaderSize:]
+			switch chunkType {
+			case chunkTypeRecordStart:
+				ok = chunkLen == recordStartLen && crc(body[:16]) == binary.LittleEndian.Uint32(body[16:])
+				if ok {
+					inRecord, resync = true, false
+					id = binary.LittleEndian.Uint64(body[0:])
+					length = binary.LittleEndian.Uint64(body[8:])
+					data = data[:0]
+				}
+
+			case chunkTypeCompressedData, chunkTypeUncompressedData:
+				var block []byte
+				block, ok = decodeDataChunk(decoded, chunkType, body)
+				if ok && inRecord {
+					data = append(data, block...)
+					ok = uint64(len(data)) <= length
+				}
+
+			case chunkTypeStreamIdentifier:
+				ok = string(body) == magicBody
+
+			default:
+				// Reserved unskippable chunks (chunk types 0x02-0x7f) are
+				// treated as damage. Others are skipped.
+				ok = chunkType > 0x7f
+			}
+		}
+
+		if !ok {
+			inRecord, resync = false, true
+			br.Discard(1)
+			continue
+		}
+		br.Discard(chunkHeaderSize + chunkLen)
+		if inRecord && uint64(len(data)) == length {
+			inRecord = false
+			if err := fn(id, data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decodeDataChunk returns the decoded contents of a compressed or uncompressed
+// data chunk with the given body, using dst if it needs to decode them, and
+// whether the chunk is valid.
+func decodeDataChunk(dst []byte, chunkType byte, body []byte) ([]byte, bool) {
+	if len(body) < checksumSize {
+		return nil, false
+	}
+	checksum := uint32(body[0]) | uint32(body[1])<<8 | uint32(body[2])<<16 | uint32(body[3])<<24
+	body = body[checksumSize:]
+	if chunkType == chunkTypeCompressedData {
+		if n, err := DecodedLen(body); err != nil || n > maxBlockSize {
+			return nil, false
+		}
+		var err error
+		if body, err = Decode(dst, body); err != nil {
+			return nil, false
+		}
+	} else if len(body) > maxBlockSize {
+		return nil, false
+	}
+	return body, crc(body) == checksum
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"sort"
+)
+
+// segmentArenaSize is the size of the chunks of memory that DecodeSegments
+// allocates for the copies that it cannot emit as sub-slices.
+const segmentArenaSize = 4096
+
+// A segment is a piece of the decoded output of DecodeSegments, starting at
+// offset start.
+type segment struct {
+	start int
+	p     []byte
+}
+
+// DecodeSegments decodes the block src, but instead of assembling the decoded
+// bytes in one buffer, it passes them to emit in order, one segment for each
+// literal or copy tag. Concatenated, the segments are what Decode would
+// return. If emit returns an error, DecodeSegments stops and returns it.
+//
+// The segments avoid copying where they can:
+//
+//   - A literal's segment is a sub-slice of src.
+//   - A copy's segment is, when it can be, a sub-slice of an earlier segment,
+//     namely when the bytes copied lie within that segment. Otherwise, such as
+//     for a copy that overlaps its own output, the bytes are copied into memory
+//     that DecodeSegments allocates.
+//
+// So segments may alias src and each other. A segment must not be modified,
+// by emit or by anything else, as that would corrupt the segments that follow
+// it, nor may src be modified during the call. Segments are never overwritten
+// by DecodeSegments, so they remain valid after the call, for as long as src
+// is not modified, and they may be retained without being copied.
+//
+// If src is not a valid block, DecodeSegments returns ErrCorrupt, or the
+// error that Decode would return, but it may have emitted the segments that
+// precede the problem by then.
+func DecodeSegments(src []byte, emit func(p []byte) error) error {
+	dLen, s, err := decodedLen(src)
+	if err != nil {
+		return err
+	}
+	var (
+		segs  []segment
+		arena []byte
+		d     int
+	)
+	for s < len(src) {
+		var p []byte
+		tag := src[s]
+		switch tag & 0x03 {
+		case tagLiteral:
+			x := uint32(tag >> 2)
+			n := 0
+			if x >= 60 {
+				// The length is in the next 1-4 bytes, little-endian.
+				n = int(x) - 59
+				if len(src)-s-1 < n {
+					return ErrCorrupt
+				}
+				x = 0
+				for i := n; i > 0; i-- {
+					x = x<<8 | uint32(src[s+i])
+				}
+			}
+			length := int(x) + 1
+			if length <= 0 {
+				return errUnsupportedLiteralLength
+			}
+			s += 1 + n
+			if length > len(src)-s || length > dLen-d {
+				return ErrCorrupt
+			}
+			p = src[s : s+length : s+length]
+			s += length
+
+		default:
+			var length, offset int
+			switch tag & 0x03 {
+			case tagCopy1:
+				if len(src)-s < 2 {
+					return ErrCorrupt
+				}
+				length = 4 + int(tag)>>2&0x7
+				offset = int(uint32(tag)&0xe0<<3 | uint32(src[s+1]))
+				s += 2
+			case tagCopy2:
+				if len(src)-s < 3 {
+					return ErrCorrupt
+				}
+				length = 1 + int(tag)>>2
+				offset = int(uint32(src[s+1]) | uint32(src[s+2])<<8)
+				s += 3
+			case tagCopy4:
+				if len(src)-s < 5 {
+					return ErrCorrupt
+				}
+				length = 1 + int(tag)>>2
+				offset = int(uint32(src[s+1]) | uint32(src[s+2])<<8 | uint32(src[s+3])<<16 | uint32(src[s+4])<<24)
+				s += 5
+			}
+			if offset <= 0 || offset > d || length > dLen-d {
+				return ErrCorrupt
+			}
+			start := d - offset
+			// Find the segment that holds the first byte to copy.
+			i := sort.Search(len(segs), func(i int) bool { return segs[i].start > start }) - 1
+			if seg := segs[i]; offset >= length && start+length <= seg.start+len(seg.p) {
+				p = seg.p[start-seg.start : start-seg.start+length : start-seg.start+length]
+				break
+			}
+
+			if cap(arena)-len(arena) < length {
+				arena = make([]byte, 0, segmentArenaSize)
+			}
+			p = arena[len(arena) : len(arena)+length : len(arena)+length]
+			arena = arena[:len(arena)+length]
+			// Gather the bytes before d from the segments that hold them, and
+			// then, for an overlapping copy, repeat them.
+			k := 0
+			for ; k < length && k < offset; i++ {
+				seg := segs[i]
+				k += copy(p[k:], seg.p[start+k-seg.start:])
+			}
+			for ; k < length; k++ {
+				p[k] = p[k-offset]
+			}
+		}
+
+		segs = append(segs, segment{start: d, p: p})
+		d += len(p)
+		if err := emit(p); err != nil {
+			return err
+		}
+	}
+	if d != dLen {
+		return ErrCorrupt
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// smallMaxLen is the longest input that EncodeSmall encodes itself,
+	// rather than passing it to Encode.
+	smallMaxLen = 1 << 10
+
+	// smallTableBits is the log2 of the size of EncodeSmall's hash table,
+	// which is half as long as the input can be, so that zeroing it costs
+	// little.
+	smallTableBits = 9
+	smallTableSize = 1 << smallTableBits
+)
+
+// EncodeSmall is like Encode, but is faster for inputs of up to 1 KiB, such
+// as the values of a key-value store, for which the pure Go Encode spends much
+// of its time clearing a 32 KiB hash table. Where Encode is implemented in
+// assembly, which only clears as much of the table as the input needs, the
+// two are about as fast. Its output is a standard block, which Decode decodes,
+// but it may differ from Encode's, and be larger or smaller. Longer inputs are
+// passed to Encode.
+//
+// The dst and src must not overlap. It is valid to pass a nil dst.
+func EncodeSmall(dst, src []byte) []byte {
+	if len(src) > smallMaxLen {
+		return Encode(dst, src)
+	}
+	if n := MaxEncodedLen(len(src)); len(dst) < n {
+		dst = make([]byte, n)
+	}
+	d := binary.PutUvarint(dst, uint64(len(src)))
+	if len(src) < minNonLiteralBlockSize {
+		if len(src) > 0 {
+			d += emitLiteral(dst[d:], src)
+		}
+		return dst[:d]
+	}
+	return dst[:d+encodeSmallBlock(dst[d:], src)]
+}
+
+// encodeSmallBlock encodes a non-empty src, of at most smallMaxLen bytes,
+// into dst, and returns the number of bytes written. It is a simpler version
+// of encodeBlock, with a smaller hash table and without the heuristic that
+// skips through incompressible input, which would not pay off in so few
+// bytes.
+//
+// It also assumes that:
+//
+//	len(dst) >= MaxEncodedLen(len(src)) &&
+//	minNonLiteralBlockSize <= len(src) && len(src) <= smallMaxLen
+func encodeSmallBlock(dst, src []byte) (d int) {
+	const shift = 32 - smallTableBits
+	var table [smallTableSize]uint16
+
+	// The encoded form must start with a literal, as there are no previous
+	// bytes to copy, so we start looking for hash matches at s == 1.
+	sLimit := len(src) - inputMargin
+	nextEmit := 0
+	for s := 1; s <= sLimit; {
+		x := load32(src, s)
+		h := hash(x, shift) & (smallTableSize - 1)
+		candidate := int(table[h])
+		table[h] = uint16(s)
+		if x != load32(src, candidate) {
+			s++
+			continue
+		}
+		if nextEmit < s {
+			d += emitLiteral(dst[d:], src[nextEmit:s])
+		}
+		base := s
+		s = extendMatch(src, candidate+4, s+4)
+		d += emitCopy(dst[d:], base-candidate, s-base)
+		nextEmit = s
+		if s <= sLimit {
+			// Hash the position just before the next one, as encodeBlock
+			// does, for better compression.
+			table[hash(load32(src, s-1), shift)&(smallTableSize-1)] = uint16(s - 1)
+		}
+	}
+	if nextEmit < len(src) {
+		d += emitLiteral(dst[d:], src[nextEmit:])
+	}
+	return d
+}
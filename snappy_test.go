@@ -5,20 +5,29 @@
 package snappy
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 var (
@@ -92,6 +101,47 @@ func TestEmpty(t *testing.T) {
 	}
 }
 
+func TestEmptyInput(t *testing.T) {
+	encoded := Encode(nil, nil)
+	if got, want := string(encoded), "\x00"; got != want {
+		t.Fatalf("Encode: got %q, want %q", got, want)
+	}
+	for _, dst := range [][]byte{nil, make([]byte, 0), make([]byte, 10)} {
+		decoded, err := Decode(dst, encoded)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if decoded == nil || len(decoded) != 0 {
+			t.Fatalf("Decode: got %#v, want an empty, non-nil slice", decoded)
+		}
+	}
+
+	for _, buffered := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		var w *Writer
+		if buffered {
+			w = NewBufferedWriter(buf)
+		} else {
+			w = NewWriter(buf)
+		}
+		if _, err := w.Write(nil); err != nil {
+			t.Fatalf("buffered=%t: Write: %v", buffered, err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("buffered=%t: Flush: %v", buffered, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("buffered=%t: Close: %v", buffered, err)
+		}
+		if got, want := buf.String(), magicChunk; got != want {
+			t.Fatalf("buffered=%t: got %q, want %q", buffered, got, want)
+		}
+		if n, err := NewReader(buf).Read(make([]byte, 10)); n != 0 || err != io.EOF {
+			t.Fatalf("buffered=%t: Read: got (%d, %v), want (0, io.EOF)", buffered, n, err)
+		}
+	}
+}
+
 func TestSmallCopy(t *testing.T) {
 	for _, ebuf := range [][]byte{nil, make([]byte, 20), make([]byte, 64)} {
 		for _, dbuf := range [][]byte{nil, make([]byte, 20), make([]byte, 64)} {
@@ -159,6 +209,157 @@ func TestInvalidVarint(t *testing.T) {
 	}
 }
 
+func TestValidateBlockHeader(t *testing.T) {
+	encodeVarint := func(v uint64) []byte {
+		var buf [binary.MaxVarintLen64]byte
+		return append([]byte(nil), buf[:binary.PutUvarint(buf[:], v)]...)
+	}
+	// Valid blocks always pass, including those that expand the most: a
+	// one-byte literal followed by 64-byte copies, each encoded in 3 bytes.
+	densest := []byte{tagLiteral, 'x'}
+	for i := 0; i < 1000; i++ {
+		densest = append(densest, tagCopy2|63<<2, 1, 0)
+	}
+	densest = append(encodeVarint(1+64*1000), densest...)
+	valid := [][]byte{
+		Encode(nil, nil),
+		Encode(nil, []byte("a")),
+		Encode(nil, make([]byte, maxBlockSize)),
+		Encode(nil, bytes.Repeat([]byte("ab"), 100000)),
+		densest,
+	}
+	for i, src := range valid {
+		if _, err := Decode(nil, src); err != nil {
+			t.Fatalf("#%d: Decode: %v", i, err)
+		}
+		if err := ValidateBlockHeader(src); err != nil {
+			t.Errorf("#%d: got %v, want nil", i, err)
+		}
+	}
+
+	invalid := []struct {
+		desc string
+		src  []byte
+	}{
+		{"empty", nil},
+		{"bad varint", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"too long for its size", append(encodeVarint(1<<20), tagLiteral, 'x', tagCopy2|63<<2, 1, 0)},
+		{"tags but no length", []byte{0, tagLiteral, 'x'}},
+		{"length but no tags", []byte{1}},
+		{"starts with a copy", []byte{4, tagCopy1, 1}},
+	}
+	for _, tc := range invalid {
+		if err := ValidateBlockHeader(tc.src); err == nil {
+			t.Errorf("%s: got nil error, want non-nil", tc.desc)
+		}
+	}
+}
+
+func TestEncodeLiteralsOnly(t *testing.T) {
+	text := smallRecord(rand.New(rand.NewSource(1)), 3*maxBlockSize+5)
+	for _, n := range []int{0, 1, 60, 61, 256, 257, maxBlockSize, maxBlockSize + 1, len(text)} {
+		src := text[:n]
+		enc := EncodeLiteralsOnly(nil, src)
+		got, f, err := DecodeWithFeatures(nil, enc)
+		if err != nil || !bytes.Equal(got, src) {
+			t.Errorf("%d bytes: round trip failed: %v", n, err)
+			continue
+		}
+		if f.Copies != 0 || f.Literals != (n+maxBlockSize-1)/maxBlockSize {
+			t.Errorf("%d bytes: got %d copies and %d literals", n, f.Copies, f.Literals)
+		}
+		if len(enc) > MaxEncodedLen(n) {
+			t.Errorf("%d bytes: encoded length %d exceeds MaxEncodedLen", n, len(enc))
+		}
+	}
+}
+
+func TestDecodeWithFeatures(t *testing.T) {
+	testCases := []struct {
+		desc string
+		src  []byte
+		want BlockFeatures
+	}{
+		{"empty", []byte{0}, BlockFeatures{}},
+		{"literal", []byte{3, tagLiteral | 2<<2, 'a', 'b', 'c'}, BlockFeatures{Literals: 1}},
+		{
+			"run",
+			[]byte{9, tagLiteral, 'a', tagCopy1 | 4<<2, 1},
+			BlockFeatures{Literals: 1, Copies: 1, MaxOffset: 1, OverlappingCopies: 1},
+		},
+		{
+			"copies",
+			[]byte{
+				16, tagLiteral | 3<<2, 'a', 'b', 'c', 'd',
+				tagCopy2 | 3<<2, 4, 0,
+				tagCopy4 | 7<<2, 8, 0, 0, 0,
+			},
+			BlockFeatures{Literals: 1, Copies: 2, MaxOffset: 8, Copy4Tags: 1},
+		},
+	}
+	for _, tc := range testCases {
+		got, f, err := DecodeWithFeatures(nil, tc.src)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if want, _ := Decode(nil, tc.src); !bytes.Equal(got, want) {
+			t.Errorf("%s: decoded %q, want %q", tc.desc, got, want)
+		}
+		if f != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.desc, f, tc.want)
+		}
+	}
+
+	src := bytes.Repeat([]byte("features of a longer block "), 1000)
+	got, f, err := DecodeWithFeatures(nil, Encode(nil, src))
+	if err != nil || !bytes.Equal(got, src) {
+		t.Fatalf("round trip: err=%v, equal=%t", err, bytes.Equal(got, src))
+	}
+	if f.Literals == 0 || f.Copies == 0 || f.MaxOffset == 0 || f.MaxOffset > len(src) {
+		t.Errorf("round trip: implausible features %+v", f)
+	}
+
+	if _, _, err := DecodeWithFeatures(nil, []byte{4, tagCopy1, 1}); err != ErrCorrupt {
+		t.Errorf("corrupt: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestDecodeLimited(t *testing.T) {
+	src := Encode(nil, bytes.Repeat([]byte("abc"), 1000))
+	if _, err := DecodeLimited(nil, src, 2999); err != ErrTooLarge {
+		t.Errorf("limit 2999: got %v, want ErrTooLarge", err)
+	}
+	got, err := DecodeLimited(nil, src, 3000)
+	if err != nil || len(got) != 3000 {
+		t.Errorf("limit 3000: got %d bytes, %v", len(got), err)
+	}
+
+	for _, src := range []string{
+		// 2^64-1, overflowing 32 bits.
+		"\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01" + "\x08\xff\xff\xff",
+		// 2^64, overflowing 64 bits.
+		"\x80\x80\x80\x80\x80\x80\x80\x80\x80\x02" + "\x08\xff\xff\xff",
+		// 0x7fffffff, which fits in an int on all platforms, but is
+		// implausible for a 4-byte body.
+		"\xff\xff\xff\xff\x07" + "\x08\xff\xff\xff",
+	} {
+		if _, err := Decode(nil, []byte(src)); err != ErrCorrupt {
+			t.Errorf("% x: got %v, want ErrCorrupt", src, err)
+		}
+	}
+
+	// A header claiming 1 GiB must be rejected without allocating for it.
+	huge := []byte("\x80\x80\x80\x80\x04\x00\x00\x00")
+	if n := testing.AllocsPerRun(10, func() {
+		if _, err := Decode(nil, huge); err != ErrCorrupt {
+			t.Fatalf("1 GiB header: got %v, want ErrCorrupt", err)
+		}
+	}); n != 0 {
+		t.Errorf("1 GiB header: got %v allocations, want 0", n)
+	}
+}
+
 func TestDecode(t *testing.T) {
 	lit40Bytes := make([]byte, 40)
 	for i := range lit40Bytes {
@@ -176,6 +377,16 @@ func TestDecode(t *testing.T) {
 		"\x00",
 		"",
 		nil,
+	}, {
+		`decodedLen=0; overlong varint`,
+		"\x80\x00",
+		"",
+		ErrCorrupt,
+	}, {
+		`decodedLen=3; overlong varint; tagLiteral, 0-byte length; length=3`,
+		"\x83\x80\x00" + "\x08\xff\xff\xff",
+		"",
+		ErrCorrupt,
 	}, {
 		`decodedLen=3; tagLiteral, 0-byte length; length=3; valid input`,
 		"\x03" + "\x08\xff\xff\xff",
@@ -374,6 +585,116 @@ loop:
 	}
 }
 
+func TestDecodeInto(t *testing.T) {
+	src := bytes.Repeat([]byte("arena "), 1000)
+	encoded := Encode(nil, src)
+	dst := make([]byte, len(src)+10)
+	n, err := DecodeInto(dst, encoded)
+	if err != nil {
+		t.Fatalf("DecodeInto: %v", err)
+	}
+	if err := cmp(dst[:n], src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeInto(dst[:len(src)-1], encoded); err != io.ErrShortBuffer {
+		t.Fatalf("short dst: got %v, want %v", err, io.ErrShortBuffer)
+	}
+	if _, err := DecodeInto(dst, encoded[:len(encoded)-1]); err != ErrCorrupt {
+		t.Fatalf("truncated src: got %v, want %v", err, ErrCorrupt)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { DecodeInto(dst, encoded) }); allocs != 0 {
+		t.Fatalf("got %v allocations, want 0", allocs)
+	}
+}
+
+func TestDecodeRawBlock(t *testing.T) {
+	for _, src := range [][]byte{nil, []byte("a"), bytes.Repeat([]byte("abcd"), 1000)} {
+		encoded := Encode(nil, src)
+		_, n := binary.Uvarint(encoded)
+		raw := encoded[n:]
+		got, err := DecodeRawBlock(nil, raw, len(src))
+		if err != nil {
+			t.Errorf("len(src)=%d: DecodeRawBlock: %v", len(src), err)
+			continue
+		}
+		if err := cmp(got, src); err != nil {
+			t.Errorf("len(src)=%d: %v", len(src), err)
+		}
+		for _, wrongLen := range []int{-1, len(src) - 1, len(src) + 1} {
+			if _, err := DecodeRawBlock(nil, raw, wrongLen); err != ErrCorrupt {
+				t.Errorf("len(src)=%d, decodedLen=%d: got %v, want ErrCorrupt", len(src), wrongLen, err)
+			}
+		}
+	}
+}
+
+func TestEncodeRawBlock(t *testing.T) {
+	for _, n := range []int{0, 1, 17, 100, 1e5, 1e6} {
+		src := bytes.Repeat([]byte("0123456789abcdef"), n/16+1)[:n]
+		rand.New(rand.NewSource(int64(n))).Read(src[:n/2])
+		raw := EncodeRawBlock(nil, src)
+		if len(raw) > MaxRawEncodedLen(n) {
+			t.Errorf("n=%d: got %d bytes, want at most MaxRawEncodedLen = %d", n, len(raw), MaxRawEncodedLen(n))
+		}
+		var buf [binary.MaxVarintLen64]byte
+		want := append(buf[:binary.PutUvarint(buf[:], uint64(n))], raw...)
+		if err := cmp(want, Encode(nil, src)); err != nil {
+			t.Errorf("n=%d: length prefix plus EncodeRawBlock differs from Encode: %v", n, err)
+		}
+		got, err := DecodeRawBlock(nil, raw, n)
+		if err != nil {
+			t.Errorf("n=%d: DecodeRawBlock: %v", n, err)
+			continue
+		}
+		if err := cmp(got, src); err != nil {
+			t.Errorf("n=%d: %v", n, err)
+		}
+	}
+}
+
+func TestDecodeNoCopy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 1000)
+	for i := range random {
+		random[i] = uint8(rng.Intn(256))
+	}
+	regular := bytes.Repeat([]byte("abcdefgh"), 125)
+
+	testCases := []struct {
+		desc        string
+		src         []byte
+		wantAliased bool
+	}{
+		{"random", random, true},
+		{"regular", regular, false},
+		{"short", []byte("abc"), true},
+	}
+	for _, tc := range testCases {
+		encoded := Encode(nil, tc.src)
+		got, aliased, err := DecodeNoCopy(encoded)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if err := cmp(got, tc.src); err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if aliased != tc.wantAliased {
+			t.Errorf("%s: aliased: got %t, want %t", tc.desc, aliased, tc.wantAliased)
+			continue
+		}
+		if aliased && &got[len(got)-1] != &encoded[len(encoded)-1] {
+			t.Errorf("%s: aliased result does not share memory with src", tc.desc)
+		}
+	}
+
+	// A literal that is shorter than the decoded length is not a valid block.
+	if _, _, err := DecodeNoCopy([]byte("\x04\x00a")); err != ErrCorrupt {
+		t.Errorf("short literal: got %v, want ErrCorrupt", err)
+	}
+}
+
 func TestDecodeCopy4(t *testing.T) {
 	dots := strings.Repeat(".", 65536)
 
@@ -520,6 +841,163 @@ func TestDecodeGoldenInput(t *testing.T) {
 	}
 }
 
+func TestDecodeAndCRC(t *testing.T) {
+	tDir := filepath.FromSlash(*testdataDir)
+	src, err := ioutil.ReadFile(filepath.Join(tDir, goldenCompressed))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	got, gotCRC, err := DecodeAndCRC(src)
+	if err != nil {
+		t.Fatalf("DecodeAndCRC: %v", err)
+	}
+	if err := cmp(got, want); err != nil {
+		t.Fatal(err)
+	}
+	// The masking is specified in section 3 of the framing format.
+	c := crc32.Checksum(want, crc32.MakeTable(crc32.Castagnoli))
+	if wantCRC := (c>>15 | c<<17) + 0xa282ead8; gotCRC != wantCRC {
+		t.Fatalf("CRC: got %#08x, want %#08x", gotCRC, wantCRC)
+	}
+
+	if _, _, err := DecodeAndCRC(src[:len(src)-1]); err != ErrCorrupt {
+		t.Fatalf("truncated: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestDumpTags(t *testing.T) {
+	// "abcd" then a copy of 8 bytes at offset 4, then "xyz".
+	src := []byte{
+		0x0f,
+		0x0c, 'a', 'b', 'c', 'd',
+		0x11, 0x04,
+		0x08, 'x', 'y', 'z',
+	}
+	if _, err := Decode(nil, src); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	const want = `decoded length=15
+literal len=4 at srcpos=1 dstpos=0
+copy offset=4 len=8 at srcpos=6 dstpos=4
+literal len=3 at srcpos=8 dstpos=12
+`
+	buf := new(bytes.Buffer)
+	if err := DumpTags(src, buf); err != nil {
+		t.Fatalf("DumpTags: %v", err)
+	}
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Point the copy past the start of the output.
+	src[7] = 0x05
+	buf.Reset()
+	if err := DumpTags(src, buf); err != ErrCorrupt {
+		t.Fatalf("bad offset: got %v, want %v", err, ErrCorrupt)
+	}
+	const wantBad = `decoded length=15
+literal len=4 at srcpos=1 dstpos=0
+copy offset=5 len=8 at srcpos=6 dstpos=4
+copy offset is outside the 4 bytes decoded so far (tag byte 0x11)
+`
+	if got := buf.String(); got != wantBad {
+		t.Fatalf("bad offset: got:\n%s\nwant:\n%s", got, wantBad)
+	}
+
+	// DumpTags must agree with Decode on which blocks are valid.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		text := make([]byte, rng.Intn(300))
+		for j := range text {
+			text[j] = "ab"[rng.Intn(2)]
+		}
+		b := Encode(nil, text)
+		if i%4 != 0 {
+			b[rng.Intn(len(b))] = uint8(rng.Intn(256))
+		}
+		_, decodeErr := Decode(nil, b)
+		dumpErr := DumpTags(b, ioutil.Discard)
+		if decodeErr != dumpErr {
+			t.Fatalf("#%d: Decode error %v, DumpTags error %v", i, decodeErr, dumpErr)
+		}
+	}
+}
+
+func TestDecodeSegments(t *testing.T) {
+	tDir := filepath.FromSlash(*testdataDir)
+	text, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	encoded := Encode(nil, text)
+	var segs [][]byte
+	err = DecodeSegments(encoded, func(p []byte) error {
+		segs = append(segs, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeSegments: %v", err)
+	}
+	// The segments remain valid after the call.
+	if err := cmp(bytes.Join(segs, nil), text); err != nil {
+		t.Fatal(err)
+	}
+
+	// A single literal is emitted as a sub-slice of src.
+	lit := Encode(nil, []byte("abc"))
+	err = DecodeSegments(lit, func(p []byte) error {
+		if &p[0] != &lit[2] {
+			t.Error("literal segment does not alias src")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeSegments: %v", err)
+	}
+
+	// Errors from emit stop the decoding.
+	errStop := errors.New("stop")
+	n := 0
+	err = DecodeSegments(encoded, func(p []byte) error {
+		if n++; n == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || n != 3 {
+		t.Errorf("stopping: got %v after %d segments, want %v after 3", err, n, errStop)
+	}
+
+	// DecodeSegments must agree with Decode.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		text := make([]byte, rng.Intn(300))
+		for j := range text {
+			text[j] = "ab"[rng.Intn(2)]
+		}
+		b := Encode(nil, text)
+		if i%4 != 0 {
+			b[rng.Intn(len(b))] = uint8(rng.Intn(256))
+		}
+		want, decodeErr := Decode(nil, b)
+		var got []byte
+		segmentsErr := DecodeSegments(b, func(p []byte) error {
+			got = append(got, p...)
+			return nil
+		})
+		if decodeErr != segmentsErr {
+			t.Fatalf("#%d: Decode error %v, DecodeSegments error %v", i, decodeErr, segmentsErr)
+		}
+		if decodeErr == nil && !bytes.Equal(got, want) {
+			t.Fatalf("#%d: DecodeSegments differs from Decode", i)
+		}
+	}
+}
+
 func TestEncodeGoldenInput(t *testing.T) {
 	tDir := filepath.FromSlash(*testdataDir)
 	src, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
@@ -536,6 +1014,60 @@ func TestEncodeGoldenInput(t *testing.T) {
 	}
 }
 
+// TestGoldenVectors checks the encoded bytes, not just that they round-trip,
+// so that any dependence on the host's byte order shows up as a failure when
+// the tests are run on a big-endian architecture.
+func TestGoldenVectors(t *testing.T) {
+	if got, want := load32([]byte{1, 2, 3, 4}, 0), uint32(0x04030201); got != want {
+		t.Errorf("load32: got %#08x, want %#08x", got, want)
+	}
+	if got, want := load64([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 0), uint64(0x0807060504030201); got != want {
+		t.Errorf("load64: got %#016x, want %#016x", got, want)
+	}
+	// The CRC-32C check value of "123456789" is 0xe3069283, masked.
+	if got, want := crc([]byte("123456789")), uint32(0xc78ab0e5); got != want {
+		t.Errorf("crc: got %#08x, want %#08x", got, want)
+	}
+
+	digits := strings.Repeat("0123456789", 8)
+	testCases := []struct {
+		src, want string
+	}{
+		{"", "\x00"},
+		{"a", "\x01\x00a"},
+		{"abcdefgh", "\x08\x1cabcdefgh"},
+		{strings.Repeat("ab", 20), "(\x04ab\x96\x02\x00"},
+		{"Hello, Hello, Hello, world", "\x1a\x18Hello, 6\x07\x00\x10world"},
+		{digits + "x" + digits, "\xa1\x01$0123456789\xfe\n\x00\t\n\x00x\xfeG\x00\tG$0123456789"},
+	}
+	for _, tc := range testCases {
+		if got := Encode(nil, []byte(tc.src)); string(got) != tc.want {
+			t.Errorf("Encode(%q):\ngot  %q\nwant %q", tc.src, got, tc.want)
+		}
+		if got := NewEncoder().Encode(nil, []byte(tc.src)); string(got) != tc.want {
+			t.Errorf("Encoder.Encode(%q):\ngot  %q\nwant %q", tc.src, got, tc.want)
+		}
+	}
+
+	const wantFramed = "\xff\x06\x00\x00sNaPpY\x01\x10\x00\x00l\xa2\xf5\xcaHello, world"
+	if got := EncodeFramed([]byte("Hello, world")); string(got) != wantFramed {
+		t.Errorf("EncodeFramed:\ngot  %q\nwant %q", got, wantFramed)
+	}
+
+	tDir := filepath.FromSlash(*testdataDir)
+	src, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join(tDir, goldenCompressed))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if err := cmp(NewEncoder().Encode(nil, src), want); err != nil {
+		t.Fatalf("Encoder.Encode: %v", err)
+	}
+}
+
 func TestExtendMatchGoldenInput(t *testing.T) {
 	tDir := filepath.FromSlash(*testdataDir)
 	src, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
@@ -687,422 +1219,4182 @@ func TestSlowForwardCopyOverrun(t *testing.T) {
 	}
 }
 
-// TestEncodeNoiseThenRepeats encodes input for which the first half is very
-// incompressible and the second half is very compressible. The encoded form's
-// length should be closer to 50% of the original length than 100%.
-func TestEncodeNoiseThenRepeats(t *testing.T) {
-	for _, origLen := range []int{256 * 1024, 2048 * 1024} {
-		src := make([]byte, origLen)
-		rng := rand.New(rand.NewSource(1))
-		firstHalf, secondHalf := src[:origLen/2], src[origLen/2:]
-		for i := range firstHalf {
-			firstHalf[i] = uint8(rng.Intn(256))
+func TestEncodeWithResult(t *testing.T) {
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+	mixed := append(bytes.Repeat([]byte("x"), 5000), random[:5000]...)
+	for _, tc := range []struct {
+		desc                 string
+		src                  []byte
+		likelyIncompressible bool
+	}{
+		{"empty", nil, false},
+		{"short", []byte("abc"), true},
+		{"random", random, true},
+		{"repetitive", bytes.Repeat([]byte("ab"), 5000), false},
+		{"mixed", mixed, false},
+	} {
+		out, info := EncodeWithResult(nil, tc.src)
+		if err := cmp(out, Encode(nil, tc.src)); err != nil {
+			t.Errorf("%s: output differs from Encode: %v", tc.desc, err)
 		}
-		for i := range secondHalf {
-			secondHalf[i] = uint8(i >> 8)
+		if info.EncodedLen != len(out) {
+			t.Errorf("%s: EncodedLen: got %d, want %d", tc.desc, info.EncodedLen, len(out))
 		}
-		dst := Encode(nil, src)
-		if got, want := len(dst), origLen*3/4; got >= want {
-			t.Errorf("origLen=%d: got %d encoded bytes, want less than %d", origLen, got, want)
+		// Count the literal bytes by hand, from the output of DumpTags.
+		dump := new(bytes.Buffer)
+		if err := DumpTags(out, dump); err != nil {
+			t.Fatalf("%s: DumpTags: %v", tc.desc, err)
+		}
+		wantLiterals := 0
+		for _, line := range strings.Split(dump.String(), "\n") {
+			var n int
+			if _, err := fmt.Sscanf(line, "literal len=%d", &n); err == nil {
+				wantLiterals += n
+			}
+		}
+		if info.LiteralBytes != wantLiterals {
+			t.Errorf("%s: LiteralBytes: got %d, want %d", tc.desc, info.LiteralBytes, wantLiterals)
+		}
+		if info.LikelyIncompressible != tc.likelyIncompressible {
+			t.Errorf("%s: LikelyIncompressible: got %t, want %t", tc.desc, info.LikelyIncompressible, tc.likelyIncompressible)
 		}
 	}
 }
 
-func TestFramingFormat(t *testing.T) {
-	// src is comprised of alternating 1e5-sized sequences of random
-	// (incompressible) bytes and repeated (compressible) bytes. 1e5 was chosen
-	// because it is larger than maxBlockSize (64k).
-	src := make([]byte, 1e6)
-	rng := rand.New(rand.NewSource(1))
-	for i := 0; i < 10; i++ {
-		if i%2 == 0 {
-			for j := 0; j < 1e5; j++ {
-				src[1e5*i+j] = uint8(rng.Intn(256))
-			}
-		} else {
-			for j := 0; j < 1e5; j++ {
-				src[1e5*i+j] = uint8(i)
+func TestEncodeRequireRatio(t *testing.T) {
+	repetitive := bytes.Repeat([]byte("abcdefgh"), 1000)
+	random := make([]byte, 8000)
+	rand.New(rand.NewSource(1)).Read(random)
+	testCases := []struct {
+		desc     string
+		src      []byte
+		minRatio float64
+		wantErr  error
+	}{
+		{"repetitive, 2x", repetitive, 2, nil},
+		{"repetitive, 1000x", repetitive, 1000, ErrPoorCompression},
+		{"random, 1x", random, 1, ErrPoorCompression},
+		{"random, 0.9x", random, 0.9, nil},
+		{"empty, 1x", nil, 1, ErrPoorCompression},
+		{"empty, 0x", nil, 0, nil},
+	}
+	for _, tc := range testCases {
+		got, err := EncodeRequireRatio(nil, tc.src, tc.minRatio)
+		if err != tc.wantErr {
+			t.Errorf("%s: got %v, want %v", tc.desc, err, tc.wantErr)
+			continue
+		}
+		if err == nil {
+			if err := cmp(got, Encode(nil, tc.src)); err != nil {
+				t.Errorf("%s: %v", tc.desc, err)
 			}
 		}
 	}
+}
 
-	buf := new(bytes.Buffer)
-	if _, err := NewWriter(buf).Write(src); err != nil {
-		t.Fatalf("Write: encoding: %v", err)
+func TestEncodeBudget(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 3*maxBlockSize+1234)
+	for i := range src {
+		src[i] = "budget"[rng.Intn(6)]
+	}
+	full := Encode(nil, src)
+	for _, maxOut := range []int{0, 1, 2, 10, 100, 1000, 30000, len(full) - 1, len(full), len(full) + 1000} {
+		out, consumed := EncodeBudget(nil, src, maxOut)
+		if maxOut < 1 {
+			if out != nil || consumed != 0 {
+				t.Errorf("maxOut=%d: got %d bytes, %d consumed, want nothing", maxOut, len(out), consumed)
+			}
+			continue
+		}
+		if len(out) > maxOut {
+			t.Errorf("maxOut=%d: got %d bytes", maxOut, len(out))
+			continue
+		}
+		got, err := Decode(nil, out)
+		if err != nil {
+			t.Errorf("maxOut=%d: Decode: %v", maxOut, err)
+			continue
+		}
+		if err := cmp(got, src[:consumed]); err != nil {
+			t.Errorf("maxOut=%d: %v", maxOut, err)
+		}
+		if maxOut >= len(full) {
+			if consumed != len(src) {
+				t.Errorf("maxOut=%d: consumed %d bytes, want all %d", maxOut, consumed, len(src))
+			}
+		} else if maxOut >= 1000 && len(out) < maxOut*9/10 {
+			t.Errorf("maxOut=%d: got only %d bytes", maxOut, len(out))
+		}
+	}
+}
+
+func TestEncoderDenseMatching(t *testing.T) {
+	tDir := filepath.FromSlash(*testdataDir)
+	text, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	// Interleave the text with copies of itself that have been shifted by an
+	// odd number of bytes and lightly edited.
+	var src []byte
+	for i := 0; i+4096 < len(text) && len(src) < 1e6; i += 4096 {
+		src = append(src, text[i:i+4096]...)
+		edited := append([]byte(nil), text[i+3:i+4096]...)
+		for j := 100; j < len(edited); j += 500 {
+			edited[j] ^= 0x20
+		}
+		src = append(src, edited...)
+	}
+
+	dflt := NewEncoder().Encode(nil, src)
+	if err := cmp(dflt, Encode(nil, src)); err != nil {
+		t.Fatalf("default Encoder does not match Encode: %v", err)
+	}
+	dense := NewEncoder(DenseMatching()).Encode(nil, src)
+	if len(dense) >= len(dflt) {
+		t.Errorf("got %d bytes with dense matching, want fewer than the default %d", len(dense), len(dflt))
+	}
+	for _, src := range [][]byte{src, nil, []byte("a"), bytes.Repeat([]byte("ab"), 100)} {
+		encoded := NewEncoder(DenseMatching()).Encode(nil, src)
+		decoded, err := Decode(nil, encoded)
+		if err != nil {
+			t.Fatalf("len(src)=%d: Decode: %v", len(src), err)
+		}
+		if err := cmp(decoded, src); err != nil {
+			t.Fatalf("len(src)=%d: %v", len(src), err)
+		}
+	}
+}
+
+func TestEncoderRunMatching(t *testing.T) {
+	// A column of slowly increasing 32-bit integers.
+	rng := rand.New(rand.NewSource(1))
+	column := make([]byte, 0, maxBlockSize)
+	v := uint32(1000)
+	for len(column) < maxBlockSize {
+		if rng.Intn(20) == 0 {
+			v += uint32(rng.Intn(3))
+		}
+		column = append(column, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	}
+	plain := Encode(nil, column)
+	runs := NewEncoder(RunMatching()).Encode(nil, column)
+	if len(runs) >= len(plain) {
+		t.Errorf("column: RunMatching gave %d bytes, want fewer than Encode's %d", len(runs), len(plain))
+	}
+
+	e := NewEncoder(RunMatching())
+	for i := 0; i < 200; i++ {
+		src := make([]byte, rng.Intn(3*maxBlockSize/2))
+		for j := range src {
+			switch {
+			case j > 8 && rng.Intn(4) != 0:
+				src[j] = src[j-[]int{1, 2, 4, 8}[rng.Intn(4)]]
+			default:
+				src[j] = uint8(rng.Intn(256))
+			}
+		}
+		got, err := Decode(nil, e.Encode(nil, src))
+		if err != nil {
+			t.Fatalf("#%d: Decode: %v", i, err)
+		}
+		if err := cmp(got, src); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+}
+
+func TestEncoderSkipHeuristic(t *testing.T) {
+	// Compressible text with incompressible stretches.
+	rng := rand.New(rand.NewSource(1))
+	var src []byte
+	for len(src) < 3*maxBlockSize {
+		src = append(src, "HEADER: some compressible metadata goes here\n"...)
+		payload := make([]byte, rng.Intn(2000))
+		rng.Read(payload)
+		src = append(src, payload...)
+	}
+
+	if err := cmp(NewEncoder(SkipHeuristic(32, 5)).Encode(nil, src), Encode(nil, src)); err != nil {
+		t.Fatalf("default parameters: %v", err)
+	}
+	for _, p := range []struct {
+		initialSkip int
+		shift       uint
+	}{{16, 4}, {256, 5}, {64, 6}, {1, 0}, {1 << 16, 16}} {
+		got, err := Decode(nil, NewEncoder(SkipHeuristic(p.initialSkip, p.shift)).Encode(nil, src))
+		if err != nil {
+			t.Fatalf("%v: Decode: %v", p, err)
+		}
+		if err := cmp(got, src); err != nil {
+			t.Fatalf("%v: %v", p, err)
+		}
+	}
+
+	for _, p := range [][2]int{{15, 4}, {1 << 17, 17}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: did not panic", p)
+				}
+			}()
+			NewEncoder(SkipHeuristic(p[0], uint(p[1])))
+		}()
+	}
+}
+
+func TestAutoTune(t *testing.T) {
+	tDir := filepath.FromSlash(*testdataDir)
+	src, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if got := NewEncoder(EncoderConfig{}.Options()...).Encode(nil, src); !bytes.Equal(got, Encode(nil, src)) {
+		t.Fatal("the zero EncoderConfig does not give the output of Encode")
+	}
+	for _, budget := range []time.Duration{0, 10 * time.Millisecond} {
+		c := AutoTune(src, budget)
+		found := false
+		for _, d := range autoTuneConfigs {
+			found = found || c == d
+		}
+		if !found {
+			t.Errorf("budget=%v: got %+v, which is not a candidate", budget, c)
+		}
+		decoded, err := Decode(nil, NewEncoder(c.Options()...).Encode(nil, src))
+		if err != nil {
+			t.Fatalf("budget=%v: Decode: %v", budget, err)
+		}
+		if err := cmp(decoded, src); err != nil {
+			t.Fatalf("budget=%v: %v", budget, err)
+		}
+	}
+}
+
+func TestEncodeBlockContinue(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// Messages that share a lot with each other, but little within themselves,
+	// and some larger ones to push earlier messages out of the window.
+	var msgs [][]byte
+	for i := 0; i < 500; i++ {
+		n := 20 + rng.Intn(200)
+		if i%50 == 49 {
+			n = 40000 + rng.Intn(60000)
+		}
+		msg := make([]byte, n)
+		for j := range msg {
+			msg[j] = "abcdefghijklmnopqrstuvwxyz"[rng.Intn(26)]
+		}
+		copy(msg, fmt.Sprintf(`{"user":"u%d","event":"login","ok":true}`, rng.Intn(5)))
+		msgs = append(msgs, msg)
+	}
+
+	e := NewEncoder()
+	for pass := 0; pass < 2; pass++ {
+		d := NewContinueDecoder()
+		continued, independent := 0, 0
+		for i, msg := range msgs {
+			enc := e.EncodeBlockContinue(nil, msg)
+			continued += len(enc)
+			independent += len(Encode(nil, msg))
+			got, err := d.Decode(nil, enc)
+			if err != nil || !bytes.Equal(got, msg) {
+				t.Fatalf("pass %d, message #%d: err=%v, equal=%t", pass, i, err, bytes.Equal(got, msg))
+			}
+		}
+		if continued >= independent {
+			t.Errorf("pass %d: continued blocks total %d bytes, independent %d", pass, continued, independent)
+		}
+		e.ResetContinue()
+	}
+
+	// A block that refers to an earlier one cannot be decoded on its own, and
+	// a corrupt block stops the ContinueDecoder until it is Reset.
+	e.ResetContinue()
+	first := e.EncodeBlockContinue(nil, msgs[0])
+	second := e.EncodeBlockContinue(nil, msgs[0])
+	if _, err := Decode(nil, second); err == nil {
+		t.Errorf("Decode of a continued block: got nil error, want non-nil")
+	}
+	d := NewContinueDecoder()
+	if _, err := d.Decode(nil, second); err != ErrCorrupt {
+		t.Errorf("second block first: got %v, want ErrCorrupt", err)
+	}
+	if _, err := d.Decode(nil, first); err != ErrCorrupt {
+		t.Errorf("after an error: got %v, want ErrCorrupt", err)
+	}
+	d.Reset()
+	for _, enc := range [][]byte{first, second} {
+		if got, err := d.Decode(nil, enc); err != nil || !bytes.Equal(got, msgs[0]) {
+			t.Errorf("after Reset: err=%v, equal=%t", err, bytes.Equal(got, msgs[0]))
+		}
+	}
+}
+
+func TestEncodeDelta(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	base := make([]byte, 30000)
+	for i := range base {
+		base[i] = "abcdefghijklmnopqrstuvwxyz"[rng.Intn(26)]
+	}
+	// The new version has a few edits.
+	src := append([]byte(nil), base[:10000]...)
+	src = append(src, "an inserted sentence"...)
+	src = append(src, base[10000:20000]...)
+	src = append(src, base[20100:]...)
+
+	enc := EncodeDelta(nil, base, src)
+	if n := len(Encode(nil, src)); len(enc) > n/20 {
+		t.Errorf("delta is %d bytes, against %d without a base", len(enc), n)
+	}
+	got, err := DecodeDelta(nil, base, enc)
+	if err != nil || !bytes.Equal(got, src) {
+		t.Fatalf("DecodeDelta: err=%v, equal=%t", err, bytes.Equal(got, src))
+	}
+	if _, err := DecodeDelta(nil, nil, enc); err != ErrCorrupt {
+		t.Errorf("no base: got %v, want ErrCorrupt", err)
+	}
+
+	// Only the last 65535 bytes of a larger base are used.
+	big := append(make([]byte, 100000), base...)
+	enc = EncodeDelta(nil, big, src)
+	for _, b := range [][]byte{big, big[len(big)-continueWindow:]} {
+		if got, err := DecodeDelta(nil, b, enc); err != nil || !bytes.Equal(got, src) {
+			t.Errorf("large base, len %d: err=%v, equal=%t", len(b), err, bytes.Equal(got, src))
+		}
+	}
+
+	for _, tc := range [][2][]byte{{nil, nil}, {base, nil}, {nil, src}} {
+		enc := EncodeDelta(nil, tc[0], tc[1])
+		if got, err := DecodeDelta(nil, tc[0], enc); err != nil || !bytes.Equal(got, tc[1]) {
+			t.Errorf("len(base)=%d, len(src)=%d: err=%v", len(tc[0]), len(tc[1]), err)
+		}
+	}
+}
+
+func TestEncodeDict(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	dict := smallRecord(rng, 20000)
+	d := NewDictionary(dict)
+	for i := 0; i < 20; i++ {
+		src := smallRecord(rng, rng.Intn(2000))
+		enc := EncodeDict(nil, d, src)
+		if want := EncodeDelta(nil, dict, src); !bytes.Equal(enc, want) {
+			t.Fatalf("#%d: EncodeDict and EncodeDelta differ", i)
+		}
+		got, err := DecodeDict(nil, d, enc)
+		if err != nil || !bytes.Equal(got, src) {
+			t.Fatalf("#%d: DecodeDict: err=%v, equal=%t", i, err, bytes.Equal(got, src))
+		}
+	}
+
+	// Encoding does not modify the Dictionary, even for a large src.
+	big := bytes.Repeat(dict, 5)
+	for i := 0; i < 2; i++ {
+		enc := EncodeDict(nil, d, big)
+		if got, err := DecodeDict(nil, d, enc); err != nil || !bytes.Equal(got, big) {
+			t.Fatalf("large src #%d: err=%v, equal=%t", i, err, bytes.Equal(got, big))
+		}
+	}
+	if !bytes.Equal(d.seed.buf, dict) {
+		t.Errorf("the Dictionary's bytes were modified")
+	}
+}
+
+func benchEncodeDict(b *testing.B, cached bool) {
+	rng := rand.New(rand.NewSource(1))
+	dict := smallRecord(rng, 32768)
+	src := smallRecord(rng, 256)
+	d := NewDictionary(dict)
+	dst := make([]byte, MaxEncodedLen(len(src)))
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cached {
+			EncodeDict(dst, d, src)
+		} else {
+			EncodeDelta(dst, dict, src)
+		}
+	}
+}
+
+func BenchmarkEncodeDict(b *testing.B)  { benchEncodeDict(b, true) }
+func BenchmarkEncodeDelta(b *testing.B) { benchEncodeDict(b, false) }
+
+func TestMinCompressibleLen(t *testing.T) {
+	m := MinCompressibleLen()
+	for n := 1; n < m; n++ {
+		if got, want := len(Encode(nil, make([]byte, n))), n+2; got != want {
+			t.Errorf("n=%d: encoded length %d, want %d", n, got, want)
+		}
+	}
+	if got := len(Encode(nil, make([]byte, m))); got >= m {
+		t.Errorf("n=%d: encoded length %d, want less", m, got)
+	}
+}
+
+func TestEncodeSmall(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var inputs [][]byte
+	for _, n := range []int{0, 1, 16, 17, 100, 1000, 1024, 1025, 5000} {
+		inputs = append(inputs, make([]byte, n), bytes.Repeat([]byte("ab"), n)[:n], smallRecord(rng, n))
+		random := make([]byte, n)
+		rng.Read(random)
+		inputs = append(inputs, random)
+	}
+	for i, src := range inputs {
+		enc := EncodeSmall(nil, src)
+		if len(enc) > MaxEncodedLen(len(src)) {
+			t.Errorf("input #%d: encoded length %d exceeds MaxEncodedLen", i, len(enc))
+		}
+		got, err := Decode(nil, enc)
+		if err != nil {
+			t.Errorf("input #%d (%d bytes): Decode: %v", i, len(src), err)
+			continue
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("input #%d (%d bytes): round trip mismatch", i, len(src))
+		}
+	}
+}
+
+// smallRecord returns n bytes that look like a JSON record, with repeated
+// field names and varying values.
+func smallRecord(rng *rand.Rand, n int) []byte {
+	var b []byte
+	for len(b) < n {
+		b = append(b, fmt.Sprintf(`{"id":%d,"name":"user%d","active":true},`, rng.Intn(1e6), rng.Intn(1e3))...)
+	}
+	return b[:n]
+}
+
+func benchEncodeSmall(b *testing.B, n int, small bool) {
+	src := smallRecord(rand.New(rand.NewSource(1)), n)
+	b.SetBytes(int64(n))
+	dst := make([]byte, MaxEncodedLen(n))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if small {
+			EncodeSmall(dst, src)
+		} else {
+			Encode(dst, src)
+		}
+	}
+}
+
+func BenchmarkEncodeSmall64(b *testing.B)   { benchEncodeSmall(b, 64, true) }
+func BenchmarkEncodeSmall256(b *testing.B)  { benchEncodeSmall(b, 256, true) }
+func BenchmarkEncodeSmall1024(b *testing.B) { benchEncodeSmall(b, 1024, true) }
+func BenchmarkEncode64(b *testing.B)        { benchEncodeSmall(b, 64, false) }
+func BenchmarkEncode256(b *testing.B)       { benchEncodeSmall(b, 256, false) }
+func BenchmarkEncode1024(b *testing.B)      { benchEncodeSmall(b, 1024, false) }
+
+func TestEncodeBuffers(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := smallRecord(rng, 3*maxBlockSize+1000)
+	// Split data at 0, 1, 100 and 70000 bytes, and at random, including empty
+	// fragments, so that the 64 KiB pieces straddle fragment boundaries.
+	splits := [][]int{nil, {0, 0}, {1}, {100, 100}, {70000}}
+	for i := 0; i < 5; i++ {
+		var s []int
+		for j := 0; j < 20; j++ {
+			s = append(s, rng.Intn(len(data)))
+		}
+		sort.Ints(s)
+		splits = append(splits, s)
+	}
+	for _, s := range splits {
+		var bufs net.Buffers
+		prev := 0
+		for _, x := range append(s, len(data)) {
+			bufs = append(bufs, data[prev:x])
+			prev = x
+		}
+		want := Encode(nil, data)
+		if got := EncodeBuffers(nil, bufs); !bytes.Equal(got, want) {
+			t.Errorf("split at %v: EncodeBuffers differs from Encode", s)
+		}
+		if len(bufs) != len(s)+1 {
+			t.Errorf("split at %v: bufs was modified", s)
+		}
+
+		buf := new(bytes.Buffer)
+		w := NewBufferedWriter(buf)
+		if n, err := w.WriteBuffers(bufs); n != int64(len(data)) || err != nil {
+			t.Errorf("split at %v: WriteBuffers: got %d, %v", s, n, err)
+		}
+		w.Close()
+		if got, err := DecodeFramed(buf.Bytes()); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("split at %v: WriteBuffers did not round trip: %v", s, err)
+		}
+	}
+	if got := EncodeBuffers(nil, nil); !bytes.Equal(got, []byte{0}) {
+		t.Errorf("no buffers: got % x, want 00", got)
+	}
+}
+
+func TestEncoderProbeIncompressible(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 3*maxBlockSize)
+	rng.Read(random)
+	text := smallRecord(rng, 3*maxBlockSize)
+	repeated := bytes.Repeat(random[:30001], 3)[:maxBlockSize]
+
+	e := NewEncoder(ProbeIncompressible())
+	for _, tc := range []struct {
+		desc   string
+		src    []byte
+		stored bool
+	}{
+		{"random", random, true},
+		{"text", text, false},
+		{"short random", random[:probeMinLen], false},
+		// A false negative: this compresses, but its bytes look random.
+		{"repeated random", repeated, true},
+	} {
+		got := e.Encode(nil, tc.src)
+		if tc.stored {
+			if len(got) < len(tc.src) {
+				t.Errorf("%s: encoded %d bytes to %d, want stored", tc.desc, len(tc.src), len(got))
+			}
+		} else if !bytes.Equal(got, Encode(nil, tc.src)) {
+			t.Errorf("%s: output differs from Encode", tc.desc)
+		}
+		if d, err := Decode(nil, got); err != nil || !bytes.Equal(d, tc.src) {
+			t.Errorf("%s: round trip failed: %v", tc.desc, err)
+		}
+	}
+	if n := len(Encode(nil, repeated)); n >= len(repeated)/2 {
+		t.Errorf("repeated random: Encode gave %d bytes, want it to compress", n)
+	}
+}
+
+func benchEncoderProbe(b *testing.B, probe bool) {
+	src := make([]byte, maxBlockSize)
+	rand.New(rand.NewSource(1)).Read(src)
+	var opts []EncoderOption
+	if probe {
+		opts = append(opts, ProbeIncompressible())
+	}
+	e := NewEncoder(opts...)
+	dst := make([]byte, MaxEncodedLen(len(src)))
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.Encode(dst, src)
+	}
+}
+
+func BenchmarkEncoderRandom(b *testing.B)      { benchEncoderProbe(b, false) }
+func BenchmarkEncoderRandomProbe(b *testing.B) { benchEncoderProbe(b, true) }
+
+func TestEncodedLen(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 3*maxBlockSize+5)
+	rng.Read(random)
+	text := smallRecord(rng, 3*maxBlockSize+5)
+	for _, n := range []int{0, 1, 16, 17, 1000, maxBlockSize, maxBlockSize + 1, len(text)} {
+		for _, src := range [][]byte{random[:n], text[:n], make([]byte, n)} {
+			if got, want := EncodedLen(src), len(Encode(nil, src)); got != want {
+				t.Errorf("%d bytes: got %d, want %d", n, got, want)
+			}
+		}
+	}
+	EncodedLen(text)
+	if n := testing.AllocsPerRun(10, func() { EncodedLen(text) }); n >= 1 {
+		t.Errorf("got %v allocations, want 0", n)
+	}
+}
+
+func TestEncoderReuse(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	e := NewEncoder()
+	for i := 0; i < 2000; i++ {
+		if i == 1000 {
+			// Make the generation number wrap around.
+			e.gen = 1<<16 - 3
+		}
+		src := make([]byte, rng.Intn(300))
+		for j := range src {
+			src[j] = "abcd"[rng.Intn(4)]
+		}
+		if err := cmp(e.Encode(nil, src), Encode(nil, src)); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+}
+
+func TestEncoderEncodeBatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	srcs := make([][]byte, 300)
+	dsts := make([][]byte, len(srcs))
+	for i := range srcs {
+		srcs[i] = make([]byte, rng.Intn(300))
+		for j := range srcs[i] {
+			srcs[i][j] = "abcd"[rng.Intn(4)]
+		}
+		// Give some records a large enough dst, and some a too small one.
+		switch i % 3 {
+		case 1:
+			dsts[i] = make([]byte, MaxEncodedLen(len(srcs[i])))
+		case 2:
+			dsts[i] = make([]byte, 1)
+		}
+	}
+	for _, d := range [][][]byte{nil, dsts} {
+		got := NewEncoder().EncodeBatch(d, srcs)
+		if len(got) != len(srcs) {
+			t.Fatalf("got %d results, want %d", len(got), len(srcs))
+		}
+		for i := range srcs {
+			if err := cmp(got[i], Encode(nil, srcs[i])); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+		// Appending to one result must not overwrite the next.
+		for i := range got {
+			got[i] = append(got[i], 0xff)
+		}
+		for i := range srcs {
+			if err := cmp(got[i][:len(got[i])-1], Encode(nil, srcs[i])); err != nil {
+				t.Fatalf("#%d after append: %v", i, err)
+			}
+		}
+	}
+}
+
+// TestEncodeDeterministic tests that Encode, which uses assembly on some
+// architectures, gives the same output as the always-compiled pure Go
+// implementation behind Encoder, on a variety of inputs. TestEncodeGoldenInput
+// separately pins the output to a fixed golden file.
+func TestEncodeDeterministic(t *testing.T) {
+	tDir := filepath.FromSlash(*testdataDir)
+	text, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	e := NewEncoder()
+	for i := 0; i < 500; i++ {
+		var src []byte
+		switch n := rng.Intn(3 * maxBlockSize); i % 4 {
+		case 0:
+			src = text[:n%len(text)]
+		case 1:
+			src = make([]byte, n)
+			for j := range src {
+				src[j] = uint8(rng.Intn(256))
+			}
+		case 2:
+			src = make([]byte, n)
+			for j := range src {
+				src[j] = "ab"[rng.Intn(2)]
+			}
+		case 3:
+			src = make([]byte, n)
+			for j := range src {
+				src[j] = uint8(j >> uint(rng.Intn(8)))
+			}
+		}
+		want := Encode(nil, src)
+		if err := cmp(e.Encode(nil, src), want); err != nil {
+			t.Fatalf("#%d: len(src)=%d: %v", i, len(src), err)
+		}
+		if err := cmp(Encode(make([]byte, len(want)+100), src), want); err != nil {
+			t.Fatalf("#%d: len(src)=%d: with a large dst: %v", i, len(src), err)
+		}
+	}
+}
+
+// TestEncodeNoiseThenRepeats encodes input for which the first half is very
+// incompressible and the second half is very compressible. The encoded form's
+// length should be closer to 50% of the original length than 100%.
+func TestEncodeNoiseThenRepeats(t *testing.T) {
+	for _, origLen := range []int{256 * 1024, 2048 * 1024} {
+		src := make([]byte, origLen)
+		rng := rand.New(rand.NewSource(1))
+		firstHalf, secondHalf := src[:origLen/2], src[origLen/2:]
+		for i := range firstHalf {
+			firstHalf[i] = uint8(rng.Intn(256))
+		}
+		for i := range secondHalf {
+			secondHalf[i] = uint8(i >> 8)
+		}
+		dst := Encode(nil, src)
+		if got, want := len(dst), origLen*3/4; got >= want {
+			t.Errorf("origLen=%d: got %d encoded bytes, want less than %d", origLen, got, want)
+		}
+	}
+}
+
+func TestFramingFormat(t *testing.T) {
+	// src is comprised of alternating 1e5-sized sequences of random
+	// (incompressible) bytes and repeated (compressible) bytes. 1e5 was chosen
+	// because it is larger than maxBlockSize (64k).
+	src := make([]byte, 1e6)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			for j := 0; j < 1e5; j++ {
+				src[1e5*i+j] = uint8(rng.Intn(256))
+			}
+		} else {
+			for j := 0; j < 1e5; j++ {
+				src[1e5*i+j] = uint8(i)
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := NewWriter(buf).Write(src); err != nil {
+		t.Fatalf("Write: encoding: %v", err)
+	}
+	dst, err := ioutil.ReadAll(NewReader(buf))
+	if err != nil {
+		t.Fatalf("ReadAll: decoding: %v", err)
+	}
+	if err := cmp(dst, src); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterGoldenOutput(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	defer w.Close()
+	w.Write([]byte("abcd")) // Not compressible.
+	w.Flush()
+	w.Write(bytes.Repeat([]byte{'A'}, 150)) // Compressible.
+	w.Flush()
+	// The next chunk is also compressible, but a naive, greedy encoding of the
+	// overall length 67 copy as a length 64 copy (the longest expressible as a
+	// tagCopy1 or tagCopy2) plus a length 3 remainder would be two 3-byte
+	// tagCopy2 tags (6 bytes), since the minimum length for a tagCopy1 is 4
+	// bytes. Instead, we could do it shorter, in 5 bytes: a 3-byte tagCopy2
+	// (of length 60) and a 2-byte tagCopy1 (of length 7).
+	w.Write(bytes.Repeat([]byte{'B'}, 68))
+	w.Write([]byte("efC"))                 // Not compressible.
+	w.Write(bytes.Repeat([]byte{'C'}, 20)) // Compressible.
+	w.Write(bytes.Repeat([]byte{'B'}, 20)) // Compressible.
+	w.Write([]byte("g"))                   // Not compressible.
+	w.Flush()
+
+	got := buf.String()
+	want := strings.Join([]string{
+		magicChunk,
+		"\x01\x08\x00\x00", // Uncompressed chunk, 8 bytes long (including 4 byte checksum).
+		"\x68\x10\xe6\xb6", // Checksum.
+		"\x61\x62\x63\x64", // Uncompressed payload: "abcd".
+		"\x00\x11\x00\x00", // Compressed chunk, 17 bytes long (including 4 byte checksum).
+		"\x5f\xeb\xf2\x10", // Checksum.
+		"\x96\x01",         // Compressed payload: Uncompressed length (varint encoded): 150.
+		"\x00\x41",         // Compressed payload: tagLiteral, length=1,  "A".
+		"\xfe\x01\x00",     // Compressed payload: tagCopy2,   length=64, offset=1.
+		"\xfe\x01\x00",     // Compressed payload: tagCopy2,   length=64, offset=1.
+		"\x52\x01\x00",     // Compressed payload: tagCopy2,   length=21, offset=1.
+		"\x00\x18\x00\x00", // Compressed chunk, 24 bytes long (including 4 byte checksum).
+		"\x30\x85\x69\xeb", // Checksum.
+		"\x70",             // Compressed payload: Uncompressed length (varint encoded): 112.
+		"\x00\x42",         // Compressed payload: tagLiteral, length=1,  "B".
+		"\xee\x01\x00",     // Compressed payload: tagCopy2,   length=60, offset=1.
+		"\x0d\x01",         // Compressed payload: tagCopy1,   length=7,  offset=1.
+		"\x08\x65\x66\x43", // Compressed payload: tagLiteral, length=3,  "efC".
+		"\x4e\x01\x00",     // Compressed payload: tagCopy2,   length=20, offset=1.
+		"\x4e\x5a\x00",     // Compressed payload: tagCopy2,   length=20, offset=90.
+		"\x00\x67",         // Compressed payload: tagLiteral, length=1,  "g".
+	}, "")
+	if got != want {
+		t.Fatalf("\ngot:  % x\nwant: % x", got, want)
+	}
+}
+
+func TestEmitLiteral(t *testing.T) {
+	testCases := []struct {
+		length int
+		want   string
+	}{
+		{1, "\x00"},
+		{2, "\x04"},
+		{59, "\xe8"},
+		{60, "\xec"},
+		{61, "\xf0\x3c"},
+		{62, "\xf0\x3d"},
+		{254, "\xf0\xfd"},
+		{255, "\xf0\xfe"},
+		{256, "\xf0\xff"},
+		{257, "\xf4\x00\x01"},
+		{65534, "\xf4\xfd\xff"},
+		{65535, "\xf4\xfe\xff"},
+		{65536, "\xf4\xff\xff"},
+	}
+
+	dst := make([]byte, 70000)
+	nines := bytes.Repeat([]byte{0x99}, 65536)
+	for _, tc := range testCases {
+		lit := nines[:tc.length]
+		n := emitLiteral(dst, lit)
+		if !bytes.HasSuffix(dst[:n], lit) {
+			t.Errorf("length=%d: did not end with that many literal bytes", tc.length)
+			continue
+		}
+		got := string(dst[:n-tc.length])
+		if got != tc.want {
+			t.Errorf("length=%d:\ngot  % x\nwant % x", tc.length, got, tc.want)
+			continue
+		}
+	}
+}
+
+func TestEmitCopy(t *testing.T) {
+	testCases := []struct {
+		offset int
+		length int
+		want   string
+	}{
+		{8, 04, "\x01\x08"},
+		{8, 11, "\x1d\x08"},
+		{8, 12, "\x2e\x08\x00"},
+		{8, 13, "\x32\x08\x00"},
+		{8, 59, "\xea\x08\x00"},
+		{8, 60, "\xee\x08\x00"},
+		{8, 61, "\xf2\x08\x00"},
+		{8, 62, "\xf6\x08\x00"},
+		{8, 63, "\xfa\x08\x00"},
+		{8, 64, "\xfe\x08\x00"},
+		{8, 65, "\xee\x08\x00\x05\x08"},
+		{8, 66, "\xee\x08\x00\x09\x08"},
+		{8, 67, "\xee\x08\x00\x0d\x08"},
+		{8, 68, "\xfe\x08\x00\x01\x08"},
+		{8, 69, "\xfe\x08\x00\x05\x08"},
+		{8, 80, "\xfe\x08\x00\x3e\x08\x00"},
+
+		{256, 04, "\x21\x00"},
+		{256, 11, "\x3d\x00"},
+		{256, 12, "\x2e\x00\x01"},
+		{256, 13, "\x32\x00\x01"},
+		{256, 59, "\xea\x00\x01"},
+		{256, 60, "\xee\x00\x01"},
+		{256, 61, "\xf2\x00\x01"},
+		{256, 62, "\xf6\x00\x01"},
+		{256, 63, "\xfa\x00\x01"},
+		{256, 64, "\xfe\x00\x01"},
+		{256, 65, "\xee\x00\x01\x25\x00"},
+		{256, 66, "\xee\x00\x01\x29\x00"},
+		{256, 67, "\xee\x00\x01\x2d\x00"},
+		{256, 68, "\xfe\x00\x01\x21\x00"},
+		{256, 69, "\xfe\x00\x01\x25\x00"},
+		{256, 80, "\xfe\x00\x01\x3e\x00\x01"},
+
+		{2048, 04, "\x0e\x00\x08"},
+		{2048, 11, "\x2a\x00\x08"},
+		{2048, 12, "\x2e\x00\x08"},
+		{2048, 13, "\x32\x00\x08"},
+		{2048, 59, "\xea\x00\x08"},
+		{2048, 60, "\xee\x00\x08"},
+		{2048, 61, "\xf2\x00\x08"},
+		{2048, 62, "\xf6\x00\x08"},
+		{2048, 63, "\xfa\x00\x08"},
+		{2048, 64, "\xfe\x00\x08"},
+		{2048, 65, "\xee\x00\x08\x12\x00\x08"},
+		{2048, 66, "\xee\x00\x08\x16\x00\x08"},
+		{2048, 67, "\xee\x00\x08\x1a\x00\x08"},
+		{2048, 68, "\xfe\x00\x08\x0e\x00\x08"},
+		{2048, 69, "\xfe\x00\x08\x12\x00\x08"},
+		{2048, 80, "\xfe\x00\x08\x3e\x00\x08"},
+	}
+
+	dst := make([]byte, 1024)
+	for _, tc := range testCases {
+		n := emitCopy(dst, tc.offset, tc.length)
+		got := string(dst[:n])
+		if got != tc.want {
+			t.Errorf("offset=%d, length=%d:\ngot  % x\nwant % x", tc.offset, tc.length, got, tc.want)
+		}
+	}
+}
+
+func TestNewBufferedWriter(t *testing.T) {
+	// Test all 32 possible sub-sequences of these 5 input slices.
+	//
+	// Their lengths sum to 400,000, which is over 6 times the Writer ibuf
+	// capacity: 6 * maxBlockSize is 393,216.
+	inputs := [][]byte{
+		bytes.Repeat([]byte{'a'}, 40000),
+		bytes.Repeat([]byte{'b'}, 150000),
+		bytes.Repeat([]byte{'c'}, 60000),
+		bytes.Repeat([]byte{'d'}, 120000),
+		bytes.Repeat([]byte{'e'}, 30000),
+	}
+loop:
+	for i := 0; i < 1<<uint(len(inputs)); i++ {
+		var want []byte
+		buf := new(bytes.Buffer)
+		w := NewBufferedWriter(buf)
+		for j, input := range inputs {
+			if i&(1<<uint(j)) == 0 {
+				continue
+			}
+			if _, err := w.Write(input); err != nil {
+				t.Errorf("i=%#02x: j=%d: Write: %v", i, j, err)
+				continue loop
+			}
+			want = append(want, input...)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("i=%#02x: Close: %v", i, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(NewReader(buf))
+		if err != nil {
+			t.Errorf("i=%#02x: ReadAll: %v", i, err)
+			continue
+		}
+		if err := cmp(got, want); err != nil {
+			t.Errorf("i=%#02x: %v", i, err)
+			continue
+		}
+	}
+}
+
+func TestWriterOptions(t *testing.T) {
+	src := bytes.Repeat([]byte("Not all those who wander are lost;\n"), 10000)
+	testCases := []struct {
+		desc      string
+		opts      []WriterOption
+		wantErr   error
+		wantChunk int
+	}{
+		{"default", nil, nil, maxBlockSize},
+		{"small block", []WriterOption{BlockSize(1000)}, nil, 1000},
+		{"small block, small obuf", []WriterOption{BlockSize(1000), OutputBufferSize(obufHeaderLen + MaxEncodedLen(1000))}, nil, 1000},
+		{"small obuf, small block", []WriterOption{OutputBufferSize(obufHeaderLen + MaxEncodedLen(1000)), BlockSize(1000)}, nil, 1000},
+		{"large obuf", []WriterOption{OutputBufferSize(2 * obufLen)}, nil, maxBlockSize},
+		{"obuf too small", []WriterOption{OutputBufferSize(obufLen - 1)}, errOutputBufferTooSmall, 0},
+		{"obuf too small for block", []WriterOption{BlockSize(1000), OutputBufferSize(obufHeaderLen + MaxEncodedLen(999))}, errOutputBufferTooSmall, 0},
+		{"block too small", []WriterOption{BlockSize(0)}, errInvalidBlockSize, 0},
+		{"block too large", []WriterOption{BlockSize(maxBlockSize + 1)}, errInvalidBlockSize, 0},
+	}
+	for _, tc := range testCases {
+		buf := new(bytes.Buffer)
+		w := NewBufferedWriter(buf, tc.opts...)
+		_, err := w.Write(src)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != tc.wantErr {
+			t.Errorf("%s: got %v, want %v", tc.desc, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr != nil {
+			w.Reset(ioutil.Discard)
+			if err := w.Close(); err != tc.wantErr {
+				t.Errorf("%s: after Reset: got %v, want %v", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if got, want := cap(w.ibuf), tc.wantChunk; got != want {
+			t.Errorf("%s: ibuf capacity: got %d, want %d", tc.desc, got, want)
+		}
+		got, err := ioutil.ReadAll(NewReader(buf))
+		if err != nil {
+			t.Errorf("%s: ReadAll: %v", tc.desc, err)
+			continue
+		}
+		if err := cmp(got, src); err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+		}
+	}
+}
+
+func TestWriterComparisonEncoder(t *testing.T) {
+	src := append(bytes.Repeat([]byte("compressible "), 10000), make([]byte, 1000)...)
+	rand.New(rand.NewSource(1)).Read(src[len(src)-1000:])
+
+	var calls, total int
+	compare := func(p []byte) int {
+		calls++
+		total += len(p)
+		return len(p) / 3
+	}
+	plain, compared := new(bytes.Buffer), new(bytes.Buffer)
+	for _, tc := range []struct {
+		buf  *bytes.Buffer
+		opts []WriterOption
+	}{
+		{plain, nil},
+		{compared, []WriterOption{ComparisonEncoder(compare)}},
+	} {
+		w := NewBufferedWriter(tc.buf, tc.opts...)
+		if _, err := w.Write(src); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		stats := w.Stats()
+		wantBlocks := int64((len(src) + maxBlockSize - 1) / maxBlockSize)
+		if stats.Blocks != wantBlocks || stats.UncompressedBytes != int64(len(src)) {
+			t.Errorf("comparison=%t: got %d blocks of %d bytes, want %d blocks of %d bytes",
+				tc.opts != nil, stats.Blocks, stats.UncompressedBytes, wantBlocks, len(src))
+		}
+		if stats.CompressedBytes <= 0 || stats.CompressedBytes >= int64(len(src)) {
+			t.Errorf("comparison=%t: CompressedBytes: got %d", tc.opts != nil, stats.CompressedBytes)
+		}
+		if tc.opts == nil {
+			if stats.ComparisonBytes != 0 || stats.EncodeTime != 0 || stats.ComparisonTime != 0 {
+				t.Errorf("comparison=false: got %+v, want no comparison", stats)
+			}
+			continue
+		}
+		if int64(calls) != stats.Blocks || total != len(src) {
+			t.Errorf("comparison=true: got %d calls on %d bytes, want %d calls on %d bytes",
+				calls, total, stats.Blocks, len(src))
+		}
+		// Each block is 65536 bytes, except for the last, so the rounding of
+		// len(p)/3 only affects the last one.
+		if want := int64(len(src)/maxBlockSize*(maxBlockSize/3) + len(src)%maxBlockSize/3); stats.ComparisonBytes != want {
+			t.Errorf("comparison=true: ComparisonBytes: got %d, want %d", stats.ComparisonBytes, want)
+		}
+		w.Reset(ioutil.Discard)
+		if stats := w.Stats(); stats != (WriterStats{}) {
+			t.Errorf("after Reset: got %+v, want zero stats", stats)
+		}
+	}
+	if !bytes.Equal(plain.Bytes(), compared.Bytes()) {
+		t.Error("the ComparisonEncoder option changed the output")
+	}
+}
+
+func TestWriterBlockDeadline(t *testing.T) {
+	src := bytes.Repeat([]byte("a deadline for every block "), 20000)
+	for _, tc := range []struct {
+		deadline time.Duration
+		timedOut bool
+	}{
+		{time.Hour, false},
+		{time.Nanosecond, true},
+	} {
+		buf := new(bytes.Buffer)
+		w := NewBufferedWriter(buf, BlockDeadline(tc.deadline))
+		if _, err := w.Write(src); err != nil {
+			t.Fatalf("deadline=%v: Write: %v", tc.deadline, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("deadline=%v: Close: %v", tc.deadline, err)
+		}
+		got, err := DecodeFramed(buf.Bytes())
+		if err != nil {
+			t.Fatalf("deadline=%v: DecodeFramed: %v", tc.deadline, err)
+		}
+		if err := cmp(got, src); err != nil {
+			t.Fatalf("deadline=%v: %v", tc.deadline, err)
+		}
+		stats := w.Stats()
+		if !tc.timedOut {
+			if stats.TimedOut != 0 {
+				t.Errorf("deadline=%v: %d blocks timed out", tc.deadline, stats.TimedOut)
+			}
+			if want := EncodeFramed(src); !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("deadline=%v: output differs from EncodeFramed", tc.deadline)
+			}
+		} else if stats.TimedOut == 0 {
+			t.Errorf("deadline=%v: no blocks timed out", tc.deadline)
+		}
+	}
+	if err := NewBufferedWriter(ioutil.Discard, BlockDeadline(0)).Close(); err != errInvalidDeadline {
+		t.Errorf("zero deadline: got %v, want %v", err, errInvalidDeadline)
+	}
+}
+
+func TestAdaptiveBlockSize(t *testing.T) {
+	blockLens := func(framed []byte) (lens []int) {
+		d := NewStreamDecoder()
+		d.Feed(framed)
+		for {
+			block, ok := d.Next()
+			if !ok {
+				break
+			}
+			lens = append(lens, len(block))
+		}
+		if err := d.Err(); err != nil {
+			t.Fatalf("StreamDecoder: %v", err)
+		}
+		return lens
+	}
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 200000)
+	rng.Read(random)
+	text := bytes.Repeat([]byte("a compressible line of text\n"), 10000)
+
+	testCases := []struct {
+		desc         string
+		src          []byte
+		min, max     int
+		wantLastFull int
+	}{
+		{"incompressible", random, 1024, maxBlockSize, 1024},
+		{"compressible", text, 1024, maxBlockSize, maxBlockSize},
+		{"fixed", random, 4096, 4096, 4096},
+	}
+	for _, tc := range testCases {
+		buf := new(bytes.Buffer)
+		w := NewBufferedWriter(buf, AdaptiveBlockSize(tc.min, tc.max))
+		for p := tc.src; len(p) > 0; {
+			n := 100
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatalf("%s: Write: %v", tc.desc, err)
+			}
+			p = p[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", tc.desc, err)
+		}
+		lens := blockLens(buf.Bytes())
+		for _, n := range lens {
+			if n > tc.max {
+				t.Fatalf("%s: block of %d bytes exceeds max %d", tc.desc, n, tc.max)
+			}
+		}
+		// Blocks are flushed by the Write that takes them past the target.
+		if len(lens) < 2 || lens[len(lens)-2] < tc.wantLastFull || lens[len(lens)-2] >= tc.wantLastFull+100 {
+			t.Errorf("%s: block sizes %v, want the last full one to be %d, give or take a Write", tc.desc, lens, tc.wantLastFull)
+		}
+		got, err := DecodeFramed(buf.Bytes())
+		if err != nil || !bytes.Equal(got, tc.src) {
+			t.Errorf("%s: round trip failed: %v", tc.desc, err)
+		}
+	}
+
+	for _, opts := range [][]WriterOption{
+		{AdaptiveBlockSize(0, 100)},
+		{AdaptiveBlockSize(200, 100)},
+		{AdaptiveBlockSize(1, maxBlockSize+1)},
+		{AdaptiveBlockSize(1000, 2000), BlockSize(500)},
+	} {
+		if err := NewBufferedWriter(ioutil.Discard, opts...).Close(); err != errInvalidBlockSize {
+			t.Errorf("got %v, want %v", err, errInvalidBlockSize)
+		}
+	}
+}
+
+func TestAutoFlushBytes(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf, AutoFlushBytes(100))
+	var want []byte
+	for i := 0; i < 20; i++ {
+		p := bytes.Repeat([]byte{'a' + byte(i)}, 30)
+		n := buf.Len()
+		if _, err := w.Write(p); err != nil {
+			t.Fatalf("#%d: Write: %v", i, err)
+		}
+		want = append(want, p...)
+		// Every fourth Write takes the buffered byte count to at least 100.
+		if flushed := buf.Len() != n; flushed != (i%4 == 3) {
+			t.Fatalf("#%d: flushed: got %t, want %t", i, flushed, i%4 == 3)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	got, err := ioutil.ReadAll(NewReader(buf))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := cmp(got, want); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{0, maxBlockSize + 1} {
+		if err := NewBufferedWriter(ioutil.Discard, AutoFlushBytes(n)).Close(); err != errInvalidAutoFlush {
+			t.Errorf("n=%d: got %v, want %v", n, err, errInvalidAutoFlush)
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestBufferedWriterTimed(t *testing.T) {
+	buf := new(lockedBuffer)
+	w := NewBufferedWriterTimed(buf, 10*time.Millisecond)
+	if _, err := w.Write([]byte("hello ")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := w.Write([]byte("world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(buf.Bytes()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the background flush")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	got, err := ioutil.ReadAll(NewReader(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("after the background flush: got %q, want %q", got, "hello world")
+	}
+
+	if _, err := w.Write([]byte("!")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	got, err = ioutil.ReadAll(NewReader(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello world!" {
+		t.Fatalf("after Close: got %q, want %q", got, "hello world!")
+	}
+	if _, err := w.Write([]byte("?")); err != errClosed {
+		t.Fatalf("Write after Close: got %v, want %v", err, errClosed)
+	}
+}
+
+func TestSyncWriter(t *testing.T) {
+	const (
+		numGoroutines = 8
+		numRecords    = 500
+	)
+	buf := new(bytes.Buffer)
+	w := NewSyncWriter(buf)
+	var wg sync.WaitGroup
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < numRecords; i++ {
+				// Each record is larger than one block, every so often.
+				n := 10
+				if i%100 == 0 {
+					n = maxBlockSize / 4
+				}
+				record := fmt.Sprintf("<%d:%d:%s>", g, i, strings.Repeat("x", n))
+				if _, err := w.Write([]byte(record)); err != nil {
+					t.Errorf("Write: %v", err)
+					return
+				}
+				if i%50 == 0 {
+					w.Flush()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(NewReader(buf))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	next := make([]int, numGoroutines)
+	for _, record := range strings.SplitAfter(string(got), ">") {
+		if record == "" {
+			continue
+		}
+		var g, i int
+		if _, err := fmt.Sscanf(record, "<%d:%d:", &g, &i); err != nil {
+			t.Fatalf("malformed record %.40q: %v", record, err)
+		}
+		if g < 0 || g >= numGoroutines || i != next[g] {
+			t.Fatalf("out of order record %.40q", record)
+		}
+		next[g]++
+	}
+	for g, n := range next {
+		if n != numRecords {
+			t.Errorf("goroutine %d: got %d records, want %d", g, n, numRecords)
+		}
+	}
+}
+
+func TestReaderNextChunk(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	w.Write(bytes.Repeat([]byte("compressible "), 100))
+	w.Flush()
+	w.PadTo(64)
+	w.Write([]byte("tiny"))
+	w.Close()
+
+	r := NewReader(buf)
+	var got []string
+	for {
+		chunkType, body, err := r.NextChunk()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextChunk: %v", err)
+		}
+		switch chunkType {
+		case chunkTypeCompressedData, chunkTypeUncompressedData:
+			data := body[checksumSize:]
+			if chunkType == chunkTypeCompressedData {
+				var err error
+				if data, err = Decode(nil, data); err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+			}
+			if crc(data) != binary.LittleEndian.Uint32(body) {
+				t.Fatalf("chunk type %#x: bad checksum", chunkType)
+			}
+			got = append(got, fmt.Sprintf("%#x:%d", chunkType, len(data)))
+		default:
+			got = append(got, fmt.Sprintf("%#x", chunkType))
+		}
+	}
+	if got, want := strings.Join(got, " "), "0xff 0x0:1300 0xfe 0x1:4"; got != want {
+		t.Fatalf("got chunks %q, want %q", got, want)
+	}
+}
+
+func TestReaderAllowReserved(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	w.Write([]byte("before"))
+	w.Flush()
+	buf.Write([]byte{0x42, 0x03, 0x00, 0x00, 'e', 'x', 't'})
+	w.Write([]byte(" after"))
+	w.Close()
+	framed := buf.Bytes()
+
+	r := NewReader(bytes.NewReader(framed))
+	if _, err := ioutil.ReadAll(r); err != ErrUnsupported {
+		t.Fatalf("default: got %v, want %v", err, ErrUnsupported)
+	}
+
+	r.SetAllowReserved(true)
+	r.Reset(bytes.NewReader(framed))
+	got, err := ioutil.ReadAll(r)
+	if err != nil || string(got) != "before after" {
+		t.Fatalf("allowed, no handler: got %q, %v", got, err)
+	}
+
+	var seen []string
+	r.SetReservedChunkHandler(func(chunkType byte, body []byte) error {
+		seen = append(seen, fmt.Sprintf("%#x:%s", chunkType, body))
+		return nil
+	})
+	r.Reset(bytes.NewReader(framed))
+	got, err = ioutil.ReadAll(r)
+	if err != nil || string(got) != "before after" {
+		t.Fatalf("allowed, with handler: got %q, %v", got, err)
+	}
+	if len(seen) != 1 || seen[0] != "0x42:ext" {
+		t.Fatalf("handler saw %q, want [\"0x42:ext\"]", seen)
+	}
+
+	errStop := errors.New("stop")
+	r.SetReservedChunkHandler(func(byte, []byte) error { return errStop })
+	r.Reset(bytes.NewReader(framed))
+	if _, err := ioutil.ReadAll(r); err != errStop {
+		t.Fatalf("failing handler: got %v, want %v", err, errStop)
+	}
+}
+
+func TestReaderSetMaxReadSize(t *testing.T) {
+	src := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(src[:100000])
+	encoded := EncodeFramed(src)
+
+	r := NewReader(bytes.NewReader(encoded))
+	r.SetMaxReadSize(1000)
+	var got []byte
+	buf := make([]byte, 65536)
+	for {
+		n, err := r.Read(buf)
+		if n > 1000 {
+			t.Fatalf("Read returned %d bytes, want at most 1000", n)
+		}
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if err := cmp(got, src); err != nil {
+		t.Fatal(err)
+	}
+
+	// The setting survives Reset, and zero restores the default.
+	r.Reset(bytes.NewReader(encoded))
+	if n, err := r.Read(buf); n != 1000 || err != nil {
+		t.Fatalf("after Reset: got %d, %v, want 1000, nil", n, err)
+	}
+	r.SetMaxReadSize(0)
+	if n, err := r.Read(buf); n != maxBlockSize-1000 || err != nil {
+		t.Fatalf("after SetMaxReadSize(0): got %d, %v, want %d, nil", n, err, maxBlockSize-1000)
+	}
+}
+
+func TestWindowedReader(t *testing.T) {
+	tDir := filepath.FromSlash(*testdataDir)
+	text, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	periodic := bytes.Repeat([]byte("0123456789"), 20000)
+
+	for _, tc := range []struct {
+		desc   string
+		src    []byte
+		window int
+	}{
+		{"text", text, maxBlockSize},
+		{"random", random, maxBlockSize},
+		{"periodic", periodic, 100},
+		{"periodic", periodic, 10},
+		{"empty", nil, 1},
+	} {
+		encoded := EncodeFramed(tc.src)
+		for _, bufSize := range []int{1, 7, 4096, 1 << 20} {
+			r := NewWindowedReader(bytes.NewReader(encoded), tc.window)
+			var got []byte
+			buf := make([]byte, bufSize)
+			for {
+				n, err := r.Read(buf)
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("%s, window=%d, bufSize=%d: Read: %v", tc.desc, tc.window, bufSize, err)
+				}
+			}
+			if err := cmp(got, tc.src); err != nil {
+				t.Fatalf("%s, window=%d, bufSize=%d: %v", tc.desc, tc.window, bufSize, err)
+			}
+		}
+	}
+
+	// Text has copies from further back than a small window allows.
+	if _, err := ioutil.ReadAll(NewWindowedReader(bytes.NewReader(EncodeFramed(text)), 100)); err != ErrUnsupported {
+		t.Errorf("small window: got %v, want %v", err, ErrUnsupported)
+	}
+	if _, err := NewWindowedReader(bytes.NewReader(nil), 0).Read(make([]byte, 1)); err == nil {
+		t.Error("zero window: got nil error")
+	}
+
+	// Damaged streams fail as they do with a Reader.
+	encoded := EncodeFramed(text)
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		damaged := append([]byte(nil), encoded...)
+		if i%2 == 0 {
+			damaged = damaged[:rng.Intn(len(damaged))]
+		} else {
+			damaged[rng.Intn(len(damaged))] ^= byte(1 + rng.Intn(255))
+		}
+		_, wantErr := ioutil.ReadAll(NewReader(bytes.NewReader(damaged)))
+		_, gotErr := ioutil.ReadAll(NewWindowedReader(bytes.NewReader(damaged), maxBlockSize))
+		if gotErr != wantErr {
+			t.Errorf("damaged stream #%d: got %v, want %v", i, gotErr, wantErr)
+		}
+	}
+}
+
+func TestPrefetchReader(t *testing.T) {
+	tDir := filepath.FromSlash(*testdataDir)
+	text, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	src := bytes.Repeat(text, 20)
+	encoded := new(bytes.Buffer)
+	w := NewBufferedWriter(encoded, BlockSize(10000))
+	w.Write(src)
+	w.Close()
+
+	for _, depth := range []int{0, 1, 4, 100} {
+		r := NewPrefetchReader(iotest.HalfReader(bytes.NewReader(encoded.Bytes())), depth)
+		got, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Fatalf("depth=%d: ReadAll: %v", depth, err)
+		}
+		if err := cmp(got, src); err != nil {
+			t.Fatalf("depth=%d: %v", depth, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("depth=%d: Close: %v", depth, err)
+		}
+	}
+
+	// Errors are reported after the blocks that precede them.
+	damaged := append([]byte(nil), encoded.Bytes()...)
+	damaged[len(damaged)-100] ^= 0xff
+	wantGot, wantErr := ioutil.ReadAll(NewReader(bytes.NewReader(damaged)))
+	got, err := ioutil.ReadAll(NewPrefetchReader(bytes.NewReader(damaged), 2))
+	if err != wantErr || !bytes.Equal(got, wantGot) {
+		t.Errorf("damaged: got %d bytes and %v, want %d bytes and %v", len(got), err, len(wantGot), wantErr)
+	}
+
+	// Closing stops the reading ahead.
+	cr := &countingReader{r: bytes.NewReader(encoded.Bytes())}
+	r := NewPrefetchReader(cr, 1)
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	r.Close()
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Error("Read after Close: got nil error")
+	}
+	time.Sleep(10 * time.Millisecond)
+	n := cr.n()
+	time.Sleep(10 * time.Millisecond)
+	if cr.n() != n || n == int64(encoded.Len()) {
+		t.Errorf("after Close: %d of %d bytes read, and counting", cr.n(), encoded.Len())
+	}
+}
+
+// countingReader counts the bytes read from r, safely for concurrent use.
+type countingReader struct {
+	mu    sync.Mutex
+	r     io.Reader
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.mu.Lock()
+	c.count += int64(n)
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *countingReader) n() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
+
+func TestReaderSectionReader(t *testing.T) {
+	src := bytes.Repeat([]byte("embedded stream "), 10000)
+	stream := EncodeFramed(src)
+	header, trailer := []byte("HEADER"), []byte("TRAILER, which is not a chunk")
+	file := bytes.NewReader(append(append(append([]byte(nil), header...), stream...), trailer...))
+
+	sr := io.NewSectionReader(file, int64(len(header)), int64(len(stream)))
+	got, err := ioutil.ReadAll(NewReader(sr))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := cmp(got, src); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the SectionReader, reading exactly the decoded length consumes
+	// exactly the stream, leaving the trailer to be read next.
+	file.Seek(int64(len(header)), io.SeekStart)
+	if _, err := io.ReadFull(NewReader(file), make([]byte, len(src))); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	rest, _ := ioutil.ReadAll(file)
+	if !bytes.Equal(rest, trailer) {
+		t.Errorf("after the stream: got %q, want %q", rest, trailer)
+	}
+}
+
+func TestReaderNoChecksumFormat(t *testing.T) {
+	compressible := bytes.Repeat([]byte("no checksums here "), 1000)
+	incompressible := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+
+	var stream []byte
+	appendChunk := func(chunkType byte, body []byte) {
+		n := len(body)
+		stream = append(stream, chunkType, byte(n), byte(n>>8), byte(n>>16))
+		stream = append(stream, body...)
+	}
+	stream = append(stream, magicChunk...)
+	appendChunk(chunkTypeCompressedData, Encode(nil, compressible))
+	appendChunk(chunkTypeUncompressedData, incompressible)
+	appendChunk(chunkTypeUncompressedData, nil)
+	appendChunk(chunkTypePadding, make([]byte, 10))
+	want := append(append([]byte(nil), compressible...), incompressible...)
+
+	r := NewReader(bytes.NewReader(stream))
+	r.SetNoChecksumFormat(true)
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := cmp(got, want); err != nil {
+		t.Fatal(err)
+	}
+
+	// The setting survives Reset, and the standard format rejects the stream.
+	r.Reset(bytes.NewReader(stream))
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("after Reset: got %d bytes, %v", len(got), err)
+	}
+	r.SetNoChecksumFormat(false)
+	r.Reset(bytes.NewReader(stream))
+	if _, err := ioutil.ReadAll(r); err != ErrCorrupt {
+		t.Errorf("standard format: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestReaderDiscard(t *testing.T) {
+	src := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(src)
+	copy(src[100000:], bytes.Repeat([]byte("skip me "), 10000))
+	encoded := EncodeFramed(src)
+
+	r := NewReader(bytes.NewReader(encoded))
+	pos := 0
+	buf := make([]byte, 1000)
+	for _, n := range []int{0, 10, maxBlockSize, 2*maxBlockSize + 5, 1} {
+		if got, err := r.Discard(n); got != n || err != nil {
+			t.Fatalf("Discard(%d) at %d: got %d, %v", n, pos, got, err)
+		}
+		pos += n
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("ReadFull at %d: %v", pos, err)
+		}
+		if !bytes.Equal(buf, src[pos:pos+len(buf)]) {
+			t.Fatalf("ReadFull at %d: wrong data", pos)
+		}
+		pos += len(buf)
+	}
+	if got, err := r.Discard(len(src)); got != len(src)-pos || err != io.EOF {
+		t.Errorf("Discard past the end: got %d, %v, want %d, %v", got, err, len(src)-pos, io.EOF)
+	}
+
+	// Damage is still detected.
+	damaged := append([]byte(nil), encoded...)
+	damaged[len(damaged)-1] ^= 1
+	r.Reset(bytes.NewReader(damaged))
+	if _, err := r.Discard(len(src)); err != ErrCorrupt {
+		t.Errorf("damaged: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestReaderUnreadBlock(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	w.Write([]byte("first block"))
+	w.Flush()
+	w.Write([]byte("second block"))
+	w.Close()
+
+	r := NewReader(buf)
+	if err := r.UnreadBlock(); err != ErrInvalidUnreadBlock {
+		t.Fatalf("before Read: got %v, want %v", err, ErrInvalidUnreadBlock)
+	}
+	p := make([]byte, 5)
+	if n, _ := r.Read(p); string(p[:n]) != "first" {
+		t.Fatalf("Read: got %q, want %q", p[:n], "first")
+	}
+	if err := r.UnreadBlock(); err != nil {
+		t.Fatalf("UnreadBlock: %v", err)
+	}
+	if err := r.UnreadBlock(); err != ErrInvalidUnreadBlock {
+		t.Fatalf("UnreadBlock twice: got %v, want %v", err, ErrInvalidUnreadBlock)
+	}
+	p = make([]byte, 100)
+	if n, _ := r.Read(p); string(p[:n]) != "first block" {
+		t.Fatalf("Read after UnreadBlock: got %q, want %q", p[:n], "first block")
+	}
+	if n, _ := r.Read(p); string(p[:n]) != "second block" {
+		t.Fatalf("Read: got %q, want %q", p[:n], "second block")
+	}
+	if err := r.UnreadBlock(); err != nil {
+		t.Fatalf("UnreadBlock: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || string(got) != "second block" {
+		t.Fatalf("ReadAll after UnreadBlock: got %q, %v, want %q, nil", got, err, "second block")
+	}
+	if err := r.UnreadBlock(); err != ErrInvalidUnreadBlock {
+		t.Fatalf("at EOF: got %v, want %v", err, ErrInvalidUnreadBlock)
+	}
+}
+
+func TestNewAutoReader(t *testing.T) {
+	src := bytes.Repeat([]byte("framed or raw? "), 10000)
+	testCases := []struct {
+		desc    string
+		input   []byte
+		want    []byte
+		wantErr error
+	}{
+		{"framed", EncodeFramed(src), src, nil},
+		{"framed, empty", EncodeFramed(nil), []byte{}, nil},
+		{"raw", Encode(nil, src), src, nil},
+		{"raw, empty", Encode(nil, nil), []byte{}, nil},
+		{"raw, truncated", Encode(nil, src)[:100], nil, ErrCorrupt},
+		{"framed, truncated header", EncodeFramed(src)[:9], nil, ErrCorrupt},
+		{"nothing", nil, nil, ErrCorrupt},
+	}
+	for _, tc := range testCases {
+		r, err := NewAutoReader(bytes.NewReader(tc.input))
+		if err != tc.wantErr {
+			t.Errorf("%s: NewAutoReader: got %v, want %v", tc.desc, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: ReadAll: %v", tc.desc, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: decoded bytes differ", tc.desc)
+		}
+	}
+
+	// No block starts with a stream identifier: its bytes decode as a one-byte
+	// literal, then a copy whose offset reaches back too far.
+	if _, err := Decode(nil, []byte(magicChunk+strings.Repeat("\x00", 1000))); err != ErrCorrupt {
+		t.Errorf("block starting with magicChunk: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestNewReadCloser(t *testing.T) {
+	src := []byte("closing time\n")
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	w.Write(src)
+	w.Close()
+
+	cc := &closeCounter{Reader: buf}
+	rc := NewReadCloser(cc)
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Fatalf("got %q, want %q", got, src)
+	}
+	if cc.closed != 0 {
+		t.Fatalf("source closed before Close")
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if cc.closed != 1 {
+		t.Fatalf("source closed %d times, want 1", cc.closed)
+	}
+}
+
+func TestReaderBufio(t *testing.T) {
+	src := make([]byte, 3*maxBlockSize+123)
+	rng := rand.New(rand.NewSource(1))
+	for i := range src {
+		src[i] = byte(rng.Intn(4)) + 'a'
+	}
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	for i := 0; i < len(src); i += 1000 {
+		j := i + 1000
+		if j > len(src) {
+			j = len(src)
+		}
+		w.Write(src[i:j])
+		w.Flush()
+	}
+	w.Close()
+	framed := append(buf.Bytes(), "trailer"...)
+
+	// Some chunks fit in the smallest bufio.Reader, and some do not.
+	for _, size := range []int{16, 4096, 1 << 20} {
+		br := bufio.NewReaderSize(bytes.NewReader(framed), size)
+		r := NewReader(br)
+		got := make([]byte, len(src))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("size=%d: ReadFull: %v", size, err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Fatalf("size=%d: decoded bytes differ", size)
+		}
+		// The Reader should not have consumed anything past the last chunk.
+		rest, err := ioutil.ReadAll(br)
+		if err != nil {
+			t.Fatalf("size=%d: ReadAll: %v", size, err)
+		}
+		if string(rest) != "trailer" {
+			t.Fatalf("size=%d: trailing bytes: got %q, want %q", size, rest, "trailer")
+		}
+	}
+}
+
+func TestWriterTerminator(t *testing.T) {
+	src := bytes.Repeat([]byte("durable queue entry\n"), 10000)
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriterWithTerminator(buf, BlockSize(4096))
+	if _, err := w.Write(src); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	framed := buf.Bytes()
+
+	// Readers that do not require the terminator skip it.
+	got, err := ioutil.ReadAll(NewReader(bytes.NewReader(framed)))
+	if err != nil {
+		t.Fatalf("ReadAll without requirement: %v", err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Fatal("ReadAll without requirement: decoded bytes differ")
+	}
+
+	r := NewReader(nil)
+	r.SetRequireTerminator(true)
+	r.Reset(bytes.NewReader(framed))
+	got, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll with requirement: %v", err)
+	}
+	if !bytes.Equal(got, src) {
+		t.Fatal("ReadAll with requirement: decoded bytes differ")
+	}
+
+	// Cutting the stream at any chunk boundary must be detected.
+	for n := 0; n < len(framed); {
+		r.Reset(bytes.NewReader(framed[:n]))
+		if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+			t.Fatalf("truncated to %d bytes: got %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+		n += chunkHeaderSize + (int(framed[n+1]) | int(framed[n+2])<<8 | int(framed[n+3])<<16)
+	}
+
+	// An empty stream is terminated too.
+	buf.Reset()
+	if err := NewBufferedWriterWithTerminator(buf).Close(); err != nil {
+		t.Fatalf("Close empty: %v", err)
+	}
+	r.Reset(buf)
+	if got, err := ioutil.ReadAll(r); err != nil || len(got) != 0 {
+		t.Fatalf("ReadAll empty: got %q, %v", got, err)
+	}
+}
+
+func TestWriterPending(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf, BlockSize(100))
+	if got := w.BlockSize(); got != 100 {
+		t.Fatalf("BlockSize: got %d, want 100", got)
+	}
+	testCases := []struct {
+		n, wantPending int
+	}{
+		{30, 30},
+		{60, 90},
+		{10, 100},
+		{1, 1},
+		{120, 21},
+		{45, 66},
+	}
+	for _, tc := range testCases {
+		w.Write(make([]byte, tc.n))
+		if got := w.Pending(); got != tc.wantPending {
+			t.Fatalf("after writing %d bytes: Pending: got %d, want %d", tc.n, got, tc.wantPending)
+		}
+		if got := w.Available(); got != 100-tc.wantPending {
+			t.Fatalf("after writing %d bytes: Available: got %d, want %d", tc.n, got, 100-tc.wantPending)
+		}
+	}
+	w.Flush()
+	if got := w.Pending(); got != 0 {
+		t.Fatalf("after Flush: Pending: got %d, want 0", got)
+	}
+
+	u := NewWriter(buf)
+	u.Write(make([]byte, 10))
+	if got := u.Pending(); got != 0 {
+		t.Fatalf("unbuffered: Pending: got %d, want 0", got)
+	}
+	if got := u.Available(); got != 0 {
+		t.Fatalf("unbuffered: Available: got %d, want 0", got)
+	}
+	if got := u.BlockSize(); got != maxBlockSize {
+		t.Fatalf("unbuffered: BlockSize: got %d, want %d", got, maxBlockSize)
+	}
+}
+
+func TestWriterVerifyRoundTrip(t *testing.T) {
+	src := bytes.Repeat([]byte("cold storage, warm heart\n"), 20000)
+	want := new(bytes.Buffer)
+	w := NewBufferedWriter(want)
+	w.Write(src)
+	w.Close()
+
+	got := new(bytes.Buffer)
+	w = NewBufferedWriter(got, VerifyRoundTrip())
+	if _, err := w.Write(src); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatal("verifying Writer's output differs")
+	}
+
+	uncompressed := src[:1000]
+	compressed := Encode(nil, uncompressed)
+	if !w.roundTrips(compressed, uncompressed) {
+		t.Fatal("roundTrips: got false for a valid block")
+	}
+	compressed[len(compressed)-1] ^= 1
+	if w.roundTrips(compressed, uncompressed) {
+		t.Fatal("roundTrips: got true for a corrupted block")
+	}
+
+	err := error(&RoundTripError{Offset: 131072})
+	if got, want := err.Error(), "snappy: encoded block at offset 131072 does not round-trip"; got != want {
+		t.Fatalf("Error: got %q, want %q", got, want)
+	}
+}
+
+func TestWriterPadTo(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, alignment := range []int{1, 2, 3, 5, 512, 4096} {
+		buf := new(bytes.Buffer)
+		w := NewBufferedWriter(buf)
+		var src []byte
+		for i := 0; i < 20; i++ {
+			p := make([]byte, rng.Intn(10000))
+			for j := range p {
+				p[j] = "abc"[rng.Intn(3)]
+			}
+			src = append(src, p...)
+			w.Write(p)
+			if err := w.PadTo(alignment); err != nil {
+				t.Fatalf("alignment=%d: PadTo: %v", alignment, err)
+			}
+			if buf.Len()%alignment != 0 {
+				t.Fatalf("alignment=%d: output length %d is not aligned", alignment, buf.Len())
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("alignment=%d: Close: %v", alignment, err)
+		}
+		got, err := ioutil.ReadAll(NewReader(buf))
+		if err != nil {
+			t.Fatalf("alignment=%d: ReadAll: %v", alignment, err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Fatalf("alignment=%d: decoded bytes differ", alignment)
+		}
+	}
+
+	w := NewBufferedWriter(ioutil.Discard)
+	for _, alignment := range []int{0, -1, 1<<24 + 1} {
+		if err := w.PadTo(alignment); err != errInvalidAlignment {
+			t.Errorf("alignment=%d: got %v, want %v", alignment, err, errInvalidAlignment)
+		}
+	}
+
+	// Padding longer than the Writer's output buffer is written in pieces.
+	prefix := new(bytes.Buffer)
+	w = NewBufferedWriter(prefix)
+	w.Write([]byte("x"))
+	w.Flush()
+	buf := new(bytes.Buffer)
+	w.Reset(buf)
+	w.Write([]byte("x"))
+	if err := w.PadTo(1 << 20); err != nil {
+		t.Fatalf("large padding: PadTo: %v", err)
+	}
+	want := make([]byte, 1<<20)
+	copy(want, prefix.Bytes())
+	putChunkHeader(want[prefix.Len():], chunkTypePadding, 1<<20-prefix.Len()-chunkHeaderSize)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("large padding: got %d bytes, not the expected padding chunk", buf.Len())
+	}
+
+	// Even the largest padding is written without allocating it.
+	w.Reset(ioutil.Discard)
+	x := []byte("x")
+	if n := testing.AllocsPerRun(10, func() {
+		w.Write(x)
+		if err := w.PadTo(maxPadAlignment); err != nil {
+			t.Fatalf("PadTo: %v", err)
+		}
+	}); n != 0 {
+		t.Errorf("got %v allocations, want 0", n)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	defer w.Close()
+	if _, err := w.Write(bytes.Repeat([]byte{'x'}, 20)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n := buf.Len(); n != 0 {
+		t.Fatalf("before Flush: %d bytes were written to the underlying io.Writer, want 0", n)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if n := buf.Len(); n == 0 {
+		t.Fatalf("after Flush: %d bytes were written to the underlying io.Writer, want non-0", n)
+	}
+}
+
+func TestEncodeFramedReader(t *testing.T) {
+	src := bytes.Repeat([]byte("tiny reads, big blocks. "), 10000)
+	for _, r := range []io.Reader{
+		bytes.NewReader(src),
+		iotest.OneByteReader(bytes.NewReader(src)),
+		iotest.DataErrReader(bytes.NewReader(src)),
+	} {
+		got, err := EncodeFramedReader(r)
+		if err != nil {
+			t.Fatalf("%T: EncodeFramedReader: %v", r, err)
+		}
+		if want := EncodeFramed(src); !bytes.Equal(got, want) {
+			t.Errorf("%T: output differs from EncodeFramed", r)
+		}
+	}
+
+	errBroken := errors.New("broken reader")
+	r := io.MultiReader(bytes.NewReader(src), iotest.ErrReader(errBroken))
+	if _, err := EncodeFramedReader(r); err != errBroken {
+		t.Errorf("failing reader: got %v, want %v", err, errBroken)
+	}
+}
+
+func TestTranscodeFromReader(t *testing.T) {
+	src := make([]byte, 5*maxBlockSize+17)
+	rng := rand.New(rand.NewSource(1))
+	for i := range src {
+		src[i] = "abcdefgh"[rng.Intn(8)]
+	}
+	want := new(bytes.Buffer)
+	w := NewBufferedWriter(want)
+	w.Write(src)
+	w.Close()
+
+	gz := new(bytes.Buffer)
+	zw := gzip.NewWriter(gz)
+	zw.Write(src)
+	zw.Close()
+
+	readers := map[string]func() io.Reader{
+		"bytes": func() io.Reader { return bytes.NewReader(src) },
+		"gzip": func() io.Reader {
+			zr, err := gzip.NewReader(bytes.NewReader(gz.Bytes()))
+			if err != nil {
+				t.Fatalf("gzip.NewReader: %v", err)
+			}
+			return zr
+		},
+		"half":     func() io.Reader { return iotest.HalfReader(bytes.NewReader(src)) },
+		"data+err": func() io.Reader { return iotest.DataErrReader(bytes.NewReader(src)) },
+	}
+	for name, newReader := range readers {
+		got := new(bytes.Buffer)
+		if err := TranscodeFromReader(got, newReader()); err != nil {
+			t.Errorf("%s: TranscodeFromReader: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("%s: output differs from that of Write", name)
+		}
+	}
+
+	errBoom := errors.New("boom")
+	r := io.MultiReader(bytes.NewReader(src[:1000]), iotest.ErrReader(errBoom))
+	if err := TranscodeFromReader(ioutil.Discard, r); err != errBoom {
+		t.Errorf("failing reader: got %v, want %v", err, errBoom)
+	}
+
+	// io.Copy uses ReadFrom, including for unbuffered Writers.
+	for _, buffered := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+		if buffered {
+			w = NewBufferedWriter(buf)
+		}
+		if _, err := io.Copy(w, iotest.OneByteReader(bytes.NewReader(src[:3000]))); err != nil {
+			t.Fatalf("buffered=%t: io.Copy: %v", buffered, err)
+		}
+		w.Close()
+		got, err := ioutil.ReadAll(NewReader(buf))
+		if err != nil {
+			t.Fatalf("buffered=%t: ReadAll: %v", buffered, err)
+		}
+		if !bytes.Equal(got, src[:3000]) {
+			t.Fatalf("buffered=%t: decoded bytes differ", buffered)
+		}
+	}
+}
+
+func TestMaxFramedLen(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 100, maxBlockSize - 1, maxBlockSize, maxBlockSize + 1, 5*maxBlockSize + 7} {
+		// Random bytes do not compress, so they reach the maximum.
+		src := make([]byte, n)
+		rng.Read(src)
+		if got, want := len(EncodeFramed(src)), MaxFramedLen(n); got != want {
+			t.Errorf("n=%d, random: got %d bytes, want MaxFramedLen = %d", n, got, want)
+		}
+		if got, max := len(EncodeFramed(make([]byte, n))), MaxFramedLen(n); got > max {
+			t.Errorf("n=%d, zeroes: got %d bytes, want at most %d", n, got, max)
+		}
+	}
+	maxInt := int(^uint(0) >> 1)
+	for _, n := range []int{-1, maxInt, maxInt - 100} {
+		if got := MaxFramedLen(n); got != -1 {
+			t.Errorf("n=%d: got %d, want -1", n, got)
+		}
+	}
+}
+
+func TestEncodeFramed(t *testing.T) {
+	for _, n := range []int{0, 1, 100, maxBlockSize, 3*maxBlockSize + 1} {
+		src := make([]byte, n)
+		for i := range src {
+			src[i] = "xyz"[i%3]
+		}
+		if n == maxBlockSize {
+			rand.New(rand.NewSource(1)).Read(src)
+		}
+		want := new(bytes.Buffer)
+		w := NewBufferedWriter(want)
+		w.Write(src)
+		w.Close()
+		framed := EncodeFramed(src)
+		if !bytes.Equal(framed, want.Bytes()) {
+			t.Errorf("n=%d: EncodeFramed differs from the Writer", n)
+			continue
+		}
+		got, err := DecodeFramed(framed)
+		if err != nil {
+			t.Errorf("n=%d: DecodeFramed: %v", n, err)
+			continue
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("n=%d: round trip differs", n)
+		}
+		if n > 0 {
+			if _, err := DecodeFramed(framed[:len(framed)-1]); err != ErrCorrupt {
+				t.Errorf("n=%d: truncated: got %v, want %v", n, err, ErrCorrupt)
+			}
+		}
+	}
+}
+
+func TestStreamDecoder(t *testing.T) {
+	src := make([]byte, 4*maxBlockSize+5)
+	rng := rand.New(rand.NewSource(1))
+	for i := range src {
+		src[i] = "abcdefgh"[rng.Intn(8)]
+	}
+	// Mix compressed and uncompressed chunks, and skippable chunks.
+	rand.New(rand.NewSource(2)).Read(src[maxBlockSize : 2*maxBlockSize])
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	w.Write(src[:3*maxBlockSize])
+	w.Flush()
+	buf.Write([]byte{chunkTypePadding, 3, 0, 0, 0, 0, 0})
+	w.Write(src[3*maxBlockSize:])
+	w.Close()
+	framed := buf.Bytes()
+
+	for _, maxPiece := range []int{1, 3, 1000, len(framed)} {
+		d := NewStreamDecoder()
+		var got []byte
+		for p := framed; len(p) > 0; {
+			n := 1 + rng.Intn(maxPiece)
+			if n > len(p) {
+				n = len(p)
+			}
+			d.Feed(p[:n])
+			p = p[n:]
+			for {
+				block, ok := d.Next()
+				if !ok {
+					break
+				}
+				got = append(got, block...)
+			}
+			if err := d.Err(); err != nil {
+				t.Fatalf("maxPiece=%d: %v", maxPiece, err)
+			}
+		}
+		if !bytes.Equal(got, src) {
+			t.Fatalf("maxPiece=%d: decoded bytes differ", maxPiece)
+		}
+		if n := d.Buffered(); n != 0 {
+			t.Fatalf("maxPiece=%d: Buffered: got %d, want 0", maxPiece, n)
+		}
+	}
+
+	d := NewStreamDecoder()
+	d.Feed(framed[:len(framed)-1])
+	for {
+		if _, ok := d.Next(); !ok {
+			break
+		}
+	}
+	if d.Err() != nil || d.Buffered() == 0 {
+		t.Fatalf("truncated: got Err %v, Buffered %d", d.Err(), d.Buffered())
+	}
+
+	corrupt := append([]byte(nil), framed...)
+	corrupt[len(magicChunk)+chunkHeaderSize] ^= 0xff
+	d = NewStreamDecoder()
+	d.Feed(corrupt)
+	if _, ok := d.Next(); ok || d.Err() != ErrCorrupt {
+		t.Fatalf("bad checksum: got %t, %v, want false, %v", ok, d.Err(), ErrCorrupt)
+	}
+}
+
+func TestDecodeFramedProgress(t *testing.T) {
+	src := bytes.Repeat([]byte("progress bar "), 30000)
+	framed := EncodeFramed(src)
+	buf := new(bytes.Buffer)
+	var calls []int64
+	err := DecodeFramedProgress(buf, bytes.NewReader(framed), func(n int64) {
+		if int64(buf.Len()) != n {
+			t.Errorf("progress(%d) called with %d bytes written", n, buf.Len())
+		}
+		calls = append(calls, n)
+	})
+	if err != nil {
+		t.Fatalf("DecodeFramedProgress: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), src) {
+		t.Fatal("decoded bytes differ")
+	}
+	if want := (len(src) + maxBlockSize - 1) / maxBlockSize; len(calls) != want {
+		t.Fatalf("got %d progress calls, want %d", len(calls), want)
+	}
+
+	if err := DecodeFramedProgress(ioutil.Discard, bytes.NewReader(framed[:len(framed)-1]), nil); err != ErrCorrupt {
+		t.Fatalf("truncated: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestWriterWritePreEncoded(t *testing.T) {
+	blocks := [][]byte{
+		bytes.Repeat([]byte("cached "), 1000),
+		[]byte("tiny"),
+		bytes.Repeat([]byte("y"), maxBlockSize),
+	}
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriterWithTerminator(buf)
+	var want []byte
+	for i, b := range blocks {
+		w.Write([]byte("fresh"))
+		want = append(want, "fresh"...)
+		compressed := Encode(nil, b)
+		_, checksum, err := DecodeAndCRC(compressed)
+		if err != nil {
+			t.Fatalf("block #%d: DecodeAndCRC: %v", i, err)
+		}
+		if err := w.WritePreEncoded(compressed, len(b), checksum); err != nil {
+			t.Fatalf("block #%d: WritePreEncoded: %v", i, err)
+		}
+		want = append(want, b...)
+	}
+	digest, err := w.CloseWithDigest()
+	if err != nil {
+		t.Fatalf("CloseWithDigest: %v", err)
+	}
+	if digest != crc(want) {
+		t.Errorf("digest: got %#08x, want %#08x", digest, crc(want))
+	}
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	r.SetRequireTerminator(true)
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := cmp(got, want); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the declared length is checked, unless the Writer verifies.
+	block := Encode(nil, []byte("checked"))
+	if err := NewBufferedWriter(ioutil.Discard).WritePreEncoded(block, 6, crc([]byte("checked"))); err != ErrCorrupt {
+		t.Errorf("wrong length: got %v, want %v", err, ErrCorrupt)
+	}
+	if err := NewBufferedWriter(ioutil.Discard).WritePreEncoded(block, 7, 0); err != nil {
+		t.Errorf("wrong checksum: got %v, want nil", err)
+	}
+	padded := append(Encode(nil, []byte("checked")), make([]byte, 1<<24)...)
+	if err := NewBufferedWriter(ioutil.Discard).WritePreEncoded(padded, 7, 0); err != ErrCorrupt {
+		t.Errorf("too long: got %v, want %v", err, ErrCorrupt)
+	}
+	w = NewBufferedWriter(ioutil.Discard, VerifyRoundTrip())
+	w.Write([]byte("12345"))
+	err = w.WritePreEncoded(block, 7, 0)
+	if e, ok := err.(*RoundTripError); !ok || e.Offset != 5 {
+		t.Errorf("wrong checksum, verified: got %v, want a RoundTripError at offset 5", err)
+	}
+}
+
+func TestPackBlocks(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var want []byte
+	srcs := make([][]byte, 50)
+	for i := range srcs {
+		srcs[i] = make([]byte, rng.Intn(maxBlockSize+1))
+		for j := range srcs[i] {
+			srcs[i][j] = "abcd"[rng.Intn(4)]
+		}
+		want = append(want, srcs[i]...)
+	}
+	blocks := NewEncoder().EncodeBatch(nil, srcs)
+	crcs := make([]uint32, len(blocks))
+	for i, b := range blocks {
+		_, crcs[i], _ = DecodeAndCRC(b)
+	}
+
+	for _, withCRC := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		var err error
+		if withCRC {
+			err = PackBlocksWithCRC(buf, blocks, crcs)
+		} else {
+			err = PackBlocks(buf, blocks)
+		}
+		if err != nil {
+			t.Fatalf("withCRC=%t: %v", withCRC, err)
+		}
+		got, err := DecodeFramed(buf.Bytes())
+		if err != nil {
+			t.Fatalf("withCRC=%t: DecodeFramed: %v", withCRC, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("withCRC=%t: decoded bytes differ", withCRC)
+		}
+	}
+
+	if err := PackBlocks(ioutil.Discard, [][]byte{Encode(nil, make([]byte, maxBlockSize+1))}); err != ErrTooLarge {
+		t.Fatalf("large block: got %v, want %v", err, ErrTooLarge)
+	}
+	corrupt := append([]byte(nil), blocks[0]...)
+	corrupt = corrupt[:len(corrupt)-1]
+	if err := PackBlocks(ioutil.Discard, [][]byte{corrupt}); err != ErrCorrupt {
+		t.Fatalf("corrupt block: got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestDecodeFramedLenient(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	blocks := make([][]byte, 6)
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	var offsets []int
+	for i := range blocks {
+		blocks[i] = make([]byte, 1000+rng.Intn(maxBlockSize-1000))
+		for j := range blocks[i] {
+			blocks[i][j] = "lenient"[rng.Intn(7)]
+		}
+		if i == 4 {
+			rng.Read(blocks[i])
+		}
+		w.Flush()
+		offsets = append(offsets, buf.Len())
+		w.Write(blocks[i])
+	}
+	w.Close()
+	framed := buf.Bytes()
+
+	type call struct {
+		blockIndex int
+		err        error
+	}
+	decode := func(framed []byte, recover bool) ([]byte, []call, error) {
+		var calls []call
+		out := new(bytes.Buffer)
+		err := DecodeFramedLenient(out, bytes.NewReader(framed), func(blockIndex int, err error) bool {
+			calls = append(calls, call{blockIndex, err})
+			return recover
+		})
+		return out.Bytes(), calls, err
+	}
+	want := func(skip ...int) []byte {
+		var b []byte
+		for i := range blocks {
+			if len(skip) > 0 && skip[0] == i {
+				skip = skip[1:]
+				continue
+			}
+			b = append(b, blocks[i]...)
+		}
+		return b
+	}
+
+	got, calls, err := decode(framed, true)
+	if err != nil || len(calls) != 0 || !bytes.Equal(got, want()) {
+		t.Fatalf("intact: got err %v, calls %v", err, calls)
+	}
+
+	// Corrupt block 2's data and block 4's (uncompressed) checksum, and put
+	// garbage between blocks 0 and 1.
+	damaged := append([]byte(nil), framed[:offsets[1]]...)
+	damaged = append(damaged, "garbage\x00\x10\x00"...)
+	damaged = append(damaged, framed[offsets[1]:]...)
+	shift := len(damaged) - len(framed)
+	damaged[shift+offsets[2]+100] ^= 0x01
+	damaged[shift+offsets[4]+chunkHeaderSize] ^= 0x01
+	got, calls, err = decode(damaged, true)
+	if err != nil {
+		t.Fatalf("damaged: %v", err)
+	}
+	if len(calls) != 3 || calls[0] != (call{1, ErrCorrupt}) || calls[1] != (call{2, ErrCorrupt}) || calls[2] != (call{4, ErrCorrupt}) {
+		t.Fatalf("damaged: got calls %v, want block indexes 1, 2 and 4", calls)
+	}
+	if !bytes.Equal(got, want(2, 4)) {
+		t.Fatal("damaged: decoded bytes differ")
+	}
+
+	got, calls, err = decode(damaged, false)
+	if err != ErrCorrupt || len(calls) != 1 || !bytes.Equal(got, want(1, 2, 3, 4, 5)) {
+		t.Fatalf("not recovering: got err %v, calls %v", err, calls)
+	}
+
+	// Truncation is reported, but there is nothing to recover after it.
+	got, calls, err = decode(framed[:offsets[3]+10], true)
+	if err != nil || len(calls) != 1 || !bytes.Equal(got, want(3, 4, 5)) {
+		t.Fatalf("truncated: got err %v, calls %v", err, calls)
+	}
+}
+
+func TestFramedToRawBlocks(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 5000)
+	for i := range random {
+		random[i] = uint8(rng.Intn(256))
+	}
+	pieces := [][]byte{
+		bytes.Repeat([]byte("compressible "), 10000),
+		random,
+		[]byte("abcd"),
+		bytes.Repeat([]byte{'x'}, 100),
+	}
+
+	framed := new(bytes.Buffer)
+	w := NewBufferedWriter(framed)
+	var want []byte
+	for _, p := range pieces {
+		w.Write(p)
+		w.Flush()
+		for ; len(p) > maxBlockSize; p = p[maxBlockSize:] {
+			want = append(want, Encode(nil, p[:maxBlockSize])...)
+		}
+		want = append(want, Encode(nil, p)...)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got := new(bytes.Buffer)
+	if err := FramedToRawBlocks(got, framed); err != nil {
+		t.Fatalf("FramedToRawBlocks: %v", err)
+	}
+	if err := cmp(got.Bytes(), want); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bad checksum on an uncompressed chunk is detected.
+	corrupt := magicChunk +
+		"\x01\x08\x00\x00" + // Uncompressed chunk, 8 bytes long (including 4 byte checksum).
+		"\x68\x10\xe6\xb7" + // Checksum (the correct one ends in \xb6).
+		"\x61\x62\x63\x64" // Uncompressed payload: "abcd".
+	if err := FramedToRawBlocks(ioutil.Discard, strings.NewReader(corrupt)); err != ErrCorrupt {
+		t.Fatalf("corrupt input: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 300000)
+	for i := range src {
+		src[i] = uint8(rng.Intn(256))
+	}
+	copy(src[100000:], bytes.Repeat([]byte("compressible "), 10000))
+
+	for _, n := range []int{0, 1, 1000, maxBlockSize, len(src)} {
+		buf := new(bytes.Buffer)
+		w := NewBufferedWriter(buf)
+		w.Write(src[:n])
+		if err := w.Close(); err != nil {
+			t.Fatalf("n=%d: Close: %v", n, err)
+		}
+		encoded := buf.Bytes()
+
+		got, err := DecodeAll(bytes.NewReader(encoded))
+		if err != nil {
+			t.Errorf("n=%d: DecodeAll: %v", n, err)
+			continue
+		}
+		if err := cmp(got, src[:n]); err != nil {
+			t.Errorf("n=%d: %v", n, err)
+			continue
+		}
+
+		if n < 2*maxBlockSize {
+			continue
+		}
+		// A truncated stream gives the complete blocks before the truncation.
+		got, err = DecodeAll(bytes.NewReader(encoded[:len(encoded)-1]))
+		if err != ErrCorrupt {
+			t.Errorf("n=%d: truncated: got %v, want ErrCorrupt", n, err)
+			continue
+		}
+		if len(got) == 0 || len(got)%maxBlockSize != 0 {
+			t.Errorf("n=%d: truncated: got %d bytes, want a non-zero multiple of %d", n, len(got), maxBlockSize)
+			continue
+		}
+		if err := cmp(got, src[:len(got)]); err != nil {
+			t.Errorf("n=%d: truncated: %v", n, err)
+		}
+	}
+}
+
+func TestReaderUncompressedDataOK(t *testing.T) {
+	r := NewReader(strings.NewReader(magicChunk +
+		"\x01\x08\x00\x00" + // Uncompressed chunk, 8 bytes long (including 4 byte checksum).
+		"\x68\x10\xe6\xb6" + // Checksum.
+		"\x61\x62\x63\x64", // Uncompressed payload: "abcd".
+	))
+	g, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(g), "abcd"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestReaderUncompressedDataNoPayload(t *testing.T) {
+	r := NewReader(strings.NewReader(magicChunk +
+		"\x01\x04\x00\x00" + // Uncompressed chunk, 4 bytes long.
+		"", // No payload; corrupt input.
+	))
+	if _, err := ioutil.ReadAll(r); err != ErrCorrupt {
+		t.Fatalf("got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestReaderUncompressedDataTooLong(t *testing.T) {
+	// https://github.com/google/snappy/blob/master/framing_format.txt section
+	// 4.3 says that "the maximum legal chunk length... is 65540", or 0x10004.
+	const n = 0x10005
+
+	r := NewReader(strings.NewReader(magicChunk +
+		"\x01\x05\x00\x01" + // Uncompressed chunk, n bytes long.
+		strings.Repeat("\x00", n),
+	))
+	if _, err := ioutil.ReadAll(r); err != ErrCorrupt {
+		t.Fatalf("got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestReaderReset(t *testing.T) {
+	gold := bytes.Repeat([]byte("All that is gold does not glitter,\n"), 10000)
+	buf := new(bytes.Buffer)
+	if _, err := NewWriter(buf).Write(gold); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	encoded, invalid, partial := buf.String(), "invalid", "partial"
+	r := NewReader(nil)
+	for i, s := range []string{encoded, invalid, partial, encoded, partial, invalid, encoded, encoded} {
+		if s == partial {
+			r.Reset(strings.NewReader(encoded))
+			if _, err := r.Read(make([]byte, 101)); err != nil {
+				t.Errorf("#%d: %v", i, err)
+				continue
+			}
+			continue
+		}
+		r.Reset(strings.NewReader(s))
+		got, err := ioutil.ReadAll(r)
+		switch s {
+		case encoded:
+			if err != nil {
+				t.Errorf("#%d: %v", i, err)
+				continue
+			}
+			if err := cmp(got, gold); err != nil {
+				t.Errorf("#%d: %v", i, err)
+				continue
+			}
+		case invalid:
+			if err == nil {
+				t.Errorf("#%d: got nil error, want non-nil", i)
+				continue
+			}
+		}
+	}
+}
+
+func TestWriterReset(t *testing.T) {
+	gold := bytes.Repeat([]byte("Not all those who wander are lost;\n"), 10000)
+	const n = 20
+	for _, buffered := range []bool{false, true} {
+		var w *Writer
+		if buffered {
+			w = NewBufferedWriter(nil)
+			defer w.Close()
+		} else {
+			w = NewWriter(nil)
+		}
+
+		var gots, wants [][]byte
+		failed := false
+		for i := 0; i <= n; i++ {
+			buf := new(bytes.Buffer)
+			w.Reset(buf)
+			want := gold[:len(gold)*i/n]
+			if _, err := w.Write(want); err != nil {
+				t.Errorf("#%d: Write: %v", i, err)
+				failed = true
+				continue
+			}
+			if buffered {
+				if err := w.Flush(); err != nil {
+					t.Errorf("#%d: Flush: %v", i, err)
+					failed = true
+					continue
+				}
+			}
+			got, err := ioutil.ReadAll(NewReader(buf))
+			if err != nil {
+				t.Errorf("#%d: ReadAll: %v", i, err)
+				failed = true
+				continue
+			}
+			gots = append(gots, got)
+			wants = append(wants, want)
+		}
+		if failed {
+			continue
+		}
+		for i := range gots {
+			if err := cmp(gots[i], wants[i]); err != nil {
+				t.Errorf("#%d: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestWriterResetWithoutFlush(t *testing.T) {
+	buf0 := new(bytes.Buffer)
+	buf1 := new(bytes.Buffer)
+	w := NewBufferedWriter(buf0)
+	if _, err := w.Write([]byte("xxx")); err != nil {
+		t.Fatalf("Write #0: %v", err)
+	}
+	// Note that we don't Flush the Writer before calling Reset.
+	w.Reset(buf1)
+	if _, err := w.Write([]byte("yyy")); err != nil {
+		t.Fatalf("Write #1: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	got, err := ioutil.ReadAll(NewReader(buf1))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := cmp(got, []byte("yyy")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRCCombine(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 3*maxBlockSize)
+	for i := range src {
+		src[i] = uint8(rng.Intn(256))
+	}
+	for _, n := range []int{0, 1, 2, 7, 100, 4096, maxBlockSize, 2*maxBlockSize + 3} {
+		for _, split := range []int{0, 1, n / 3, n} {
+			if split > n {
+				continue
+			}
+			a, b := src[:split], src[split:n]
+			got := crcCombine(crc32.Update(0, crcTable, a), crc32.Update(0, crcTable, b), int64(len(b)))
+			want := crc32.Update(0, crcTable, src[:n])
+			if got != want {
+				t.Errorf("n=%d, split=%d: got %#08x, want %#08x", n, split, got, want)
+			}
+		}
+	}
+}
+
+func TestCombineCRC(t *testing.T) {
+	for _, c := range []uint32{0, 1, 0xa282ead8, 0xffffffff, 0x12345678} {
+		if got := unmaskCRC(maskCRC(c)); got != c {
+			t.Errorf("unmaskCRC(maskCRC(%#08x)) = %#08x", c, got)
+		}
+	}
+
+	// Combine the digests of separately compressed segments.
+	tDir := filepath.FromSlash(*testdataDir)
+	src, err := ioutil.ReadFile(filepath.Join(tDir, goldenText))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	segments := [][]byte{src[:1000], src[1000:1000], src[1000:9000], src[9000:]}
+	var got uint32
+	for i, seg := range segments {
+		w := NewBufferedWriter(ioutil.Discard)
+		w.Write(seg)
+		digest, err := w.CloseWithDigest()
+		if err != nil {
+			t.Fatalf("segment #%d: CloseWithDigest: %v", i, err)
+		}
+		if i == 0 {
+			got = digest
+		} else {
+			got = CombineCRC(got, digest, int64(len(seg)))
+		}
+	}
+	if want := crc(src); got != want {
+		t.Errorf("got %#08x, want %#08x", got, want)
+	}
+}
+
+func TestCRCTable(t *testing.T) {
+	// crc32.Update only uses hardware acceleration for this exact table.
+	if crcTable != crc32.MakeTable(crc32.Castagnoli) {
+		t.Fatal("crcTable is not the hash/crc32 package's Castagnoli table")
+	}
+	softTable := *crcTable
+	b := []byte("The quick brown fox jumps over the lazy dog")
+	if got, want := crc32.Update(0, crcTable, b), crc32.Update(0, &softTable, b); got != want {
+		t.Fatalf("got %#08x, want %#08x", got, want)
+	}
+}
+
+func TestWriterCloseWithDigest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 200000)
+	for i := range src {
+		src[i] = uint8(rng.Intn(256))
+	}
+	copy(src[100000:], bytes.Repeat([]byte("compressible "), 4000))
+
+	for _, buffered := range []bool{false, true} {
+		for _, n := range []int{0, 10, len(src)} {
+			var w *Writer
+			if buffered {
+				w = NewBufferedWriter(ioutil.Discard)
+			} else {
+				w = NewWriter(ioutil.Discard)
+			}
+			for p := src[:n]; len(p) > 0; {
+				m := 1 + rng.Intn(30000)
+				if m > len(p) {
+					m = len(p)
+				}
+				if _, err := w.Write(p[:m]); err != nil {
+					t.Fatalf("buffered=%t, n=%d: Write: %v", buffered, n, err)
+				}
+				p = p[m:]
+			}
+			got, err := w.CloseWithDigest()
+			if err != nil {
+				t.Fatalf("buffered=%t, n=%d: CloseWithDigest: %v", buffered, n, err)
+			}
+			if want := crc(src[:n]); got != want {
+				t.Errorf("buffered=%t, n=%d: got %#08x, want %#08x", buffered, n, got, want)
+			}
+		}
+	}
+}
+
+// memWriteSeeker is an in-memory io.WriteSeeker.
+type memWriteSeeker struct {
+	buf []byte
+	pos int64
+}
+
+func (m *memWriteSeeker) Write(p []byte) (int, error) {
+	if n := m.pos + int64(len(p)); n > int64(len(m.buf)) {
+		m.buf = append(m.buf, make([]byte, n-int64(len(m.buf)))...)
+	}
+	n := copy(m.buf[m.pos:], p)
+	m.pos += int64(n)
+	return n, nil
+}
+
+func (m *memWriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += int64(len(m.buf))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	m.pos = offset
+	return offset, nil
+}
+
+// pipeWriteSeeker is an io.WriteSeeker that cannot actually seek.
+type pipeWriteSeeker struct {
+	io.Writer
+}
+
+func (pipeWriteSeeker) Seek(int64, int) (int64, error) {
+	return 0, errors.New("illegal seek")
+}
+
+func TestLengthPrefixedWriter(t *testing.T) {
+	src := bytes.Repeat([]byte("how long is this? "), 10000)
+	ws := &memWriteSeeker{}
+	ws.Write([]byte("HEADER"))
+	w := NewLengthPrefixedWriter(ws)
+	for p := src; len(p) > 0; p = p[1000:] {
+		if _, err := w.Write(p[:1000]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	ws.Write([]byte("TRAILER"))
+	if !bytes.HasPrefix(ws.buf, []byte("HEADER")) || !bytes.HasSuffix(ws.buf, []byte("TRAILER")) {
+		t.Fatal("the header or trailer was overwritten")
+	}
+	stream := ws.buf[len("HEADER") : len(ws.buf)-len("TRAILER")]
+
+	r := NewReader(bytes.NewReader(stream))
+	n, ok := r.StreamLength()
+	if !ok || n != int64(len(src)) {
+		t.Fatalf("StreamLength: got %d, %t, want %d, true", n, ok, len(src))
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := cmp(got, src); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DecodeFramed(stream); err != nil || !bytes.Equal(got, src) {
+		t.Fatalf("DecodeFramed: got %d bytes, %v", len(got), err)
+	}
+
+	// An empty stream, after Reset, records a zero length.
+	ws = &memWriteSeeker{}
+	w.Reset(ws)
+	if err := w.Close(); err != nil {
+		t.Fatalf("empty: Close: %v", err)
+	}
+	r.Reset(bytes.NewReader(ws.buf))
+	if n, ok := r.StreamLength(); !ok || n != 0 {
+		t.Errorf("empty: StreamLength: got %d, %t, want 0, true", n, ok)
+	}
+
+	// Other streams have no length.
+	r.Reset(bytes.NewReader(EncodeFramed(src)))
+	if n, ok := r.StreamLength(); ok {
+		t.Errorf("plain stream: StreamLength: got %d, true, want false", n)
+	}
+
+	// Destinations that cannot seek are reported.
+	w = NewLengthPrefixedWriter(pipeWriteSeeker{ioutil.Discard})
+	if _, err := w.Write(src); err != errLengthNotSeekable {
+		t.Errorf("pipe: Write: got %v, want %v", err, errLengthNotSeekable)
+	}
+	w = NewLengthPrefixedWriter(&memWriteSeeker{})
+	w.Reset(ioutil.Discard)
+	if err := w.Close(); err != errLengthNotSeekable {
+		t.Errorf("Reset to a non-seeker: Close: got %v, want %v", err, errLengthNotSeekable)
+	}
+}
+
+func TestWriterRollingCRC(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 300000)
+	rng.Read(src)
+	for _, buffered := range []bool{false, true} {
+		var w *Writer
+		if buffered {
+			w = NewBufferedWriter(ioutil.Discard)
+		} else {
+			w = NewWriter(ioutil.Discard)
+		}
+		if got, want := w.RollingCRC(), crc(nil); got != want {
+			t.Errorf("buffered=%t, empty: got %#08x, want %#08x", buffered, got, want)
+		}
+		for n := 0; n < len(src); {
+			m := 1 + rng.Intn(40000)
+			if m > len(src)-n {
+				m = len(src) - n
+			}
+			w.Write(src[n : n+m])
+			n += m
+			if got, want := w.RollingCRC(), crc(src[:n]); got != want {
+				t.Fatalf("buffered=%t, after %d bytes: got %#08x, want %#08x", buffered, n, got, want)
+			}
+		}
+	}
+}
+
+func TestCDCWriter(t *testing.T) {
+	const avg = 4096
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 1<<20)
+	for i := range src {
+		src[i] = "abcdefgh"[rng.Intn(8)]
+	}
+
+	// encode writes data to a CDCWriter in random pieces, and returns the
+	// stream and the chunks' bodies.
+	encode := func(data []byte, seed int64) ([]byte, []string) {
+		rng := rand.New(rand.NewSource(seed))
+		buf := new(bytes.Buffer)
+		w := NewCDCWriter(buf, avg)
+		for n := 0; n < len(data); {
+			m := rng.Intn(3 * maxBlockSize)
+			if m > len(data)-n {
+				m = len(data) - n
+			}
+			if _, err := w.Write(data[n : n+m]); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			n += m
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		var chunks []string
+		r := NewReader(bytes.NewReader(buf.Bytes()))
+		for {
+			chunkType, body, err := r.NextChunk()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("NextChunk: %v", err)
+			}
+			if chunkType == chunkTypeCompressedData || chunkType == chunkTypeUncompressedData {
+				chunks = append(chunks, string(chunkType)+string(body))
+			}
+		}
+		return buf.Bytes(), chunks
+	}
+
+	enc, chunks := encode(src, 1)
+	got, err := ioutil.ReadAll(NewReader(bytes.NewReader(enc)))
+	if err != nil || !bytes.Equal(got, src) {
+		t.Fatalf("round trip: err=%v, equal=%t", err, bytes.Equal(got, src))
+	}
+	if n := len(src) / len(chunks); n < avg/2 || n > 2*avg {
+		t.Errorf("average block size: got %d, want about %d", n, avg)
+	}
+	for i, c := range chunks {
+		b := []byte(c[1+checksumSize:])
+		if c[0] == chunkTypeCompressedData {
+			var err error
+			if b, err = Decode(nil, b); err != nil {
+				t.Fatalf("chunk #%d: %v", i, err)
+			}
+		}
+		if len(b) > maxBlockSize || (len(b) < avg/2 && i != len(chunks)-1) {
+			t.Errorf("chunk #%d: decoded length %d out of range", i, len(b))
+		}
+	}
+
+	// The output does not depend on how the data was split into Writes, and
+	// ReadFrom agrees with Write.
+	if enc2, _ := encode(src, 2); !bytes.Equal(enc2, enc) {
+		t.Errorf("output depends on the Write sizes")
+	}
+	buf := new(bytes.Buffer)
+	w := NewCDCWriter(buf, avg)
+	w.ReadFrom(bytes.NewReader(src))
+	w.Close()
+	if !bytes.Equal(buf.Bytes(), enc) {
+		t.Errorf("ReadFrom's output differs from Write's")
+	}
+
+	// Inserting bytes in the middle only changes the chunks around them.
+	edited := append(append(append([]byte(nil), src[:len(src)/2]...), "inserted"...), src[len(src)/2:]...)
+	_, chunks2 := encode(edited, 3)
+	old := map[string]bool{}
+	for _, c := range chunks {
+		old[c] = true
+	}
+	changed := 0
+	for _, c := range chunks2 {
+		if !old[c] {
+			changed++
+		}
+	}
+	if changed > 3 {
+		t.Errorf("an insertion changed %d of %d chunks", changed, len(chunks2))
+	}
+
+	for _, avg := range []int{-1, 0, 63, maxBlockSize/2 + 1} {
+		if _, err := NewCDCWriter(ioutil.Discard, avg).Write([]byte("x")); err == nil {
+			t.Errorf("avg=%d: got nil error, want non-nil", avg)
+		}
+	}
+}
+
+func TestVerifiedReader(t *testing.T) {
+	a := bytes.Repeat([]byte("first block "), 1000)
+	b := bytes.Repeat([]byte("second block "), 1000)
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriterWithTerminator(buf)
+	w.Write(a)
+	w.Flush()
+	split := buf.Len()
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	enc := buf.Bytes()
+	// The last chunk is the end-of-stream marker.
+	end := len(enc) - chunkHeaderSize - checksumSize
+	want := append(append([]byte(nil), a...), b...)
+
+	read := func(enc []byte) ([]byte, error) {
+		return ioutil.ReadAll(NewVerifiedReader(bytes.NewReader(enc)))
+	}
+	if got, err := read(enc); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("intact: err=%v, equal=%t", err, bytes.Equal(got, want))
+	}
+	if got, err := read(append(enc[:len(enc):len(enc)], enc...)); err != nil || !bytes.Equal(got, append(want, want...)) {
+		t.Errorf("concatenated: err=%v", err)
+	}
+	// Only the second stream has a marker, which covers its data alone.
+	plain := new(bytes.Buffer)
+	pw := NewBufferedWriter(plain)
+	pw.Write(a)
+	pw.Close()
+	mixed := append(plain.Bytes(), enc...)
+	if got, err := read(mixed); err != nil || !bytes.Equal(got, append(append([]byte(nil), a...), want...)) {
+		t.Errorf("unterminated, then terminated: err=%v", err)
+	}
+
+	// Swapping the data chunks leaves each intact, but not the stream.
+	swapped := append([]byte(nil), enc[:len(magicChunk)]...)
+	swapped = append(swapped, enc[split:end]...)
+	swapped = append(swapped, enc[len(magicChunk):split]...)
+	swapped = append(swapped, enc[end:]...)
+	if _, err := read(swapped); err != ErrStreamChecksum {
+		t.Errorf("swapped: got %v, want ErrStreamChecksum", err)
+	}
+	if _, err := ioutil.ReadAll(NewReader(bytes.NewReader(swapped))); err != nil {
+		t.Errorf("swapped, unverified: %v", err)
+	}
+	dropped := append(enc[:split:split], enc[end:]...)
+	if _, err := read(dropped); err != ErrStreamChecksum {
+		t.Errorf("dropped: got %v, want ErrStreamChecksum", err)
+	}
+
+	// Without a marker, the stream is only rejected if one is required.
+	if _, err := read(enc[:end]); err != nil {
+		t.Errorf("no marker: %v", err)
+	}
+	r := NewVerifiedReader(bytes.NewReader(enc[:end]))
+	r.SetRequireTerminator(true)
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("no marker, required: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// failAfterWriter accepts n bytes, and then fails.
+type failAfterWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (f *failAfterWriter) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		m, _ := f.buf.Write(p[:f.n])
+		f.n = 0
+		return m, errors.New("sink is full")
+	}
+	f.n -= len(p)
+	return f.buf.Write(p)
+}
+
+func TestWriterAddWriter(t *testing.T) {
+	src := bytes.Repeat([]byte("tee to several sinks "), 20000)
+	primary, extra := new(bytes.Buffer), new(bytes.Buffer)
+	failing := &failAfterWriter{n: 1000}
+	w := NewBufferedWriter(primary)
+	for _, x := range []io.Writer{extra, failing} {
+		if err := w.AddWriter(x); err != nil {
+			t.Fatalf("AddWriter: %v", err)
+		}
+	}
+	if _, err := w.Write(src); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !bytes.Equal(extra.Bytes(), primary.Bytes()) {
+		t.Errorf("added writer's output differs from the primary's")
+	}
+	if got, err := ioutil.ReadAll(NewReader(extra)); err != nil || !bytes.Equal(got, src) {
+		t.Errorf("added writer: err=%v, equal=%t", err, bytes.Equal(got, src))
+	}
+	if !bytes.HasPrefix(primary.Bytes(), failing.buf.Bytes()) || failing.buf.Len() != 1000 {
+		t.Errorf("failed writer got %d bytes, want a 1000-byte prefix", failing.buf.Len())
+	}
+	if errs := w.SinkErrors(); len(errs) != 2 || errs[0] != nil || errs[1] == nil {
+		t.Errorf("SinkErrors: got %v, want [nil, non-nil]", errs)
+	}
+
+	// AddWriter is too late once output has been written, and Reset removes
+	// the added writers.
+	w.Reset(new(bytes.Buffer))
+	if errs := w.SinkErrors(); len(errs) != 0 {
+		t.Errorf("after Reset: SinkErrors: got %v, want none", errs)
+	}
+	w.Write(src)
+	if err := w.AddWriter(new(bytes.Buffer)); err == nil {
+		t.Errorf("AddWriter after output: got nil error, want non-nil")
+	}
+
+	// A length-prefixed Writer does not support added writers, even before
+	// any output.
+	lw := NewLengthPrefixedWriter(&memWriteSeeker{})
+	if err := lw.AddWriter(new(bytes.Buffer)); err != errAddWriterLength {
+		t.Errorf("length-prefixed: got %v, want %v", err, errAddWriterLength)
+	}
+
+	// A failure of the primary writer fails the Writer, and stops all output.
+	extra.Reset()
+	w.Reset(&failAfterWriter{n: 100})
+	w.AddWriter(extra)
+	w.Write(src)
+	if err := w.Close(); err == nil {
+		t.Errorf("failing primary: got nil error, want non-nil")
+	}
+	if extra.Len() > 100 {
+		t.Errorf("failing primary: added writer got %d bytes, want at most 100", extra.Len())
+	}
+}
+
+func TestMemoryFootprint(t *testing.T) {
+	src := bytes.Repeat([]byte("compressible "), maxBlockSize/13+1)[:maxBlockSize]
+	allocated := func(f func()) int {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		f()
+		runtime.ReadMemStats(&after)
+		return int(after.TotalAlloc - before.TotalAlloc)
+	}
+	check := func(desc string, got, measured int) {
+		t.Helper()
+		if d := got - measured; d < -got/10 || d > got/10 {
+			t.Errorf("%s: footprint %d, but %d bytes were allocated", desc, got, measured)
+		}
+	}
+
+	testCases := []struct {
+		desc string
+		opts []WriterOption
+	}{
+		{"default", nil},
+		{"BlockSize(4096)", []WriterOption{BlockSize(4096)}},
+		{"OutputBufferSize", []WriterOption{OutputBufferSize(1 << 18)}},
+		{"VerifyRoundTrip", []WriterOption{VerifyRoundTrip()}},
+		{"BlockDeadline", []WriterOption{BlockDeadline(time.Hour)}},
+		{"invalid", []WriterOption{BlockSize(-1)}},
+	}
+	for _, tc := range testCases {
+		got := WriterMemoryFootprint(tc.opts...)
+		measured := allocated(func() {
+			w := NewBufferedWriter(ioutil.Discard, tc.opts...)
+			w.Write(src)
+			w.Close()
+		})
+		// The hash table is on the stack, so it is not counted as allocated.
+		check(tc.desc, got-encodeTableSize, measured)
+	}
+	if got, want := WriterMemoryFootprint(BlockSize(-1)), WriterMemoryFootprint(); got != want {
+		t.Errorf("invalid options: got %d, want the default %d", got, want)
+	}
+
+	check("Reader", ReaderMemoryFootprint(), allocated(func() {
+		NewReader(bytes.NewReader(nil)).Read(src)
+	}))
+	// With a buffer pool, the Reader never allocates a buffer of its own for
+	// decoded blocks.
+	get := func(n int) []byte { return nil }
+	check("Reader with SetBufferPool", ReaderMemoryFootprint()-maxBlockSize, allocated(func() {
+		r := NewReader(bytes.NewReader(nil))
+		r.SetBufferPool(get, nil)
+		r.Read(src)
+	}))
+}
+
+func TestReaderReadBuffers(t *testing.T) {
+	data := smallRecord(rand.New(rand.NewSource(1)), 3*maxBlockSize+1000)
+	r := NewReader(bytes.NewReader(EncodeFramed(data)))
+	head := make([]byte, 100)
+	if _, err := io.ReadFull(r, head); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	got := new(bytes.Buffer)
+	got.Write(head)
+	for {
+		bufs, err := r.ReadBuffers()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("ReadBuffers: %v", err)
+		}
+		// WriteTo consumes bufs, but not the data that they alias.
+		if _, err := bufs.WriteTo(got); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("got %d bytes, want %d", got.Len(), len(data))
+	}
+}
+
+func TestReaderSetRequireStreamHeader(t *testing.T) {
+	data := smallRecord(rand.New(rand.NewSource(1)), 2*maxBlockSize)
+	stream := EncodeFramed(data)
+	headless := stream[len(magicChunk):]
+
+	r := NewReader(bytes.NewReader(headless))
+	if _, err := ioutil.ReadAll(r); err != ErrCorrupt {
+		t.Errorf("default: got %v, want ErrCorrupt", err)
+	}
+	r.Reset(bytes.NewReader(headless))
+	r.SetRequireStreamHeader(false)
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("headless: got %d bytes, %v; want %d bytes", len(got), err, len(data))
+	}
+	r.Reset(bytes.NewReader(stream))
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("with header: got %d bytes, %v; want %d bytes", len(got), err, len(data))
+	}
+	r.Reset(bytes.NewReader([]byte("\xfe\x00\x00\x00")))
+	if _, err := ioutil.ReadAll(r); err != ErrCorrupt {
+		t.Errorf("padding first: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestReaderReadBlock(t *testing.T) {
+	records := [][]byte{
+		[]byte("first"),
+		{},
+		bytes.Repeat([]byte("third "), 1000),
+		[]byte("fourth"),
+	}
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	for _, rec := range records {
+		if len(rec) == 0 {
+			// Flush does not write empty blocks, so write one directly.
+			w.WritePreEncoded(Encode(nil, nil), 0, crc(nil))
+			continue
+		}
+		w.Write(rec)
+		w.Flush()
+	}
+	w.Close()
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	for i, rec := range records {
+		got, err := r.ReadBlock()
+		if err != nil {
+			t.Fatalf("record #%d: ReadBlock: %v", i, err)
+		}
+		if !bytes.Equal(got, rec) {
+			t.Errorf("record #%d: got %q, want %q", i, got, rec)
+		}
+	}
+	if _, err := r.ReadBlock(); err != io.EOF {
+		t.Errorf("at end: got %v, want io.EOF", err)
+	}
+
+	// The rest of a block partly read by Read comes first.
+	r.Reset(bytes.NewReader(buf.Bytes()))
+	p := make([]byte, 2)
+	r.Read(p)
+	if got, err := r.ReadBlock(); err != nil || string(got) != "rst" {
+		t.Errorf("after Read: got %q, %v; want %q", got, err, "rst")
+	}
+	if got, err := r.ReadBlock(); err != nil || len(got) != 0 {
+		t.Errorf("after Read: got %q, %v; want the empty record", got, err)
+	}
+
+	// A block pushed back by UnreadBlock is returned again, whole.
+	r.Reset(bytes.NewReader(buf.Bytes()))
+	r.ReadBlock()
+	if err := r.UnreadBlock(); err != nil {
+		t.Fatalf("UnreadBlock: %v", err)
+	}
+	if got, err := r.ReadBlock(); err != nil || string(got) != "first" {
+		t.Errorf("after UnreadBlock: got %q, %v; want %q", got, err, "first")
+	}
+}
+
+func TestReaderStoredRanges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 3000)
+	rng.Read(random)
+	text := smallRecord(rng, 5000)
+
+	// The stream holds text, random bytes as two stored blocks, which merge
+	// into one range, text, and random bytes again.
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	for _, p := range [][]byte{text, random[:1000], random[1000:], text, random} {
+		w.Write(p)
+		w.Flush()
+	}
+	w.Close()
+	want := "[{5000 8000} {13000 16000}]"
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	ioutil.ReadAll(r)
+	if got := r.StoredRanges(); got != nil {
+		t.Errorf("untracked: got %v, want nil", got)
+	}
+	r.Reset(bytes.NewReader(buf.Bytes()))
+	r.SetTrackStoredRanges(true)
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got := fmt.Sprint(r.StoredRanges()); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	r.Reset(bytes.NewReader(buf.Bytes()))
+	if got := r.StoredRanges(); got != nil {
+		t.Errorf("after Reset: got %v, want nil", got)
+	}
+}
+
+func TestReaderLastBlockSourceRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 300000)
+	for i := range src {
+		src[i] = "index"[rng.Intn(5)]
+	}
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	w.Write(src[:1000])
+	w.Flush()
+	w.Write(src[1000:])
+	w.Close()
+	enc := buf.Bytes()
+
+	for _, buffered := range []bool{false, true} {
+		var sr io.Reader = bytes.NewReader(enc)
+		if buffered {
+			sr = bufio.NewReader(sr)
+		}
+		r := NewReader(sr)
+		if start, end := r.LastBlockSourceRange(); start != 0 || end != 0 {
+			t.Fatalf("buffered=%t, before reading: got [%d, %d), want [0, 0)", buffered, start, end)
+		}
+		// Read a block at a time, and check that each block's chunk can be
+		// decoded on its own, after a stream identifier.
+		p := make([]byte, maxBlockSize)
+		decoded, prevEnd := 0, int64(len(magicChunk))
+		for {
+			n, err := r.Read(p)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("buffered=%t: Read: %v", buffered, err)
+			}
+			start, end := r.LastBlockSourceRange()
+			if start != prevEnd {
+				t.Fatalf("buffered=%t: block at %d starts at %d, want %d", buffered, decoded, start, prevEnd)
+			}
+			chunk := append([]byte(magicChunk), enc[start:end]...)
+			got, err := ioutil.ReadAll(NewReader(bytes.NewReader(chunk)))
+			if err != nil || !bytes.Equal(got, p[:n]) {
+				t.Fatalf("buffered=%t: block at %d: err=%v, equal=%t", buffered, decoded, err, bytes.Equal(got, p[:n]))
+			}
+			decoded += n
+			prevEnd = end
+		}
+		if decoded != len(src) || prevEnd != int64(len(enc)) {
+			t.Errorf("buffered=%t: decoded %d bytes to position %d, want %d to %d", buffered, decoded, prevEnd, len(src), len(enc))
+		}
+	}
+}
+
+func TestReaderSetBufferPool(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 300000)
+	for i := range src {
+		src[i] = "pool"[rng.Intn(4)]
+	}
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	w.Write(src[:1000])
+	w.Flush()
+	w.Write(src[1000:])
+	w.Close()
+	enc := buf.Bytes()
+
+	var (
+		sizes       []int
+		outstanding = map[*byte]bool{}
+	)
+	get := func(n int) []byte {
+		sizes = append(sizes, n)
+		b := make([]byte, n, n+1)
+		outstanding[&b[:1][0]] = true
+		return b
+	}
+	put := func(b []byte) {
+		if !outstanding[&b[:1][0]] {
+			t.Fatalf("put a buffer that was not from the pool")
+		}
+		delete(outstanding, &b[:1][0])
+	}
+
+	r := NewReader(bytes.NewReader(enc))
+	r.SetBufferPool(get, put)
+	p := make([]byte, 10000)
+	var got []byte
+	unread := false
+	for {
+		n, err := r.Read(p)
+		got = append(got, p[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if len(got) == 11000 && !unread {
+			r.UnreadBlock()
+			unread = true
+			got = got[:1000]
+		}
+		if len(outstanding) != 1 {
+			t.Fatalf("after %d bytes: %d buffers outstanding, want 1", len(got), len(outstanding))
+		}
+	}
+	if !bytes.Equal(got, src) {
+		t.Fatalf("decoded data differs")
+	}
+	if len(outstanding) != 0 {
+		t.Errorf("at EOF: %d buffers outstanding, want 0", len(outstanding))
+	}
+	if len(sizes) != 6 || sizes[0] != 1000 || sizes[1] != maxBlockSize {
+		t.Errorf("sizes requested: got %v, want 1000 then 65536s", sizes)
+	}
+
+	// Reset returns the current buffer, and SetBufferPool(nil, nil) reverts to
+	// the Reader's own buffer.
+	r.Reset(bytes.NewReader(enc))
+	r.Read(p)
+	r.Reset(bytes.NewReader(enc))
+	if len(outstanding) != 0 {
+		t.Errorf("after Reset: %d buffers outstanding, want 0", len(outstanding))
+	}
+	r.Read(p)
+	r.SetBufferPool(nil, nil)
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, src[1000:]) {
+		t.Errorf("after SetBufferPool(nil, nil): err=%v, equal=%t", err, bytes.Equal(got, src[1000:]))
+	}
+	if len(outstanding) != 0 {
+		t.Errorf("after SetBufferPool(nil, nil): %d buffers outstanding, want 0", len(outstanding))
+	}
+
+	r.Reset(bytes.NewReader(enc))
+	r.SetBufferPool(func(n int) []byte { return make([]byte, n/2) }, nil)
+	if _, err := r.Read(p); err == nil {
+		t.Errorf("short buffer: got nil error, want non-nil")
+	}
+}
+
+func TestFixedFrameWriter(t *testing.T) {
+	const frameSize = 256
+	rng := rand.New(rand.NewSource(1))
+	records := [][]byte{
+		nil,
+		[]byte("hello"),
+		bytes.Repeat([]byte("abcd"), 200),
+		make([]byte, frameSize-frameHeaderLen),
+	}
+	rng.Read(records[3])
+	buf := new(bytes.Buffer)
+	f := NewFixedFrameWriter(buf, frameSize)
+	for i, rec := range records {
+		if err := f.WriteFrame(rec); err != nil {
+			t.Fatalf("record #%d: WriteFrame: %v", i, err)
+		}
 	}
-	dst, err := ioutil.ReadAll(NewReader(buf))
+	for _, n := range []int{frameSize - frameHeaderLen - 1, frameSize, maxBlockSize + 1} {
+		rec := make([]byte, n)
+		rng.Read(rec)
+		if err := f.WriteFrame(rec); err != ErrFrameTooLarge {
+			t.Errorf("%d random bytes: got %v, want ErrFrameTooLarge", n, err)
+		}
+	}
+	if got, want := buf.Len(), len(records)*frameSize; got != want {
+		t.Fatalf("output length: got %d, want %d", got, want)
+	}
+	r := bytes.NewReader(buf.Bytes())
+	for i, rec := range records {
+		got, err := ioutil.ReadAll(NewReader(io.NewSectionReader(r, int64(i*frameSize), frameSize)))
+		if err != nil {
+			t.Fatalf("record #%d: %v", i, err)
+		}
+		if !bytes.Equal(got, rec) {
+			t.Errorf("record #%d: got %d bytes, want %d", i, len(got), len(rec))
+		}
+	}
+	all, err := ioutil.ReadAll(NewReader(r))
 	if err != nil {
-		t.Fatalf("ReadAll: decoding: %v", err)
+		t.Fatalf("whole stream: %v", err)
 	}
-	if err := cmp(dst, src); err != nil {
-		t.Fatal(err)
+	if want := bytes.Join(records, nil); !bytes.Equal(all, want) {
+		t.Errorf("whole stream: got %d bytes, want %d", len(all), len(want))
+	}
+
+	for _, n := range []int{minFrameSize - 1, maxFrameSize + 1} {
+		if err := NewFixedFrameWriter(ioutil.Discard, n).WriteFrame(nil); err == nil {
+			t.Errorf("frame size %d: got nil error", n)
+		}
 	}
 }
 
-func TestWriterGoldenOutput(t *testing.T) {
+func TestAuditFramed(t *testing.T) {
 	buf := new(bytes.Buffer)
 	w := NewBufferedWriter(buf)
-	defer w.Close()
-	w.Write([]byte("abcd")) // Not compressible.
-	w.Flush()
-	w.Write(bytes.Repeat([]byte{'A'}, 150)) // Compressible.
-	w.Flush()
-	// The next chunk is also compressible, but a naive, greedy encoding of the
-	// overall length 67 copy as a length 64 copy (the longest expressible as a
-	// tagCopy1 or tagCopy2) plus a length 3 remainder would be two 3-byte
-	// tagCopy2 tags (6 bytes), since the minimum length for a tagCopy1 is 4
-	// bytes. Instead, we could do it shorter, in 5 bytes: a 3-byte tagCopy2
-	// (of length 60) and a 2-byte tagCopy1 (of length 7).
-	w.Write(bytes.Repeat([]byte{'B'}, 68))
-	w.Write([]byte("efC"))                 // Not compressible.
-	w.Write(bytes.Repeat([]byte{'C'}, 20)) // Compressible.
-	w.Write(bytes.Repeat([]byte{'B'}, 20)) // Compressible.
-	w.Write([]byte("g"))                   // Not compressible.
-	w.Flush()
+	blocks := [][]byte{
+		bytes.Repeat([]byte("compressible "), 100),
+		[]byte("short"),
+		bytes.Repeat([]byte("z"), 3000),
+	}
+	for _, b := range blocks {
+		w.Write(b)
+		w.Flush()
+	}
+	w.Close()
 
-	got := buf.String()
-	want := strings.Join([]string{
-		magicChunk,
-		"\x01\x08\x00\x00", // Uncompressed chunk, 8 bytes long (including 4 byte checksum).
-		"\x68\x10\xe6\xb6", // Checksum.
-		"\x61\x62\x63\x64", // Uncompressed payload: "abcd".
-		"\x00\x11\x00\x00", // Compressed chunk, 17 bytes long (including 4 byte checksum).
-		"\x5f\xeb\xf2\x10", // Checksum.
-		"\x96\x01",         // Compressed payload: Uncompressed length (varint encoded): 150.
-		"\x00\x41",         // Compressed payload: tagLiteral, length=1,  "A".
-		"\xfe\x01\x00",     // Compressed payload: tagCopy2,   length=64, offset=1.
-		"\xfe\x01\x00",     // Compressed payload: tagCopy2,   length=64, offset=1.
-		"\x52\x01\x00",     // Compressed payload: tagCopy2,   length=21, offset=1.
-		"\x00\x18\x00\x00", // Compressed chunk, 24 bytes long (including 4 byte checksum).
-		"\x30\x85\x69\xeb", // Checksum.
-		"\x70",             // Compressed payload: Uncompressed length (varint encoded): 112.
-		"\x00\x42",         // Compressed payload: tagLiteral, length=1,  "B".
-		"\xee\x01\x00",     // Compressed payload: tagCopy2,   length=60, offset=1.
-		"\x0d\x01",         // Compressed payload: tagCopy1,   length=7,  offset=1.
-		"\x08\x65\x66\x43", // Compressed payload: tagLiteral, length=3,  "efC".
-		"\x4e\x01\x00",     // Compressed payload: tagCopy2,   length=20, offset=1.
-		"\x4e\x5a\x00",     // Compressed payload: tagCopy2,   length=20, offset=90.
-		"\x00\x67",         // Compressed payload: tagLiteral, length=1,  "g".
-	}, "")
-	if got != want {
-		t.Fatalf("\ngot:  % x\nwant: % x", got, want)
+	// Corrupt the checksum of the second data chunk, which follows the stream
+	// identifier and the first chunk.
+	stream := buf.Bytes()
+	first := len(magicChunk) + chunkHeaderSize + (int(stream[len(magicChunk)+1]) | int(stream[len(magicChunk)+2])<<8)
+	stream[first+chunkHeaderSize] ^= 0xff
+
+	var mismatches []int
+	n := 0
+	err := AuditFramed(bytes.NewReader(stream), func(i int, decoded []byte, stored, computed uint32) error {
+		if i != n {
+			t.Errorf("block index: got %d, want %d", i, n)
+		}
+		if !bytes.Equal(decoded, blocks[i]) {
+			t.Errorf("block #%d: decoded bytes differ", i)
+		}
+		if stored != computed {
+			mismatches = append(mismatches, i)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("AuditFramed: %v", err)
+	}
+	if n != len(blocks) || fmt.Sprint(mismatches) != "[1]" {
+		t.Errorf("got %d blocks, mismatches %v; want %d blocks, mismatches [1]", n, mismatches, len(blocks))
+	}
+
+	errStop := errors.New("stop")
+	err = AuditFramed(bytes.NewReader(stream), func(int, []byte, uint32, uint32) error {
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("fn error: got %v, want %v", err, errStop)
 	}
 }
 
-func TestEmitLiteral(t *testing.T) {
-	testCases := []struct {
-		length int
-		want   string
-	}{
-		{1, "\x00"},
-		{2, "\x04"},
-		{59, "\xe8"},
-		{60, "\xec"},
-		{61, "\xf0\x3c"},
-		{62, "\xf0\x3d"},
-		{254, "\xf0\xfd"},
-		{255, "\xf0\xfe"},
-		{256, "\xf0\xff"},
-		{257, "\xf4\x00\x01"},
-		{65534, "\xf4\xfd\xff"},
-		{65535, "\xf4\xfe\xff"},
-		{65536, "\xf4\xff\xff"},
+func TestSplitFramed(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf, ParameterHeader(nil))
+	var blocks []string
+	for i := 0; i < 50; i++ {
+		b := fmt.Sprintf("%03d:%s", i, smallRecord(rng, rng.Intn(20000)))
+		blocks = append(blocks, b)
+		w.Write([]byte(b))
+		w.Flush()
 	}
+	w.PadTo(4096)
+	w.Close()
 
-	dst := make([]byte, 70000)
-	nines := bytes.Repeat([]byte{0x99}, 65536)
-	for _, tc := range testCases {
-		lit := nines[:tc.length]
-		n := emitLiteral(dst, lit)
-		if !bytes.HasSuffix(dst[:n], lit) {
-			t.Errorf("length=%d: did not end with that many literal bytes", tc.length)
-			continue
+	shards := make([]*bytes.Buffer, 3)
+	out := make([]io.Writer, len(shards))
+	for i := range shards {
+		shards[i] = new(bytes.Buffer)
+		out[i] = shards[i]
+	}
+	if err := SplitFramed(bytes.NewReader(buf.Bytes()), len(shards), out); err != nil {
+		t.Fatalf("SplitFramed: %v", err)
+	}
+	seen := make([]bool, len(blocks))
+	for i, shard := range shards {
+		if shard.Len() < buf.Len()/len(shards)/2 {
+			t.Errorf("shard #%d: %d bytes of %d in all", i, shard.Len(), buf.Len())
 		}
-		got := string(dst[:n-tc.length])
-		if got != tc.want {
-			t.Errorf("length=%d:\ngot  % x\nwant % x", tc.length, got, tc.want)
-			continue
+		r := NewReader(shard)
+		prev := -1
+		for {
+			b, err := r.ReadBlock()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("shard #%d: %v", i, err)
+			}
+			var j int
+			fmt.Sscanf(string(b), "%03d:", &j)
+			if j <= prev || j >= len(blocks) || string(b) != blocks[j] || seen[j] {
+				t.Fatalf("shard #%d: unexpected block %q after block %d", i, b[:4], prev)
+			}
+			seen[j], prev = true, j
+		}
+	}
+	for j, ok := range seen {
+		if !ok {
+			t.Errorf("block %d is missing", j)
 		}
 	}
-}
-
-func TestEmitCopy(t *testing.T) {
-	testCases := []struct {
-		offset int
-		length int
-		want   string
-	}{
-		{8, 04, "\x01\x08"},
-		{8, 11, "\x1d\x08"},
-		{8, 12, "\x2e\x08\x00"},
-		{8, 13, "\x32\x08\x00"},
-		{8, 59, "\xea\x08\x00"},
-		{8, 60, "\xee\x08\x00"},
-		{8, 61, "\xf2\x08\x00"},
-		{8, 62, "\xf6\x08\x00"},
-		{8, 63, "\xfa\x08\x00"},
-		{8, 64, "\xfe\x08\x00"},
-		{8, 65, "\xee\x08\x00\x05\x08"},
-		{8, 66, "\xee\x08\x00\x09\x08"},
-		{8, 67, "\xee\x08\x00\x0d\x08"},
-		{8, 68, "\xfe\x08\x00\x01\x08"},
-		{8, 69, "\xfe\x08\x00\x05\x08"},
-		{8, 80, "\xfe\x08\x00\x3e\x08\x00"},
 
-		{256, 04, "\x21\x00"},
-		{256, 11, "\x3d\x00"},
-		{256, 12, "\x2e\x00\x01"},
-		{256, 13, "\x32\x00\x01"},
-		{256, 59, "\xea\x00\x01"},
-		{256, 60, "\xee\x00\x01"},
-		{256, 61, "\xf2\x00\x01"},
-		{256, 62, "\xf6\x00\x01"},
-		{256, 63, "\xfa\x00\x01"},
-		{256, 64, "\xfe\x00\x01"},
-		{256, 65, "\xee\x00\x01\x25\x00"},
-		{256, 66, "\xee\x00\x01\x29\x00"},
-		{256, 67, "\xee\x00\x01\x2d\x00"},
-		{256, 68, "\xfe\x00\x01\x21\x00"},
-		{256, 69, "\xfe\x00\x01\x25\x00"},
-		{256, 80, "\xfe\x00\x01\x3e\x00\x01"},
+	if err := SplitFramed(bytes.NewReader(buf.Bytes()), 2, out); err == nil {
+		t.Errorf("mismatched shards: got nil error")
+	}
+}
 
-		{2048, 04, "\x0e\x00\x08"},
-		{2048, 11, "\x2a\x00\x08"},
-		{2048, 12, "\x2e\x00\x08"},
-		{2048, 13, "\x32\x00\x08"},
-		{2048, 59, "\xea\x00\x08"},
-		{2048, 60, "\xee\x00\x08"},
-		{2048, 61, "\xf2\x00\x08"},
-		{2048, 62, "\xf6\x00\x08"},
-		{2048, 63, "\xfa\x00\x08"},
-		{2048, 64, "\xfe\x00\x08"},
-		{2048, 65, "\xee\x00\x08\x12\x00\x08"},
-		{2048, 66, "\xee\x00\x08\x16\x00\x08"},
-		{2048, 67, "\xee\x00\x08\x1a\x00\x08"},
-		{2048, 68, "\xfe\x00\x08\x0e\x00\x08"},
-		{2048, 69, "\xfe\x00\x08\x12\x00\x08"},
-		{2048, 80, "\xfe\x00\x08\x3e\x00\x08"},
+func TestRawBlockWriter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 200000)
+	for i := range src {
+		src[i] = "raw"[rng.Intn(3)]
+	}
+	buf := new(bytes.Buffer)
+	w := NewRawBlockWriter(buf)
+	for n := 0; n < len(src); {
+		m := rng.Intn(100000)
+		if m > len(src)-n {
+			m = len(src) - n
+		}
+		if _, err := w.Write(src[n : n+m]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		n += m
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Errorf("Write after Close: got nil error, want non-nil")
 	}
 
-	dst := make([]byte, 1024)
-	for _, tc := range testCases {
-		n := emitCopy(dst, tc.offset, tc.length)
-		got := string(dst[:n])
-		if got != tc.want {
-			t.Errorf("offset=%d, length=%d:\ngot  % x\nwant % x", tc.offset, tc.length, got, tc.want)
+	enc := buf.Bytes()
+	var got []byte
+	var lens []int
+	for len(enc) > 0 {
+		n, k := binary.Uvarint(enc)
+		if k <= 0 || uint64(len(enc)-k) < n {
+			t.Fatalf("bad length prefix")
+		}
+		b, err := Decode(nil, enc[k:k+int(n)])
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
 		}
+		got = append(got, b...)
+		lens = append(lens, len(b))
+		enc = enc[k+int(n):]
+	}
+	if !bytes.Equal(got, src) {
+		t.Fatalf("decoded data differs")
+	}
+	if want := []int{maxBlockSize, maxBlockSize, maxBlockSize, len(src) - 3*maxBlockSize}; fmt.Sprint(lens) != fmt.Sprint(want) {
+		t.Errorf("block lengths: got %v, want %v", lens, want)
 	}
 }
 
-func TestNewBufferedWriter(t *testing.T) {
-	// Test all 32 possible sub-sequences of these 5 input slices.
-	//
-	// Their lengths sum to 400,000, which is over 6 times the Writer ibuf
-	// capacity: 6 * maxBlockSize is 393,216.
-	inputs := [][]byte{
-		bytes.Repeat([]byte{'a'}, 40000),
-		bytes.Repeat([]byte{'b'}, 150000),
-		bytes.Repeat([]byte{'c'}, 60000),
-		bytes.Repeat([]byte{'d'}, 120000),
-		bytes.Repeat([]byte{'e'}, 30000),
+func TestWriterFlushOnByte(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf, FlushOnByte('\n'))
+	// readable returns what a consumer tailing the output can read so far.
+	readable := func() string {
+		got, err := ioutil.ReadAll(NewReader(bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		return string(got)
 	}
-loop:
-	for i := 0; i < 1<<uint(len(inputs)); i++ {
-		var want []byte
-		buf := new(bytes.Buffer)
-		w := NewBufferedWriter(buf)
-		for j, input := range inputs {
-			if i&(1<<uint(j)) == 0 {
-				continue
+	chunks := func() int {
+		r := NewReader(bytes.NewReader(buf.Bytes()))
+		n := 0
+		for {
+			chunkType, _, err := r.NextChunk()
+			if err != nil {
+				return n
 			}
-			if _, err := w.Write(input); err != nil {
-				t.Errorf("i=%#02x: j=%d: Write: %v", i, j, err)
-				continue loop
+			if chunkType == chunkTypeCompressedData || chunkType == chunkTypeUncompressedData {
+				n++
 			}
-			want = append(want, input...)
 		}
-		if err := w.Close(); err != nil {
-			t.Errorf("i=%#02x: Close: %v", i, err)
-			continue
+	}
+
+	w.Write([]byte("partial"))
+	if got := readable(); got != "" {
+		t.Errorf("no newline: readable %q, want nothing", got)
+	}
+	w.Write([]byte(" line\nsecond line\nthird"))
+	if got, want := readable(), "partial line\nsecond line\n"; got != want {
+		t.Errorf("after newlines: readable %q, want %q", got, want)
+	}
+	if n := chunks(); n != 1 {
+		t.Errorf("after newlines: %d chunks, want 1", n)
+	}
+	w.ReadFrom(strings.NewReader(" line\nfourth"))
+	if got, want := readable(), "partial line\nsecond line\nthird line\n"; got != want {
+		t.Errorf("after ReadFrom: readable %q, want %q", got, want)
+	}
+	w.Close()
+	if got, want := readable(), "partial line\nsecond line\nthird line\nfourth"; got != want {
+		t.Errorf("after Close: readable %q, want %q", got, want)
+	}
+}
+
+func TestParameterHeader(t *testing.T) {
+	src := bytes.Repeat([]byte("parameters "), 10000)
+	extra := map[string]string{"app": "archiver", "schema": "v3"}
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf, ParameterHeader(extra), BlockSize(4096))
+	w.Write(src)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	enc := buf.Bytes()
+	if enc[len(magicChunk)] != chunkTypeParams {
+		t.Fatalf("chunk after the stream identifier has type %#02x, want %#02x", enc[len(magicChunk)], chunkTypeParams)
+	}
+
+	r := NewReader(bytes.NewReader(enc))
+	p, ok := r.StreamParams()
+	want := StreamParams{Version: WriterVersion, BlockSize: 4096, Extra: extra}
+	if !ok || fmt.Sprint(p) != fmt.Sprint(want) {
+		t.Errorf("StreamParams: got %+v, %t, want %+v, true", p, ok, want)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, src) {
+		t.Errorf("ReadAll: err=%v, equal=%t", err, bytes.Equal(got, src))
+	}
+
+	// Reset writes the header again, and a stream without one has none.
+	buf.Reset()
+	w.Reset(buf)
+	w.Close()
+	if p, ok := NewReader(bytes.NewReader(buf.Bytes())).StreamParams(); !ok || p.BlockSize != 4096 {
+		t.Errorf("after Reset: got %+v, %t", p, ok)
+	}
+	buf.Reset()
+	w = NewBufferedWriter(buf)
+	w.Write(src)
+	w.Close()
+	if _, ok := NewReader(bytes.NewReader(buf.Bytes())).StreamParams(); ok {
+		t.Errorf("no header: got true, want false")
+	}
+
+	// Later versions' own parameters are ignored, but malformed bodies are
+	// rejected.
+	body := appendParamsString(appendParamsString(nil, "snappy.future"), "x")
+	body = appendParamsString(appendParamsString(body, paramsBlockSize), "100")
+	if p, ok := parseParams(body); !ok || p.BlockSize != 100 || p.Extra != nil {
+		t.Errorf("unknown key: got %+v, %t", p, ok)
+	}
+	if _, ok := parseParams(body[:len(body)-1]); ok {
+		t.Errorf("truncated: got true, want false")
+	}
+
+	if _, err := NewBufferedWriter(ioutil.Discard, ParameterHeader(map[string]string{"snappy.x": ""})).Write(src); err == nil {
+		t.Errorf("reserved key: got nil error, want non-nil")
+	}
+
+	// The header is only written with the first output, so the Writer can
+	// be created with a nil io.Writer and Reset later, and AddWriter can be
+	// called after Reset.
+	w = NewBufferedWriter(nil, ParameterHeader(extra))
+	primary, added := new(bytes.Buffer), new(bytes.Buffer)
+	w.Reset(primary)
+	if err := w.AddWriter(added); err != nil {
+		t.Fatalf("AddWriter: %v", err)
+	}
+	w.Write(src)
+	if err := w.Close(); err != nil {
+		t.Fatalf("nil, then Reset: Close: %v", err)
+	}
+	for _, b := range []*bytes.Buffer{primary, added} {
+		r := NewReader(bytes.NewReader(b.Bytes()))
+		if p, ok := r.StreamParams(); !ok || fmt.Sprint(p.Extra) != fmt.Sprint(extra) {
+			t.Errorf("nil, then Reset: StreamParams: got %+v, %t", p, ok)
 		}
-		got, err := ioutil.ReadAll(NewReader(buf))
-		if err != nil {
-			t.Errorf("i=%#02x: ReadAll: %v", i, err)
-			continue
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, src) {
+			t.Errorf("nil, then Reset: ReadAll: err=%v, equal=%t", err, bytes.Equal(got, src))
+		}
+	}
+
+	// A length-prefixed stream can have a parameter header too.
+	ws := &memWriteSeeker{}
+	w = NewLengthPrefixedWriter(ws, ParameterHeader(extra))
+	w.Write(src)
+	if err := w.Close(); err != nil {
+		t.Fatalf("length-prefixed: Close: %v", err)
+	}
+	r = NewReader(bytes.NewReader(ws.buf))
+	if p, ok := r.StreamParams(); !ok || fmt.Sprint(p.Extra) != fmt.Sprint(extra) {
+		t.Errorf("length-prefixed: StreamParams: got %+v, %t", p, ok)
+	}
+	if n, ok := r.StreamLength(); !ok || n != int64(len(src)) {
+		t.Errorf("length-prefixed: StreamLength: got %d, %t, want %d, true", n, ok, len(src))
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, src) {
+		t.Errorf("length-prefixed: ReadAll: err=%v, equal=%t", err, bytes.Equal(got, src))
+	}
+}
+
+func TestReaderSetTotalDecodedLimit(t *testing.T) {
+	src := bytes.Repeat([]byte("endless "), 50000)
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf, BlockSize(10000))
+	w.Write(src)
+	w.Close()
+	enc := buf.Bytes()
+
+	testCases := []struct {
+		limit   int64
+		wantLen int
+		wantErr error
+	}{
+		{0, len(src), nil},
+		{-1, len(src), nil},
+		{int64(len(src)), len(src), nil},
+		{int64(len(src)) - 1, len(src) - 10000, ErrDecodedLimit},
+		{25000, 20000, ErrDecodedLimit},
+		{1, 0, ErrDecodedLimit},
+	}
+	r := NewReader(nil)
+	for _, tc := range testCases {
+		r.Reset(bytes.NewReader(enc))
+		r.SetTotalDecodedLimit(tc.limit)
+		got, err := ioutil.ReadAll(r)
+		if err != tc.wantErr || len(got) != tc.wantLen {
+			t.Errorf("limit %d: got %d bytes, %v, want %d bytes, %v", tc.limit, len(got), err, tc.wantLen, tc.wantErr)
 		}
-		if err := cmp(got, want); err != nil {
-			t.Errorf("i=%#02x: %v", i, err)
-			continue
+		if !bytes.Equal(got, src[:len(got)]) {
+			t.Errorf("limit %d: decoded data differs", tc.limit)
 		}
 	}
 }
 
-func TestFlush(t *testing.T) {
+func TestWriterTryWrite(t *testing.T) {
+	data := smallRecord(rand.New(rand.NewSource(1)), 3*maxBlockSize)
 	buf := new(bytes.Buffer)
 	w := NewBufferedWriter(buf)
-	defer w.Close()
-	if _, err := w.Write(bytes.Repeat([]byte{'x'}, 20)); err != nil {
-		t.Fatalf("Write: %v", err)
+	for p := data; len(p) > 0; {
+		outLen := buf.Len()
+		n, err := w.TryWrite(p[:len(p)/2+1])
+		if buf.Len() != outLen {
+			t.Fatalf("TryWrite wrote to the underlying io.Writer")
+		}
+		if err == ErrWouldBlock {
+			if w.Available() != 0 {
+				t.Fatalf("ErrWouldBlock with %d bytes available", w.Available())
+			}
+			w.Flush()
+		} else if err != nil {
+			t.Fatalf("TryWrite: %v", err)
+		}
+		p = p[n:]
 	}
-	if n := buf.Len(); n != 0 {
-		t.Fatalf("before Flush: %d bytes were written to the underlying io.Writer, want 0", n)
+	w.Close()
+	if got, err := DecodeFramed(buf.Bytes()); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("round trip failed: %v", err)
 	}
-	if err := w.Flush(); err != nil {
-		t.Fatalf("Flush: %v", err)
+
+	w = NewBufferedWriter(ioutil.Discard, AutoFlushBytes(10))
+	if n, err := w.TryWrite([]byte("0123456789abc")); n != 10 || err != ErrWouldBlock {
+		t.Errorf("AutoFlushBytes(10): got %d, %v; want 10, ErrWouldBlock", n, err)
 	}
-	if n := buf.Len(); n == 0 {
-		t.Fatalf("after Flush: %d bytes were written to the underlying io.Writer, want non-0", n)
+	w = NewBufferedWriter(ioutil.Discard, FlushOnByte('\n'))
+	if n, err := w.TryWrite([]byte("ab\ncd")); n != 3 || err != ErrWouldBlock {
+		t.Errorf("FlushOnByte: got %d, %v; want 3, ErrWouldBlock", n, err)
+	}
+	if n, err := w.TryWrite([]byte("cd")); n != 0 || err != ErrWouldBlock {
+		t.Errorf("FlushOnByte, after delimiter: got %d, %v; want 0, ErrWouldBlock", n, err)
+	}
+	w.Flush()
+	if n, err := w.TryWrite([]byte("cd")); n != 2 || err != nil {
+		t.Errorf("FlushOnByte, after Flush: got %d, %v; want 2, nil", n, err)
+	}
+	if n, err := NewWriter(ioutil.Discard).TryWrite([]byte("x")); n != 0 || err != ErrWouldBlock {
+		t.Errorf("unbuffered: got %d, %v; want 0, ErrWouldBlock", n, err)
+	}
+	if _, err := NewCDCWriter(ioutil.Discard, 1024).TryWrite([]byte("x")); err == nil {
+		t.Errorf("CDC: got nil error")
 	}
 }
 
-func TestReaderUncompressedDataOK(t *testing.T) {
-	r := NewReader(strings.NewReader(magicChunk +
-		"\x01\x08\x00\x00" + // Uncompressed chunk, 8 bytes long (including 4 byte checksum).
-		"\x68\x10\xe6\xb6" + // Checksum.
-		"\x61\x62\x63\x64", // Uncompressed payload: "abcd".
-	))
-	g, err := ioutil.ReadAll(r)
-	if err != nil {
-		t.Fatal(err)
+func TestWriteRecord(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	records := make([][]byte, 10)
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	var offsets []int
+	for i := range records {
+		records[i] = make([]byte, rng.Intn(3*maxBlockSize/2))
+		for j := range records[i] {
+			records[i][j] = "wal"[rng.Intn(3)]
+		}
+		if i == 5 {
+			records[i] = nil
+		}
+		w.Flush()
+		offsets = append(offsets, buf.Len())
+		if err := w.WriteRecord(uint64(100+i), records[i]); err != nil {
+			t.Fatalf("WriteRecord: %v", err)
+		}
+		// Data outside of any record is ignored.
+		w.Write([]byte("noise"))
 	}
-	if got, want := string(g), "abcd"; got != want {
-		t.Fatalf("got %q, want %q", got, want)
+	w.Close()
+	framed := buf.Bytes()
+
+	// Plain Readers see all of the data.
+	if _, err := DecodeFramed(framed); err != nil {
+		t.Fatalf("DecodeFramed: %v", err)
 	}
-}
 
-func TestReaderUncompressedDataNoPayload(t *testing.T) {
-	r := NewReader(strings.NewReader(magicChunk +
-		"\x01\x04\x00\x00" + // Uncompressed chunk, 4 bytes long.
-		"", // No payload; corrupt input.
-	))
-	if _, err := ioutil.ReadAll(r); err != ErrCorrupt {
-		t.Fatalf("got %v, want %v", err, ErrCorrupt)
+	scan := func(framed []byte) (ids []int) {
+		err := ScanRecords(bytes.NewReader(framed), func(id uint64, data []byte) error {
+			i := int(id) - 100
+			if i < 0 || i >= len(records) || !bytes.Equal(data, records[i]) {
+				t.Fatalf("record %d: wrong data", id)
+			}
+			ids = append(ids, i)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ScanRecords: %v", err)
+		}
+		return ids
+	}
+	if got, want := fmt.Sprint(scan(framed)), "[0 1 2 3 4 5 6 7 8 9]"; got != want {
+		t.Fatalf("intact: got records %s, want %s", got, want)
 	}
-}
 
-func TestReaderUncompressedDataTooLong(t *testing.T) {
-	// https://github.com/google/snappy/blob/master/framing_format.txt section
-	// 4.3 says that "the maximum legal chunk length... is 65540", or 0x10004.
-	const n = 0x10005
+	// Damage record 3's data, and cut record 9 short.
+	damaged := append([]byte(nil), framed[:offsets[9]+100]...)
+	damaged[offsets[3]+200] ^= 0x55
+	if got, want := fmt.Sprint(scan(damaged)), "[0 1 2 4 5 6 7 8]"; got != want {
+		t.Fatalf("damaged: got records %s, want %s", got, want)
+	}
 
-	r := NewReader(strings.NewReader(magicChunk +
-		"\x01\x05\x00\x01" + // Uncompressed chunk, n bytes long.
-		strings.Repeat("\x00", n),
-	))
-	if _, err := ioutil.ReadAll(r); err != ErrCorrupt {
-		t.Fatalf("got %v, want %v", err, ErrCorrupt)
+	// Start scanning in the middle of a record.
+	if got, want := fmt.Sprint(scan(framed[offsets[6]+10:])), "[7 8 9]"; got != want {
+		t.Fatalf("mid-stream: got records %s, want %s", got, want)
+	}
+
+	errStop := errors.New("stop")
+	if err := ScanRecords(bytes.NewReader(framed), func(uint64, []byte) error { return errStop }); err != errStop {
+		t.Fatalf("failing fn: got %v, want %v", err, errStop)
 	}
 }
 
-func TestReaderReset(t *testing.T) {
-	gold := bytes.Repeat([]byte("All that is gold does not glitter,\n"), 10000)
+func TestMessageWriter(t *testing.T) {
+	messages := [][]byte{
+		[]byte("hello"),
+		nil,
+		bytes.Repeat([]byte("0123456789"), 20000),
+		[]byte("world"),
+	}
 	buf := new(bytes.Buffer)
-	if _, err := NewWriter(buf).Write(gold); err != nil {
-		t.Fatalf("Write: %v", err)
+	m := NewMessageWriter(buf)
+	var want []byte
+	for i, msg := range messages {
+		n := buf.Len()
+		if err := m.WriteMessage(msg); err != nil {
+			t.Fatalf("#%d: WriteMessage: %v", i, err)
+		}
+		if buf.Len() == n {
+			t.Fatalf("#%d: WriteMessage did not write to the underlying io.Writer", i)
+		}
+		want = append(want, msg...)
 	}
-	encoded, invalid, partial := buf.String(), "invalid", "partial"
-	r := NewReader(nil)
-	for i, s := range []string{encoded, invalid, partial, encoded, partial, invalid, encoded, encoded} {
-		if s == partial {
-			r.Reset(strings.NewReader(encoded))
-			if _, err := r.Read(make([]byte, 101)); err != nil {
-				t.Errorf("#%d: %v", i, err)
-				continue
-			}
-			continue
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	encoded := buf.Bytes()
+
+	// A plain Reader skips the end-of-message markers.
+	got, err := ioutil.ReadAll(NewReader(bytes.NewReader(encoded)))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := cmp(got, want); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(bytes.NewReader(encoded))
+	for i, msg := range messages {
+		got, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("#%d: ReadMessage: %v", i, err)
 		}
-		r.Reset(strings.NewReader(s))
-		got, err := ioutil.ReadAll(r)
-		switch s {
-		case encoded:
-			if err != nil {
-				t.Errorf("#%d: %v", i, err)
-				continue
-			}
-			if err := cmp(got, gold); err != nil {
-				t.Errorf("#%d: %v", i, err)
-				continue
-			}
-		case invalid:
-			if err == nil {
-				t.Errorf("#%d: got nil error, want non-nil", i)
-				continue
-			}
+		if err := cmp(got, msg); err != nil {
+			t.Fatalf("#%d: %v", i, err)
 		}
 	}
-}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Fatalf("at end: got %v, want io.EOF", err)
+	}
 
-func TestWriterReset(t *testing.T) {
-	gold := bytes.Repeat([]byte("Not all those who wander are lost;\n"), 10000)
-	const n = 20
-	for _, buffered := range []bool{false, true} {
-		var w *Writer
-		if buffered {
-			w = NewBufferedWriter(nil)
-			defer w.Close()
-		} else {
-			w = NewWriter(nil)
+	// Truncating the final end-of-message marker leaves a partial message.
+	r = NewReader(bytes.NewReader(encoded[:len(encoded)-len("\x80\x01\x00\x00\x05")]))
+	for i := 0; i < len(messages)-1; i++ {
+		if _, err := r.ReadMessage(); err != nil {
+			t.Fatalf("truncated: #%d: ReadMessage: %v", i, err)
 		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadMessage(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("truncated: call #%d: got %v, want io.ErrUnexpectedEOF", i, err)
+		}
+	}
+}
 
-		var gots, wants [][]byte
-		failed := false
-		for i := 0; i <= n; i++ {
-			buf := new(bytes.Buffer)
-			w.Reset(buf)
-			want := gold[:len(gold)*i/n]
-			if _, err := w.Write(want); err != nil {
-				t.Errorf("#%d: Write: %v", i, err)
-				failed = true
-				continue
-			}
-			if buffered {
-				if err := w.Flush(); err != nil {
-					t.Errorf("#%d: Flush: %v", i, err)
-					failed = true
-					continue
-				}
+func TestMessageWriterChecksum(t *testing.T) {
+	messages := [][]byte{
+		[]byte("hello"),
+		nil,
+		bytes.Repeat([]byte("0123456789"), 20000),
+		[]byte("world"),
+	}
+	for _, sum := range []func([]byte) uint32{nil, crc32.ChecksumIEEE} {
+		buf := new(bytes.Buffer)
+		m := NewMessageWriterWithChecksum(buf, sum)
+		var want []byte
+		for i, msg := range messages {
+			if err := m.WriteMessage(msg); err != nil {
+				t.Fatalf("#%d: WriteMessage: %v", i, err)
 			}
-			got, err := ioutil.ReadAll(NewReader(buf))
+			want = append(want, msg...)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		encoded := buf.Bytes()
+
+		// A plain Reader skips the end-of-message markers.
+		got, err := ioutil.ReadAll(NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if err := cmp(got, want); err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewReader(bytes.NewReader(encoded))
+		r.SetMessageChecksum(sum)
+		for i, msg := range messages {
+			got, err := r.ReadMessage()
 			if err != nil {
-				t.Errorf("#%d: ReadAll: %v", i, err)
-				failed = true
-				continue
+				t.Fatalf("#%d: ReadMessage: %v", i, err)
+			}
+			if err := cmp(got, msg); err != nil {
+				t.Fatalf("#%d: %v", i, err)
 			}
-			gots = append(gots, got)
-			wants = append(wants, want)
 		}
-		if failed {
-			continue
+		if _, err := r.ReadMessage(); err != io.EOF {
+			t.Fatalf("at end: got %v, want io.EOF", err)
 		}
-		for i := range gots {
-			if err := cmp(gots[i], wants[i]); err != nil {
-				t.Errorf("#%d: %v", i, err)
-			}
+
+		// Reading with the wrong checksum function fails every message.
+		r.Reset(bytes.NewReader(encoded))
+		r.SetMessageChecksum(func(p []byte) uint32 { return crc32c(p) ^ crc32.ChecksumIEEE(p) ^ 1 })
+		if _, err := r.ReadMessage(); err != ErrMessageChecksum {
+			t.Fatalf("wrong sum: got %v, want ErrMessageChecksum", err)
 		}
 	}
-}
 
-func TestWriterResetWithoutFlush(t *testing.T) {
-	buf0 := new(bytes.Buffer)
-	buf1 := new(bytes.Buffer)
-	w := NewBufferedWriter(buf0)
-	if _, err := w.Write([]byte("xxx")); err != nil {
-		t.Fatalf("Write #0: %v", err)
-	}
-	// Note that we don't Flush the Writer before calling Reset.
-	w.Reset(buf1)
-	if _, err := w.Write([]byte("yyy")); err != nil {
-		t.Fatalf("Write #1: %v", err)
-	}
-	if err := w.Flush(); err != nil {
-		t.Fatalf("Flush: %v", err)
-	}
-	got, err := ioutil.ReadAll(NewReader(buf1))
-	if err != nil {
-		t.Fatalf("ReadAll: %v", err)
-	}
-	if err := cmp(got, []byte("yyy")); err != nil {
-		t.Fatal(err)
+	// A message with a bad checksum does not stop the messages after it, and
+	// messages without checksums are not checked.
+	buf := new(bytes.Buffer)
+	m := NewMessageWriter(buf)
+	m.WriteMessage([]byte("first"))
+	m.WriteMessageSum([]byte("second"), 0)
+	m.WriteMessageSum([]byte("third"), crc32c([]byte("third")))
+	m.WriteMessage([]byte("fourth"))
+	m.Close()
+	r := NewReader(buf)
+	for _, want := range []struct {
+		msg string
+		err error
+	}{
+		{"first", nil},
+		{"", ErrMessageChecksum},
+		{"third", nil},
+		{"fourth", nil},
+		{"", io.EOF},
+	} {
+		got, err := r.ReadMessage()
+		if string(got) != want.msg || err != want.err {
+			t.Fatalf("got %q, %v, want %q, %v", got, err, want.msg, want.err)
+		}
 	}
 }
 
@@ -1351,3 +5643,158 @@ func BenchmarkExtendMatch(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkCRC(b *testing.B) {
+	src := make([]byte, maxBlockSize)
+	rng := rand.New(rand.NewSource(1))
+	for i := range src {
+		src[i] = uint8(rng.Intn(256))
+	}
+	softTable := *crcTable
+	b.Run("table=castagnoli", func(b *testing.B) {
+		b.SetBytes(int64(len(src)))
+		for i := 0; i < b.N; i++ {
+			crc32.Update(0, crcTable, src)
+		}
+	})
+	b.Run("table=portable", func(b *testing.B) {
+		b.SetBytes(int64(len(src)))
+		for i := 0; i < b.N; i++ {
+			crc32.Update(0, &softTable, src)
+		}
+	})
+}
+
+// BenchmarkWriterIncompressible measures the Writer's throughput on input for
+// which the encoder gives up quickly, so that the checksum is a large part of
+// the cost of each block.
+func BenchmarkWriterIncompressible(b *testing.B) {
+	src := make([]byte, 1<<20)
+	rng := rand.New(rand.NewSource(1))
+	for i := range src {
+		src[i] = uint8(rng.Intn(256))
+	}
+	w := NewBufferedWriter(ioutil.Discard)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.Reset(ioutil.Discard)
+		w.Write(src)
+		w.Flush()
+	}
+}
+
+func benchSmallEncoder(b *testing.B, n int, useEncoder bool) {
+	src := expand([]byte("abcdefghijklmnopqrstuvwxyz 0123456789 the quick brown fox "), n)
+	dst := make([]byte, MaxEncodedLen(n))
+	e := NewEncoder()
+	b.SetBytes(int64(n))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if useEncoder {
+			e.Encode(dst, src)
+		} else {
+			Encode(dst, src)
+		}
+	}
+}
+
+func BenchmarkEncodeSmall100(b *testing.B)          { benchSmallEncoder(b, 100, false) }
+func BenchmarkEncodeSmall1000(b *testing.B)         { benchSmallEncoder(b, 1000, false) }
+func BenchmarkEncodeSmall10000(b *testing.B)        { benchSmallEncoder(b, 10000, false) }
+func BenchmarkEncoderEncodeSmall100(b *testing.B)   { benchSmallEncoder(b, 100, true) }
+func BenchmarkEncoderEncodeSmall1000(b *testing.B)  { benchSmallEncoder(b, 1000, true) }
+func BenchmarkEncoderEncodeSmall10000(b *testing.B) { benchSmallEncoder(b, 10000, true) }
+
+func benchReaderSmallChunks(b *testing.B, wrap func(io.Reader) io.Reader) {
+	data := readFile(b, filepath.Join(filepath.FromSlash(*testdataDir), goldenText))
+	buf := new(bytes.Buffer)
+	w := NewBufferedWriter(buf)
+	for i := 0; i < len(data); i += 512 {
+		j := i + 512
+		if j > len(data) {
+			j = len(data)
+		}
+		w.Write(data[i:j])
+		w.Flush()
+	}
+	w.Close()
+	framed := buf.Bytes()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	r := NewReader(nil)
+	for i := 0; i < b.N; i++ {
+		r.Reset(wrap(bytes.NewReader(framed)))
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReaderSmallChunks{Bufio,Wrapped} compare decoding from a
+// *bufio.Reader with the same reader hidden behind another type, which
+// disables the Reader's in-place decoding of chunk bodies.
+func BenchmarkReaderSmallChunksBufio(b *testing.B) {
+	br := bufio.NewReader(nil)
+	benchReaderSmallChunks(b, func(r io.Reader) io.Reader {
+		br.Reset(r)
+		return br
+	})
+}
+
+func BenchmarkReaderSmallChunksWrapped(b *testing.B) {
+	br := bufio.NewReader(nil)
+	benchReaderSmallChunks(b, func(r io.Reader) io.Reader {
+		br.Reset(r)
+		return struct{ io.Reader }{br}
+	})
+}
+
+// slowReader is an io.Reader that waits for a while before each Read, like a
+// network connection.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	if len(p) > 16384 {
+		p = p[:16384]
+	}
+	return r.r.Read(p)
+}
+
+// benchSlowSource decodes from a slow source to a consumer that is also slow to
+// process each piece of data, with or without prefetching.
+func benchSlowSource(b *testing.B, prefetch bool) {
+	data := readFile(b, filepath.Join(filepath.FromSlash(*testdataDir), goldenText))
+	data = bytes.Repeat(data, 32)
+	framed := EncodeFramed(data)
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	buf := make([]byte, 16384)
+	for i := 0; i < b.N; i++ {
+		src := &slowReader{bytes.NewReader(framed), 100 * time.Microsecond}
+		var r io.Reader = NewReader(src)
+		if prefetch {
+			r = NewPrefetchReader(src, 4)
+		}
+		for {
+			_, err := r.Read(buf)
+			// Stand in for processing the data.
+			time.Sleep(100 * time.Microsecond)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkReaderSlowSource(b *testing.B)         { benchSlowSource(b, false) }
+func BenchmarkPrefetchReaderSlowSource(b *testing.B) { benchSlowSource(b, true) }
@@ -0,0 +1,170 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package snappybench measures the compression ratio and speed of Snappy, or
+// of another codec, on a corpus of files, so that codecs can be compared on
+// the same data in the same way. The corpus is typically a set of files such
+// as those of the Silesia or Calgary corpora, loaded with LoadFiles.
+//
+// Speeds are in bytes of uncompressed data per second, for both encoding and
+// decoding, as with the package's own benchmarks.
+package snappybench
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// A Codec is a block compression codec to be measured.
+type Codec struct {
+	// Name identifies the codec in reports.
+	Name string
+
+	// Encode and Decode have the semantics of snappy.Encode and
+	// snappy.Decode: the result may be a sub-slice of dst, if dst is large
+	// enough.
+	Encode func(dst, src []byte) []byte
+	Decode func(dst, src []byte) ([]byte, error)
+}
+
+// Snappy is the Codec of snappy.Encode and snappy.Decode.
+var Snappy = Codec{
+	Name:   "snappy",
+	Encode: snappy.Encode,
+	Decode: snappy.Decode,
+}
+
+// A Result is the outcome of measuring a Codec on a corpus.
+type Result struct {
+	// Codec is the name of the Codec.
+	Codec string
+
+	// UncompressedBytes and CompressedBytes are the total sizes of the
+	// corpus's files before and after compression.
+	UncompressedBytes int64
+	CompressedBytes   int64
+
+	// EncodePasses and DecodePasses are the numbers of times that the whole
+	// corpus was encoded and decoded, and EncodeTime and DecodeTime are the
+	// total times taken to do so.
+	EncodePasses int
+	DecodePasses int
+	EncodeTime   time.Duration
+	DecodeTime   time.Duration
+}
+
+// Ratio returns the compression ratio, the uncompressed size divided by the
+// compressed size, so that larger is better.
+func (r Result) Ratio() float64 {
+	if r.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(r.UncompressedBytes) / float64(r.CompressedBytes)
+}
+
+// EncodeMBps and DecodeMBps return the encoding and decoding speeds, in
+// megabytes (10^6 bytes) of uncompressed data per second.
+func (r Result) EncodeMBps() float64 { return r.mbps(r.EncodePasses, r.EncodeTime) }
+func (r Result) DecodeMBps() float64 { return r.mbps(r.DecodePasses, r.DecodeTime) }
+
+func (r Result) mbps(passes int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(r.UncompressedBytes) * float64(passes) / d.Seconds() / 1e6
+}
+
+// String formats the result as a single line for a report.
+func (r Result) String() string {
+	return fmt.Sprintf("%s: ratio %.3f, encode %.1f MB/s, decode %.1f MB/s",
+		r.Codec, r.Ratio(), r.EncodeMBps(), r.DecodeMBps())
+}
+
+// ErrMismatch is returned by Run when a codec does not decode a file back to
+// its original contents.
+var ErrMismatch = errors.New("snappybench: decoded data does not match the original")
+
+// Benchmark measures Snappy on corpus, for about a second each of encoding
+// and decoding. It panics if Snappy fails to round trip a file, which would
+// be a bug in package snappy.
+func Benchmark(corpus [][]byte) Result {
+	r, err := Run(Snappy, corpus, time.Second)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Run measures c on corpus. Each file is first encoded and decoded once, to
+// check that it round trips and to measure its compressed size. Then the
+// whole corpus is encoded, and then decoded, as many times as fit in about d
+// each, and at least once. The buffers are allocated before the timing
+// starts, so that only the codec is timed: the encoding buffer of each file is
+// 1.5 times its size plus 64 bytes, which is enough for Snappy.
+//
+// It returns an error, which is ErrMismatch or wraps the error from c.Decode,
+// if a file does not round trip.
+func Run(c Codec, corpus [][]byte, d time.Duration) (Result, error) {
+	r := Result{Codec: c.Name}
+	encoded := make([][]byte, len(corpus))
+	for i, src := range corpus {
+		enc := c.Encode(nil, src)
+		dec, err := c.Decode(nil, enc)
+		if err != nil {
+			return Result{}, fmt.Errorf("snappybench: %s: file #%d: %w", c.Name, i, err)
+		}
+		if !bytes.Equal(dec, src) {
+			return Result{}, ErrMismatch
+		}
+		encoded[i] = enc
+		r.UncompressedBytes += int64(len(src))
+		r.CompressedBytes += int64(len(enc))
+	}
+
+	dsts := make([][]byte, len(corpus))
+	for i, src := range corpus {
+		dsts[i] = make([]byte, len(src)+len(src)/2+64)
+	}
+	start := time.Now()
+	for r.EncodePasses == 0 || time.Since(start) < d {
+		for i, src := range corpus {
+			c.Encode(dsts[i], src)
+		}
+		r.EncodePasses++
+	}
+	r.EncodeTime = time.Since(start)
+
+	for i, src := range corpus {
+		dsts[i] = dsts[i][:len(src)]
+	}
+	start = time.Now()
+	for r.DecodePasses == 0 || time.Since(start) < d {
+		for i, enc := range encoded {
+			if _, err := c.Decode(dsts[i], enc); err != nil {
+				return Result{}, fmt.Errorf("snappybench: %s: file #%d: %w", c.Name, i, err)
+			}
+		}
+		r.DecodePasses++
+	}
+	r.DecodeTime = time.Since(start)
+	return r, nil
+}
+
+// LoadFiles reads the named files into a corpus.
+func LoadFiles(names ...string) ([][]byte, error) {
+	corpus := make([][]byte, len(names))
+	for i, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		corpus[i] = b
+	}
+	return corpus, nil
+}
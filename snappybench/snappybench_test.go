@@ -0,0 +1,62 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappybench
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func TestRun(t *testing.T) {
+	corpus, err := LoadFiles("../testdata/Mark.Twain-Tom.Sawyer.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpus = append(corpus, nil, bytes.Repeat([]byte("a"), 1000))
+	r, err := Run(Snappy, corpus, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := int64(0)
+	for _, f := range corpus {
+		want += int64(len(snappy.Encode(nil, f)))
+	}
+	if r.CompressedBytes != want {
+		t.Errorf("CompressedBytes: got %d, want %d", r.CompressedBytes, want)
+	}
+	if r.Ratio() <= 1 || r.EncodeMBps() <= 0 || r.DecodeMBps() <= 0 || r.EncodePasses < 1 || r.DecodePasses < 1 {
+		t.Errorf("implausible result: %+v", r)
+	}
+
+	broken := Snappy
+	broken.Decode = func(dst, src []byte) ([]byte, error) {
+		dst, err := snappy.Decode(dst, src)
+		if len(dst) > 0 {
+			dst[0]++
+		}
+		return dst, err
+	}
+	if _, err := Run(broken, corpus, time.Millisecond); err != ErrMismatch {
+		t.Errorf("broken codec: got %v, want ErrMismatch", err)
+	}
+
+	failing := Snappy
+	failing.Decode = func(dst, src []byte) ([]byte, error) {
+		return nil, snappy.ErrCorrupt
+	}
+	if _, err := Run(failing, corpus, time.Millisecond); !errors.Is(err, snappy.ErrCorrupt) {
+		t.Errorf("failing codec: got %v, want an error wrapping ErrCorrupt", err)
+	}
+}
+
+func TestLoadFiles(t *testing.T) {
+	if _, err := LoadFiles("../testdata/no-such-file"); err == nil {
+		t.Errorf("missing file: got nil error")
+	}
+}
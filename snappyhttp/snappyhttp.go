@@ -0,0 +1,187 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package snappyhttp uses the Snappy framing format as an HTTP content coding,
+// named by ContentEncoding, for compressing request and response bodies.
+//
+// Decoder wraps a server's http.Handler, and Transport wraps a client's
+// http.RoundTripper. Between them, request bodies are compressed by the client
+// and decompressed by the server, and response bodies are compressed by the
+// server and decompressed by the client. Either side interoperates with peers
+// that do not use this package: bodies are only compressed when the peer is
+// known to accept them, and only decompressed when they are marked as such.
+package snappyhttp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+// ContentEncoding is the value of the Content-Encoding and Accept-Encoding
+// headers that denotes the Snappy framing format.
+const ContentEncoding = "x-snappy-framed"
+
+// Decoder returns an http.Handler that calls next with the request body
+// decompressed, if the request's Content-Encoding is ContentEncoding. In that
+// case, the Content-Encoding header is removed and the ContentLength is set to
+// -1, as the decompressed length is not known in advance.
+//
+// If the request's Accept-Encoding lists ContentEncoding, the response body
+// written by next is compressed, unless next sets its own Content-Encoding.
+func Decoder(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == ContentEncoding {
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			r.Body = snappy.NewReadCloser(r.Body)
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsSnappy(r.Header) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &encodingResponseWriter{ResponseWriter: w}
+		defer ew.close()
+		next.ServeHTTP(ew, r)
+	})
+}
+
+// acceptsSnappy returns whether h's Accept-Encoding lists ContentEncoding.
+func acceptsSnappy(h http.Header) bool {
+	for _, v := range h["Accept-Encoding"] {
+		for _, coding := range strings.Split(v, ",") {
+			if i := strings.IndexByte(coding, ';'); i >= 0 {
+				coding = coding[:i]
+			}
+			if strings.TrimSpace(coding) == ContentEncoding {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodingResponseWriter compresses the response body, once the handler has
+// written the header without choosing a Content-Encoding of its own.
+type encodingResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	sw          *snappy.Writer
+}
+
+func (w *encodingResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if h.Get("Content-Encoding") == "" && code != http.StatusNoContent && code != http.StatusNotModified {
+		h.Set("Content-Encoding", ContentEncoding)
+		h.Del("Content-Length")
+		w.sw = snappy.NewBufferedWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *encodingResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.sw == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.sw.Write(p)
+}
+
+// Flush implements http.Flusher, flushing both the compressed data and, if it
+// can, the underlying ResponseWriter.
+func (w *encodingResponseWriter) Flush() {
+	if w.sw != nil {
+		w.sw.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *encodingResponseWriter) close() {
+	if w.sw != nil {
+		w.sw.Close()
+	}
+}
+
+// Transport is an http.RoundTripper that compresses request bodies and
+// decompresses response bodies, using the Snappy framing format.
+//
+// Request bodies are only compressed if Compress is set, as the server must
+// be known to accept them, such as by being wrapped by Decoder. Responses are
+// requested compressed by setting Accept-Encoding, unless the request already
+// sets it, and are decompressed if their Content-Encoding is ContentEncoding.
+// As with the standard library's transparent gzip support, a decompressed
+// response has its Content-Encoding and Content-Length headers removed, its
+// ContentLength set to -1 and its Uncompressed field set.
+type Transport struct {
+	// Base is the RoundTripper used to make the underlying requests. If nil,
+	// http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// Compress is whether to compress request bodies.
+	Compress bool
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// A RoundTripper must not modify the request, so make a copy.
+	req = req.Clone(req.Context())
+	requested := false
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", ContentEncoding)
+		requested = true
+	}
+	if t.Compress && req.Body != nil && req.Body != http.NoBody && req.Header.Get("Content-Encoding") == "" {
+		req.Header.Set("Content-Encoding", ContentEncoding)
+		req.ContentLength = -1
+		req.GetBody = nil
+		req.Body = compressBody(req.Body)
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if requested && resp.Header.Get("Content-Encoding") == ContentEncoding {
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+		resp.Body = snappy.NewReadCloser(resp.Body)
+	}
+	return resp, nil
+}
+
+// compressBody returns a reader of the compressed form of body, which is
+// compressed on the fly by another goroutine. That goroutine exits, closing
+// body, once it has reached the end of body or the returned reader is closed.
+func compressBody(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		sw := snappy.NewBufferedWriter(pw)
+		_, err := io.Copy(sw, body)
+		if err == nil {
+			err = sw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappyhttp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+// echoHandler responds with the request body, and records the request headers
+// as seen by the handler.
+type echoHandler struct {
+	contentEncoding string
+}
+
+func (h *echoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.contentEncoding = r.Header.Get("Content-Encoding")
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(body)
+}
+
+func TestRoundTrip(t *testing.T) {
+	h := &echoHandler{}
+	var wireEncoding string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wireEncoding = r.Header.Get("Content-Encoding")
+		Decoder(h).ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	body := strings.Repeat("compress me, compress me not\n", 1000)
+	for _, compress := range []bool{false, true} {
+		client := &http.Client{Transport: &Transport{Compress: compress}}
+		resp, err := client.Post(s.URL, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("compress=%t: Post: %v", compress, err)
+		}
+		got, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("compress=%t: ReadAll: %v", compress, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("compress=%t: status %d: %s", compress, resp.StatusCode, got)
+		}
+		if string(got) != body {
+			t.Fatalf("compress=%t: response body differs", compress)
+		}
+		if !resp.Uncompressed {
+			t.Errorf("compress=%t: response was not compressed", compress)
+		}
+		want := ""
+		if compress {
+			want = ContentEncoding
+		}
+		if wireEncoding != want {
+			t.Errorf("compress=%t: request Content-Encoding: got %q, want %q", compress, wireEncoding, want)
+		}
+		if h.contentEncoding != "" {
+			t.Errorf("compress=%t: handler saw Content-Encoding %q", compress, h.contentEncoding)
+		}
+	}
+}
+
+func TestDecoderWithoutSnappy(t *testing.T) {
+	s := httptest.NewServer(Decoder(&echoHandler{}))
+	defer s.Close()
+
+	// A client that does not know about snappy gets an uncompressed response.
+	req, err := http.NewRequest("POST", s.URL, strings.NewReader("plain"))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding: got %q, want none", ce)
+	}
+	if string(got) != "plain" {
+		t.Errorf("got %q, want %q", got, "plain")
+	}
+}
+
+func TestDecoderRawRequest(t *testing.T) {
+	s := httptest.NewServer(Decoder(&echoHandler{}))
+	defer s.Close()
+
+	buf := new(bytes.Buffer)
+	w := snappy.NewBufferedWriter(buf)
+	w.Write([]byte("framed"))
+	w.Close()
+	req, err := http.NewRequest("POST", s.URL, buf)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Encoding", ContentEncoding)
+	req.Header.Set("Accept-Encoding", "gzip, "+ContentEncoding+";q=0.5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+	if ce := resp.Header.Get("Content-Encoding"); ce != ContentEncoding {
+		t.Fatalf("Content-Encoding: got %q, want %q", ce, ContentEncoding)
+	}
+	got, err := ioutil.ReadAll(snappy.NewReader(resp.Body))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "framed" {
+		t.Errorf("got %q, want %q", got, "framed")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"errors"
+	"io"
+)
+
+var errInvalidShards = errors.New("snappy: invalid number of shards")
+
+// SplitFramed splits the stream r, in the framing format, into shards
+// streams, written to the elements of out, which must have that many, so
+// that they can be processed in parallel. Each shard is a complete stream of
+// its own, starting with a stream identifier, that holds some of r's data
+// chunks, whole and in their original order. Together, the shards hold all of
+// r's data, as blocks are independent of each other.
+//
+// Each data chunk goes to the shard that has been written the fewest bytes so
+// far, so the shards come out roughly equal in size. But the blocks are
+// interleaved across the shards, so only the order of the blocks within each
+// shard is that of r, which suits processing that does not depend on the
+// order of the records in the data, such as a map-reduce.
+//
+// Data chunks are copied as they are, without being decoded, and so without
+// their checksums being verified. Other chunks, such as padding and the
+// skippable chunks that this package writes, are dropped, as they describe
+// the stream as a whole. SplitFramed returns ErrUnsupported at a reserved
+// unskippable chunk, or else the first error from reading r, from the
+// framing of r being broken, or from writing to out.
+func SplitFramed(r io.Reader, shards int, out []io.Writer) error {
+	if shards < 1 || shards != len(out) {
+		return errInvalidShards
+	}
+	sizes := make([]int64, shards)
+	write := func(i int, p []byte) error {
+		n, err := out[i].Write(p)
+		sizes[i] += int64(n)
+		return err
+	}
+	for i := range out {
+		if err := write(i, []byte(magicChunk)); err != nil {
+			return err
+		}
+	}
+
+	fr := NewReader(r)
+	var buf []byte
+	for {
+		chunkType, body, err := fr.NextChunk()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case chunkType <= chunkTypeUncompressedData:
+		case chunkType <= 0x7f:
+			return ErrUnsupported
+		default:
+			continue
+		}
+		shard := 0
+		for i, size := range sizes {
+			if size < sizes[shard] {
+				shard = i
+			}
+		}
+		// Write the chunk's header and body together, in one Write.
+		buf = append(buf[:0], 0, 0, 0, 0)
+		putChunkHeader(buf, chunkType, len(body))
+		buf = append(buf, body...)
+		if err := write(shard, buf); err != nil {
+			return err
+		}
+	}
+}
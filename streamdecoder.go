@@ -0,0 +1,136 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+// A StreamDecoder decodes a stream in the framing format that is pushed to it
+// in arbitrary pieces, such as the payloads of network reads in an event loop,
+// rather than pulled from an io.Reader. Incomplete chunks, including chunk
+// headers that are split across pieces, are buffered until the rest arrives.
+//
+// It checks the stream exactly as a Reader does.
+type StreamDecoder struct {
+	err error
+	// buf[i:] holds the bytes fed but not yet consumed.
+	buf        []byte
+	i          int
+	decoded    []byte
+	readHeader bool
+}
+
+// NewStreamDecoder returns a new StreamDecoder.
+func NewStreamDecoder() *StreamDecoder {
+	return &StreamDecoder{}
+}
+
+// Feed appends p, the next piece of the stream, to the StreamDecoder's input.
+// The StreamDecoder does not retain p.
+func (d *StreamDecoder) Feed(p []byte) {
+	if d.err != nil {
+		return
+	}
+	if d.i == len(d.buf) {
+		d.buf, d.i = d.buf[:0], 0
+	} else if d.i > 0 && len(d.buf)+len(p) > cap(d.buf) {
+		n := copy(d.buf, d.buf[d.i:])
+		d.buf, d.i = d.buf[:n], 0
+	}
+	d.buf = append(d.buf, p...)
+}
+
+// Next returns the decoded contents of the next data chunk, and true. If the
+// input fed so far does not hold another complete data chunk, or the stream is
+// invalid, it returns false, and Err reports which.
+//
+// The returned slice is only valid until the next call to Feed or Next.
+func (d *StreamDecoder) Next() ([]byte, bool) {
+	for d.err == nil {
+		if len(d.buf)-d.i < chunkHeaderSize {
+			return nil, false
+		}
+		chunkType := d.buf[d.i]
+		chunkLen := int(d.buf[d.i+1]) | int(d.buf[d.i+2])<<8 | int(d.buf[d.i+3])<<16
+		if !d.readHeader {
+			if chunkType != chunkTypeStreamIdentifier {
+				d.err = ErrCorrupt
+				break
+			}
+			d.readHeader = true
+		}
+		if chunkLen > maxEncodedLenOfMaxBlockSize+checksumSize {
+			d.err = ErrUnsupported
+			break
+		}
+		if len(d.buf)-d.i < chunkHeaderSize+chunkLen {
+			return nil, false
+		}
+		body := d.buf[d.i+chunkHeaderSize : d.i+chunkHeaderSize+chunkLen]
+		d.i += chunkHeaderSize + chunkLen
+
+		// The chunk types are specified at
+		// https://github.com/google/snappy/blob/master/framing_format.txt
+		switch chunkType {
+		case chunkTypeCompressedData, chunkTypeUncompressedData:
+			if chunkLen < checksumSize {
+				d.err = ErrCorrupt
+				break
+			}
+			checksum := uint32(body[0]) | uint32(body[1])<<8 | uint32(body[2])<<16 | uint32(body[3])<<24
+			body = body[checksumSize:]
+			if chunkType == chunkTypeCompressedData {
+				n, err := DecodedLen(body)
+				if err != nil {
+					d.err = err
+					break
+				}
+				if n > maxBlockSize {
+					d.err = ErrCorrupt
+					break
+				}
+				if d.decoded == nil {
+					d.decoded = make([]byte, maxBlockSize)
+				}
+				if body, err = Decode(d.decoded, body); err != nil {
+					d.err = err
+					break
+				}
+			} else if len(body) > maxBlockSize {
+				d.err = ErrCorrupt
+				break
+			}
+			if crc(body) != checksum {
+				d.err = ErrCorrupt
+				break
+			}
+			return body, true
+
+		case chunkTypeStreamIdentifier:
+			if string(body) != magicBody {
+				d.err = ErrCorrupt
+			}
+
+		default:
+			if chunkType <= 0x7f {
+				// Reserved unskippable chunks (chunk types 0x02-0x7f).
+				d.err = ErrUnsupported
+			}
+			// Padding and reserved skippable chunks (chunk types 0x80-0xfe)
+			// are skipped.
+		}
+	}
+	return nil, false
+}
+
+// Err returns the error, if any, that stopped the StreamDecoder. It returns
+// nil if Next returned false only because it needs more input.
+func (d *StreamDecoder) Err() error {
+	return d.err
+}
+
+// Buffered returns the number of bytes fed but not yet consumed, such as
+// those of a partial chunk. When the input has ended, a non-zero Buffered
+// means that the stream was truncated.
+func (d *StreamDecoder) Buffered() int {
+	return len(d.buf) - d.i
+}
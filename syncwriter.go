@@ -0,0 +1,54 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"io"
+	"sync"
+)
+
+// A SyncWriter is a buffered Writer that is safe for concurrent use by
+// multiple goroutines. Each call to Write is atomic with respect to the
+// others: the bytes of one Write are never interleaved with those of another.
+//
+// All calls are serialized by a single mutex, so concurrent writers contend
+// for it, and the compression itself is not parallelized. Where the order of
+// bytes across goroutines does not matter, a Writer per goroutine, each with
+// its own output, scales better.
+type SyncWriter struct {
+	mu sync.Mutex
+	w  *Writer
+}
+
+// NewSyncWriter returns a new SyncWriter that compresses to w, as a Writer
+// returned by NewBufferedWriter would. Users must call Close to guarantee all
+// data has been forwarded to the underlying io.Writer.
+func NewSyncWriter(w io.Writer) *SyncWriter {
+	return &SyncWriter{
+		w: NewBufferedWriter(w),
+	}
+}
+
+// Write satisfies the io.Writer interface.
+func (s *SyncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// Flush flushes the SyncWriter to its underlying io.Writer.
+func (s *SyncWriter) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Flush()
+}
+
+// Close calls Flush and then closes the SyncWriter. It does not close the
+// underlying io.Writer.
+func (s *SyncWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
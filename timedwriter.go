@@ -0,0 +1,79 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A TimedWriter is a buffered Writer that also flushes itself once its input
+// has been idle for a given duration, bounding how long written bytes can sit
+// in its buffer before being forwarded to the underlying io.Writer.
+//
+// The flushing happens on a background goroutine. All of a TimedWriter's
+// methods are serialized with that goroutine, and so with each other.
+type TimedWriter struct {
+	mu     sync.Mutex
+	w      *Writer
+	d      time.Duration
+	timer  *time.Timer
+	closed bool
+}
+
+// NewBufferedWriterTimed returns a new TimedWriter that compresses to w, as a
+// Writer returned by NewBufferedWriter would, and that flushes any buffered
+// bytes once d has passed without a Write.
+//
+// Users must call Close to stop the background flushing and to guarantee all
+// data has been forwarded to the underlying io.Writer. Errors from background
+// flushes are returned by the next call to Write, Flush or Close.
+func NewBufferedWriterTimed(w io.Writer, d time.Duration) *TimedWriter {
+	t := &TimedWriter{
+		w: NewBufferedWriter(w),
+		d: d,
+	}
+	t.timer = time.AfterFunc(d, t.flushIdle)
+	t.timer.Stop()
+	return t
+}
+
+// flushIdle is called by t.timer.
+func (t *TimedWriter) flushIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.w.Flush()
+	}
+}
+
+// Write satisfies the io.Writer interface.
+func (t *TimedWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, err := t.w.Write(p)
+	if err == nil && len(t.w.ibuf) > 0 {
+		t.timer.Reset(t.d)
+	}
+	return n, err
+}
+
+// Flush flushes the TimedWriter to its underlying io.Writer.
+func (t *TimedWriter) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.w.Flush()
+}
+
+// Close stops the background flushing, and then calls Flush and closes the
+// TimedWriter. It does not close the underlying io.Writer.
+func (t *TimedWriter) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer.Stop()
+	t.closed = true
+	return t.w.Close()
+}
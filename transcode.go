@@ -0,0 +1,160 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"io"
+)
+
+// TranscodeFromReader reads uncompressed bytes from r until io.EOF, such as
+// from a gzip.Reader when converting an archive, and writes them to w as a
+// stream in the framing format. It uses a buffered Writer's ReadFrom, so data
+// is read straight into the Writer's block buffer, and a full block is
+// compressed as soon as it has been read.
+//
+// On success, the output is a complete stream, as if the Writer were closed.
+// The returned error is the first from reading r or writing w.
+func TranscodeFromReader(w io.Writer, r io.Reader) error {
+	sw := NewBufferedWriter(w)
+	if _, err := sw.ReadFrom(r); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// FramedToRawBlocks reads a stream in the framing format from r and writes the
+// block encoding (the format produced by Encode) of each of its data chunks to
+// w, back to back. Compressed chunks already hold such a block, so their bodies
+// are copied through without being decompressed. Uncompressed chunks are
+// encoded.
+//
+// The blocks are not delimited other than by their contents: each one starts
+// with the varint-encoded length of its decompressed bytes, but not with its
+// own encoded length.
+//
+// The checksums of compressed chunks are not verified, as doing so would
+// require decompressing them. The checksums of uncompressed chunks are.
+func FramedToRawBlocks(w io.Writer, r io.Reader) error {
+	fr := NewReader(r)
+	ebuf := make([]byte, maxEncodedLenOfMaxBlockSize)
+	for {
+		chunkType, body, err := fr.NextChunk()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var block []byte
+		switch chunkType {
+		case chunkTypeCompressedData:
+			block = body[checksumSize:]
+			n, err := DecodedLen(block)
+			if err != nil {
+				return err
+			}
+			if n > maxBlockSize {
+				return ErrCorrupt
+			}
+
+		case chunkTypeUncompressedData:
+			checksum := uint32(body[0]) | uint32(body[1])<<8 | uint32(body[2])<<16 | uint32(body[3])<<24
+			data := body[checksumSize:]
+			if len(data) > maxBlockSize || crc(data) != checksum {
+				return ErrCorrupt
+			}
+			block = Encode(ebuf, data)
+
+		case chunkTypeStreamIdentifier, chunkTypePadding:
+			continue
+
+		default:
+			if chunkType <= 0x7f {
+				// Reserved unskippable chunks (chunk types 0x02-0x7f).
+				return ErrUnsupported
+			}
+			// Reserved skippable chunks (chunk types 0x80-0xfd).
+			continue
+		}
+
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+	}
+}
+
+// PackBlocks writes a stream in the framing format to w, whose data chunks are
+// the given blocks, as returned by Encode, in order. The blocks are not
+// re-encoded, but each is decoded once to compute its chunk's checksum, which
+// also checks that it is valid. Each block must decode to at most 64 KiB, the
+// framing format's limit for a chunk, or PackBlocks returns ErrTooLarge.
+//
+// PackBlocksWithCRC does the same without decoding the blocks, given their
+// checksums.
+func PackBlocks(w io.Writer, blocks [][]byte) error {
+	return packBlocks(w, blocks, nil)
+}
+
+// PackBlocksWithCRC is like PackBlocks, but takes the masked checksum of each
+// block's decoded bytes, as returned by DecodeAndCRC, instead of decoding the
+// blocks to compute them. The blocks are not checked, other than for their
+// decoded lengths, so a wrong checksum or a corrupt block will only be
+// detected when the stream is read. The crcs must be the same length as
+// blocks.
+func PackBlocksWithCRC(w io.Writer, blocks [][]byte, crcs []uint32) error {
+	if len(crcs) != len(blocks) {
+		panic("snappy: PackBlocksWithCRC called with mismatched blocks and crcs")
+	}
+	return packBlocks(w, blocks, crcs)
+}
+
+// packBlocks implements PackBlocks and PackBlocksWithCRC. It computes the
+// checksums if crcs is nil.
+func packBlocks(w io.Writer, blocks [][]byte, crcs []uint32) error {
+	if _, err := io.WriteString(w, magicChunk); err != nil {
+		return err
+	}
+	var decoded []byte
+	if crcs == nil {
+		decoded = make([]byte, maxBlockSize)
+	}
+	var header [chunkHeaderSize + checksumSize]byte
+	for i, block := range blocks {
+		n, err := DecodedLen(block)
+		if err != nil {
+			return err
+		}
+		if n > maxBlockSize {
+			return ErrTooLarge
+		}
+		var checksum uint32
+		if crcs != nil {
+			checksum = crcs[i]
+		} else {
+			d, err := Decode(decoded, block)
+			if err != nil {
+				return err
+			}
+			checksum = crc(d)
+		}
+		chunkLen := checksumSize + len(block)
+		header[0] = chunkTypeCompressedData
+		header[1] = uint8(chunkLen >> 0)
+		header[2] = uint8(chunkLen >> 8)
+		header[3] = uint8(chunkLen >> 16)
+		header[4] = uint8(checksum >> 0)
+		header[5] = uint8(checksum >> 8)
+		header[6] = uint8(checksum >> 16)
+		header[7] = uint8(checksum >> 24)
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
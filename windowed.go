@@ -0,0 +1,372 @@
+// Copyright 2016 The Snappy-Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package snappy
+
+import (
+	"bufio"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// windowedInputSize is the size of a WindowedReader's input buffer.
+const windowedInputSize = 4096
+
+var errInvalidWindow = errors.New("snappy: invalid window size")
+
+// A WindowedReader is like a Reader, but uses a fixed amount of memory: a
+// window of decoded bytes, whose size is chosen by the caller, and a 4 KiB
+// input buffer. A Reader instead holds a whole chunk, compressed and decoded,
+// which can take up to about 140 KiB.
+//
+// It decodes each chunk's tags as they are read, into the window, which is a
+// ring buffer, and returns decoded bytes from Read as soon as they are
+// produced. They stay in the window, for later copy tags to refer to, until
+// they are overwritten by newer bytes, which happens once the window is full
+// and the caller has read them.
+//
+// As a consequence, a WindowedReader can only decode streams whose copy tags
+// never refer further back than the size of its window. A window of 65536
+// bytes, the largest allowed, can decode any stream, as the blocks within a
+// stream are at most that long. With a smaller window, a copy tag with a larger
+// offset makes Read return ErrUnsupported.
+//
+// Another consequence is that the bytes of a data chunk are returned before
+// its checksum is verified, which happens once the whole chunk has been
+// decoded. A checksum mismatch makes the next Read return ErrCorrupt, but the
+// caller has by then received the chunk's bytes.
+type WindowedReader struct {
+	r   *bufio.Reader
+	err error
+
+	// window is a ring buffer of decoded bytes, of which window[w] is the
+	// next to be written. unread is the number of bytes written but not yet
+	// returned by Read, which are those just before window[w].
+	window []byte
+	w      int
+	unread int
+
+	readHeader bool
+
+	// inChunk is whether a data chunk is being decoded, of which chunkLeft
+	// bytes are still to be read. Its decoded length is dLen, of which d bytes
+	// have been decoded so far, and whose CRC-32C is crc. checksum is the
+	// masked checksum that the chunk declares.
+	inChunk   bool
+	chunkLeft int
+	dLen, d   int
+	crc       uint32
+	checksum  uint32
+
+	// litLeft is the number of bytes of the current literal still to be read,
+	// and copyLeft is the number of bytes of the current copy still to be
+	// made, from copyOff bytes back.
+	litLeft  int
+	copyLeft int
+	copyOff  int
+}
+
+// NewWindowedReader returns a new WindowedReader that decompresses from r,
+// using a window of the given size, which must be in the range [1, 65536].
+// Otherwise, every Read returns an error.
+func NewWindowedReader(r io.Reader, window int) *WindowedReader {
+	x := &WindowedReader{
+		r: bufio.NewReaderSize(r, windowedInputSize),
+	}
+	if window < 1 || window > maxBlockSize {
+		x.err = errInvalidWindow
+	} else {
+		x.window = make([]byte, window)
+	}
+	return x
+}
+
+// Read satisfies the io.Reader interface.
+func (r *WindowedReader) Read(p []byte) (int, error) {
+	// Decode until there is enough to fill p, the window is full of unread
+	// bytes, or reading on would mean waiting for another chunk.
+	for r.unread < len(p) && r.unread < len(r.window) && r.err == nil {
+		if !r.inChunk && r.unread > 0 {
+			break
+		}
+		r.step()
+	}
+	if r.unread == 0 {
+		return 0, r.err
+	}
+
+	// The unread bytes end just before window[w], and may wrap around.
+	start := r.w - r.unread
+	if start < 0 {
+		start += len(r.window)
+	}
+	n := 0
+	for n < len(p) && r.unread > 0 {
+		end := start + r.unread
+		if end > len(r.window) {
+			end = len(r.window)
+		}
+		m := copy(p[n:], r.window[start:end])
+		n += m
+		r.unread -= m
+		start = 0
+	}
+	return n, nil
+}
+
+// step makes some progress in decoding the stream: it reads the next chunk
+// header, or tag, or decodes part of the current literal or copy. It sets
+// r.err if the stream ends or is invalid.
+func (r *WindowedReader) step() {
+	free := len(r.window) - r.unread
+	switch {
+	case !r.inChunk:
+		r.nextChunk()
+
+	case r.litLeft > 0:
+		n := r.litLeft
+		if n > free {
+			n = free
+		}
+		if n > len(r.window)-r.w {
+			n = len(r.window) - r.w
+		}
+		if !r.readFull(r.window[r.w : r.w+n]) {
+			return
+		}
+		r.litLeft -= n
+		r.produced(n)
+
+	case r.copyLeft > 0:
+		n := r.copyLeft
+		if n > free {
+			n = free
+		}
+		// The source and destination may overlap, and either may wrap around,
+		// so copy byte by byte.
+		from := r.w - r.copyOff
+		if from < 0 {
+			from += len(r.window)
+		}
+		for i, to := 0, r.w; i < n; i++ {
+			r.window[to] = r.window[from]
+			if to++; to == len(r.window) {
+				to = 0
+			}
+			if from++; from == len(r.window) {
+				from = 0
+			}
+		}
+		r.copyLeft -= n
+		r.produced(n)
+
+	case r.chunkLeft == 0 || r.d == r.dLen:
+		if r.chunkLeft != 0 || r.d != r.dLen || maskCRC(r.crc) != r.checksum {
+			r.err = ErrCorrupt
+			return
+		}
+		r.inChunk = false
+
+	default:
+		r.nextTag()
+	}
+}
+
+// produced records that n more bytes have been decoded into the window, from
+// window[w] onwards.
+func (r *WindowedReader) produced(n int) {
+	end := r.w + n
+	if end > len(r.window) {
+		r.crc = crc32.Update(r.crc, crcTable, r.window[r.w:])
+		end -= len(r.window)
+		r.crc = crc32.Update(r.crc, crcTable, r.window[:end])
+	} else {
+		r.crc = crc32.Update(r.crc, crcTable, r.window[r.w:end])
+	}
+	if end == len(r.window) {
+		end = 0
+	}
+	r.w = end
+	r.unread += n
+	r.d += n
+}
+
+// nextChunk reads chunks until it finds a data chunk, and then reads its
+// header.
+func (r *WindowedReader) nextChunk() {
+	var hdr [chunkHeaderSize + checksumSize]byte
+	for {
+		if _, err := io.ReadFull(r.r, hdr[:chunkHeaderSize]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = ErrCorrupt
+			}
+			r.err = err
+			return
+		}
+		chunkType := hdr[0]
+		if !r.readHeader {
+			if chunkType != chunkTypeStreamIdentifier {
+				r.err = ErrCorrupt
+				return
+			}
+			r.readHeader = true
+		}
+		chunkLen := int(hdr[1]) | int(hdr[2])<<8 | int(hdr[3])<<16
+		if chunkLen > maxEncodedLenOfMaxBlockSize+checksumSize {
+			r.err = ErrUnsupported
+			return
+		}
+		r.chunkLeft = chunkLen
+
+		switch chunkType {
+		case chunkTypeCompressedData, chunkTypeUncompressedData:
+			if !r.readFull(hdr[chunkHeaderSize:]) {
+				return
+			}
+			r.checksum = uint32(hdr[4]) | uint32(hdr[5])<<8 | uint32(hdr[6])<<16 | uint32(hdr[7])<<24
+			r.crc, r.d = 0, 0
+			if chunkType == chunkTypeUncompressedData {
+				r.dLen = r.chunkLeft
+				r.litLeft = r.chunkLeft
+			} else if !r.readDecodedLen() {
+				return
+			}
+			if r.dLen > maxBlockSize {
+				r.err = ErrCorrupt
+				return
+			}
+			r.inChunk = true
+			return
+
+		case chunkTypeStreamIdentifier:
+			var body [len(magicBody)]byte
+			if chunkLen != len(magicBody) {
+				r.err = ErrCorrupt
+				return
+			}
+			if !r.readFull(body[:]) {
+				return
+			}
+			if string(body[:]) != magicBody {
+				r.err = ErrCorrupt
+				return
+			}
+			continue
+		}
+
+		if chunkType <= 0x7f {
+			// Reserved unskippable chunks (chunk types 0x02-0x7f).
+			r.err = ErrUnsupported
+			return
+		}
+		// Padding and reserved skippable chunks (chunk types 0x80-0xfe) are
+		// skipped.
+		if _, err := r.r.Discard(chunkLen); err != nil {
+			r.err = ErrCorrupt
+			return
+		}
+	}
+}
+
+// readDecodedLen reads the varint-encoded decoded length that starts a block.
+func (r *WindowedReader) readDecodedLen() bool {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		var b [1]byte
+		if shift >= 35 || !r.readFull(b[:]) {
+			if r.err == nil {
+				r.err = ErrCorrupt
+			}
+			return false
+		}
+		v |= uint64(b[0]&0x7f) << shift
+		if b[0] < 0x80 {
+			break
+		}
+	}
+	if v > maxBlockSize {
+		r.err = ErrCorrupt
+		return false
+	}
+	r.dLen = int(v)
+	return true
+}
+
+// nextTag reads the next tag of the current block, and sets up the literal or
+// copy that it describes.
+func (r *WindowedReader) nextTag() {
+	var buf [5]byte
+	if !r.readFull(buf[:1]) {
+		return
+	}
+	tag := buf[0]
+	var length, offset int
+	switch tag & 0x03 {
+	case tagLiteral:
+		x := uint32(tag >> 2)
+		if x >= 60 {
+			// The length is in the next 1-4 bytes, little-endian.
+			n := int(x) - 59
+			if !r.readFull(buf[1 : 1+n]) {
+				return
+			}
+			x = 0
+			for i := n; i > 0; i-- {
+				x = x<<8 | uint32(buf[i])
+			}
+		}
+		length = int(x) + 1
+		if length <= 0 || length > r.dLen-r.d || length > r.chunkLeft {
+			r.err = ErrCorrupt
+			return
+		}
+		r.litLeft = length
+		return
+
+	case tagCopy1:
+		if !r.readFull(buf[1:2]) {
+			return
+		}
+		length = 4 + int(tag)>>2&0x7
+		offset = int(uint32(tag)&0xe0<<3 | uint32(buf[1]))
+
+	case tagCopy2:
+		if !r.readFull(buf[1:3]) {
+			return
+		}
+		length = 1 + int(tag)>>2
+		offset = int(uint32(buf[1]) | uint32(buf[2])<<8)
+
+	case tagCopy4:
+		if !r.readFull(buf[1:5]) {
+			return
+		}
+		length = 1 + int(tag)>>2
+		offset = int(uint32(buf[1]) | uint32(buf[2])<<8 | uint32(buf[3])<<16 | uint32(buf[4])<<24)
+	}
+	if offset <= 0 || offset > r.d || length > r.dLen-r.d {
+		r.err = ErrCorrupt
+		return
+	}
+	if offset > len(r.window) {
+		r.err = ErrUnsupported
+		return
+	}
+	r.copyLeft, r.copyOff = length, offset
+}
+
+// readFull reads len(p) bytes of the current chunk's body.
+func (r *WindowedReader) readFull(p []byte) bool {
+	if len(p) > r.chunkLeft {
+		r.err = ErrCorrupt
+		return false
+	}
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		r.err = ErrCorrupt
+		return false
+	}
+	r.chunkLeft -= len(p)
+	return true
+}